@@ -40,14 +40,8 @@ func InitDBCommand(root *cobra.Command) *cobra.Command {
 
 			l.Info("Initialize database")
 
-			switch config.Database.Type {
-			case "influxdb":
-				err := config.Database.InfluxDB.Setup(ctx)
-				if err != nil {
-					return err
-				}
-			default:
-				panic("invalid database type")
+			if err := config.Database.Setup(ctx); err != nil {
+				return err
 			}
 			return nil
 		},
@@ -16,16 +16,23 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/spf13/cobra"
+	"krishnaiyer.dev/golang/datasink/pkg/alert"
 	"krishnaiyer.dev/golang/datasink/pkg/database"
 	"krishnaiyer.dev/golang/datasink/pkg/device"
+	"krishnaiyer.dev/golang/datasink/pkg/heartbeat"
 	"krishnaiyer.dev/golang/datasink/pkg/http"
+	"krishnaiyer.dev/golang/datasink/pkg/metrics"
 	"krishnaiyer.dev/golang/datasink/pkg/mqtt"
+	"krishnaiyer.dev/golang/datasink/pkg/p1"
+	"krishnaiyer.dev/golang/datasink/pkg/pipeline"
+	"krishnaiyer.dev/golang/datasink/pkg/state"
 	conf "krishnaiyer.dev/golang/dry/pkg/config"
 	logger "krishnaiyer.dev/golang/dry/pkg/logger"
 )
@@ -36,10 +43,15 @@ const (
 
 // Config contains the configuration.
 type Config struct {
-	HTTP     http.Config     `name:"http"`
-	MQTT     mqtt.Config     `name:"mqtt"`
-	Database database.Config `name:"database"`
-	Devices  device.Config   `name:"devices"`
+	HTTP      http.Config          `name:"http"`
+	MQTT      mqtt.Config          `name:"mqtt"`
+	WebSocket mqtt.WebSocketConfig `name:"websocket"`
+	Database  database.Config      `name:"database"`
+	Devices   device.Config        `name:"devices"`
+	P1        p1.Config            `name:"p1"`
+	State     state.Config         `name:"state"`
+	Alerts    alert.Config         `name:"alerts"`
+	Heartbeat heartbeat.Config     `name:"heartbeat"`
 }
 
 var (
@@ -76,38 +88,145 @@ var (
 			}
 			ctx = logger.NewContextWithLogger(ctx, l)
 
+			// The error channel is not closed, since the servers may still return errors during shutdown.
 			errCh := make(chan error)
-			defer close(errCh)
 
-			var database database.Database
-			switch config.Database.Type {
-			case "influxdb":
-				// Create Client.
-				client := config.Database.InfluxDB.NewClient(ctx)
-				database = client
+			database, err := config.Database.New(ctx)
+			if err != nil {
+				return err
 			}
-			defer database.Close(ctx)
+			// Stop the producers before closing the database. The database is closed with a context that is not
+			// canceled so that the pending entries are still written.
+			defer func() {
+				cancel()
+				database.Close(logger.NewContextWithLogger(baseCtx, l))
+			}()
 
-			// Start the HTTP Server.
+			// Start the MQTT Server.
+			// The message channel is not closed, since the producers may still send messages during shutdown.
+			messageCh := make(chan *mqtt.Message, defaultBufferSize)
+			if err := metrics.RegisterMessageQueue(func() int { return len(messageCh) }, cap(messageCh)); err != nil {
+				return err
+			}
+			mqttServer, err := mqtt.New(ctx, config.MQTT, messageCh)
+			if err != nil {
+				return err
+			}
 			go func() {
-				s := http.New(config.HTTP)
-				err = s.Start(ctx)
+				err := mqttServer.Start(ctx)
 				if err != nil {
 					errCh <- err
 					return
 				}
 			}()
 
-			// Start the MQTT Server.
-			messageCh := make(chan *mqtt.Message, defaultBufferSize)
-			defer close(messageCh)
-			go func() {
-				s, err := mqtt.New(ctx, config.MQTT, messageCh)
+			// Start the MQTT TLS Server.
+			if config.MQTT.TLS.Addr != "" {
+				go func() {
+					err := mqttServer.StartTLS(ctx)
+					if err != nil {
+						errCh <- err
+						return
+					}
+				}()
+			}
+
+			// Start the WebSocket Server.
+			if config.WebSocket.Addr != "" {
+				go func() {
+					err := mqttServer.StartWebSocket(ctx, config.WebSocket)
+					if err != nil {
+						errCh <- err
+						return
+					}
+				}()
+			}
+
+			// Start the P1 reader.
+			var p1Reader *p1.Reader
+			if config.P1.Path != "" {
+				p1Reader, err = p1.New(config.P1, messageCh)
 				if err != nil {
-					errCh <- err
-					return
+					return err
+				}
+				go func() {
+					err := p1Reader.Start(ctx)
+					if err != nil {
+						errCh <- err
+						return
+					}
+				}()
+			}
+
+			router, err := config.Devices.NewRouter()
+			if err != nil {
+				return err
+			}
+			pipeline := pipeline.New(router, database)
+
+			// Keep the latest values and save them on shutdown.
+			store, err := config.State.NewStore()
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := store.Save(); err != nil {
+					l.WithError(err).Error("Failed to save state")
 				}
-				err = s.Start(ctx)
+			}()
+			pipeline.AddObserver(store)
+
+			// Stream the processed messages to HTTP clients.
+			stream, err := config.HTTP.Stream.NewStream()
+			if err != nil {
+				return err
+			}
+			pipeline.AddListener(stream)
+
+			// Evaluate the alert rules on the parsed entries.
+			alerts, err := config.Alerts.NewEngine()
+			if err != nil {
+				return err
+			}
+			pipeline.AddObserver(alerts)
+			go alerts.Run(ctx)
+
+			// Record the status of devices that stop sending messages.
+			monitor, err := config.Heartbeat.NewMonitor(database)
+			if err != nil {
+				return err
+			}
+			pipeline.AddListener(monitor)
+			go monitor.Run(ctx)
+
+			// Start the HTTP Server.
+			httpServer, err := http.New(config.HTTP)
+			if err != nil {
+				return err
+			}
+			httpServer.RegisterIngester(pipeline, mqttServer.ACL())
+			httpServer.RegisterQuerier(database)
+			httpServer.RegisterState(store)
+			httpServer.RegisterStream(stream)
+			httpServer.RegisterDeviceMonitor(monitor)
+			httpServer.RegisterCheck("mqtt", true, mqttServer.CheckListeners)
+			httpServer.RegisterCheck("auth", true, mqttServer.CheckAuth)
+			httpServer.RegisterCheck("database", true, func(ctx context.Context) (any, error) {
+				return nil, database.Ping(ctx)
+			})
+			httpServer.RegisterCheck("queue", false, func(ctx context.Context) (any, error) {
+				length, capacity := len(messageCh), cap(messageCh)
+				details := map[string]int{"length": length, "capacity": capacity}
+				if length >= capacity {
+					return details, errors.New("message queue full")
+				}
+				return details, nil
+			})
+			if p1Reader != nil {
+				httpServer.RegisterCheck("p1", false, p1Reader.Check)
+			}
+			go func() {
+				err := httpServer.Start(ctx)
 				if err != nil {
 					errCh <- err
 					return
@@ -115,46 +234,19 @@ var (
 			}()
 
 			// Listen for messages and write to database.
-			go func() {
-				for {
-					select {
-					case <-ctx.Done():
-						return
-					case msg := <-messageCh:
-						if msg == nil {
-							continue
-						}
-						parser, err := config.Devices.GetParser(ctx, msg.Topic)
-						if err != nil {
-							l.WithError(err).Warn("Skip message")
-							continue
-						}
-						entry, err := parser.Parse(ctx, msg.Username, msg.Topic, msg.Payload)
-						if err != nil {
-							l.WithError(err).Warn("Skip message")
-							continue
-						}
-						if entry != nil {
-							err := database.Record(ctx, *entry)
-							if err != nil {
-								l.WithError(err).Error("Error writing to database")
-							}
-						}
-					}
-				}
-			}()
+			go pipeline.Run(ctx, messageCh)
 
+			// Wait for an error or a signal to stop the server.
+			sigChan := make(chan os.Signal, 1)
+			signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 			select {
 			case err := <-errCh:
+				l.WithError(err).Error("Server failed. Shut down server")
 				return err
 			case <-ctx.Done():
 				return ctx.Err()
-			default:
-				// Wait for a signal to stop the server.
-				sigChan := make(chan os.Signal, 1)
-				signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-				signal := (<-sigChan).String()
-				l.WithField("signal", signal).Info("Signal received. Shut down server")
+			case sig := <-sigChan:
+				l.WithField("signal", sig.String()).Info("Signal received. Shut down server")
 				return nil
 			}
 		},
@@ -0,0 +1,442 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package alert evaluates alert rules on the parsed entries and notifies when alerts fire and resolve.
+package alert
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+	"krishnaiyer.dev/golang/datasink/pkg/topic"
+	"krishnaiyer.dev/golang/dry/pkg/logger"
+)
+
+// States of an alert.
+const (
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+const (
+	// defaultInterval is the default interval at which the rules are evaluated.
+	defaultInterval = 10 * time.Second
+	// queueSize is the number of notifications that are queued for delivery.
+	queueSize = 64
+)
+
+// operators are the comparisons of a value with the threshold.
+var operators = map[string]func(v, threshold float64) bool{
+	">":  func(v, threshold float64) bool { return v > threshold },
+	">=": func(v, threshold float64) bool { return v >= threshold },
+	"<":  func(v, threshold float64) bool { return v < threshold },
+	"<=": func(v, threshold float64) bool { return v <= threshold },
+	"==": func(v, threshold float64) bool { return v == threshold },
+	"!=": func(v, threshold float64) bool { return v != threshold },
+}
+
+// Config configures the alerts.
+type Config struct {
+	Rules     []Rule                    `name:"rules" description:"alert rules"`
+	Notifiers map[string]NotifierConfig `name:"notifiers" description:"named notifiers"`
+	Interval  time.Duration             `name:"interval" description:"interval at which durations and absence are evaluated (default 10s)"`
+}
+
+// Rule is an alert rule. A rule either compares a field with a threshold or detects the absence of entries.
+// Alerts are tracked per set of tags of the entries that match the rule.
+type Rule struct {
+	Name        string            `name:"name" description:"name of the rule"`
+	Measurement string            `name:"measurement" description:"measurement of the entries"`
+	Tags        map[string]string `name:"tags" description:"tag values that the entries must have"`
+	Field       string            `name:"field" description:"field that is compared. For absence rules, leave empty to match any field"`
+	Operator    string            `name:"operator" description:"comparison of the field with the threshold. Supported values are '>', '>=', '<', '<=', '==' and '!='"`
+	Threshold   float64           `name:"threshold" description:"threshold that the field is compared with"`
+	Hysteresis  float64           `name:"hysteresis" description:"margin beyond the threshold that the field must return to before the alert resolves"`
+	For         time.Duration     `name:"for" description:"duration that the condition must hold before the alert fires"`
+	Absent      time.Duration     `name:"absent" description:"fire if no entries are received for this duration. Leave empty for threshold rules"`
+	Notifiers   []string          `name:"notifiers" description:"names of the notifiers. Leave empty to use all notifiers"`
+}
+
+// validate returns an error if the rule is invalid.
+func (r Rule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("invalid rule: missing name")
+	}
+	// The name is a topic level of MQTT alerts.
+	if strings.ContainsAny(r.Name, topic.Separator+topic.Wildcard+topic.PartWildcard) {
+		return fmt.Errorf("invalid rule name '%s': names must not contain '/', '+' or '#'", r.Name)
+	}
+	if r.Measurement == "" {
+		return fmt.Errorf("invalid rule '%s': missing measurement", r.Name)
+	}
+	if r.Absent < 0 || r.For < 0 || r.Hysteresis < 0 {
+		return fmt.Errorf("invalid rule '%s': durations and hysteresis must not be negative", r.Name)
+	}
+	if r.Absent > 0 {
+		if r.Operator != "" || r.For > 0 || r.Hysteresis > 0 {
+			return fmt.Errorf("invalid rule '%s': absence rules have no operator, duration or hysteresis", r.Name)
+		}
+		return nil
+	}
+	if r.Field == "" {
+		return fmt.Errorf("invalid rule '%s': missing field", r.Name)
+	}
+	if _, ok := operators[r.Operator]; !ok {
+		return fmt.Errorf("invalid operator '%s' in rule '%s'. Supported values are '>', '>=', '<', '<=', '==' and '!='", r.Operator, r.Name)
+	}
+	if r.Hysteresis > 0 && (r.Operator == "==" || r.Operator == "!=") {
+		return fmt.Errorf("invalid rule '%s': hysteresis requires an ordered operator", r.Name)
+	}
+	return nil
+}
+
+// description returns a human readable description of the condition of the rule.
+func (r Rule) description() string {
+	if r.Absent > 0 {
+		if r.Field != "" {
+			return fmt.Sprintf("no %s for %s", r.Field, r.Absent)
+		}
+		return fmt.Sprintf("no %s for %s", r.Measurement, r.Absent)
+	}
+	return fmt.Sprintf("%s %s %v", r.Field, r.Operator, r.Threshold)
+}
+
+// condition returns true if the value meets the condition of the rule.
+func (r Rule) condition(v float64) bool {
+	return operators[r.Operator](v, r.Threshold)
+}
+
+// resolved returns true if the value is beyond the threshold by the hysteresis.
+func (r Rule) resolved(v float64) bool {
+	switch r.Operator {
+	case ">", ">=":
+		return !r.condition(v + r.Hysteresis)
+	case "<", "<=":
+		return !r.condition(v - r.Hysteresis)
+	default:
+		return !r.condition(v)
+	}
+}
+
+// matches returns true if the entry matches the measurement and tags of the rule.
+func (r Rule) matches(e entry.Entry) bool {
+	if e.Measurement != r.Measurement {
+		return false
+	}
+	for k, v := range r.Tags {
+		if e.Tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Alert is a notification of an alert that fired or resolved.
+type Alert struct {
+	Rule        string            `json:"rule"`
+	State       string            `json:"state"`
+	Description string            `json:"description"`
+	Measurement string            `json:"measurement"`
+	Field       string            `json:"field,omitempty"`
+	Tags        map[string]string `json:"tags"`
+	// Value is the latest value of the field. It is nil for absence rules.
+	Value any `json:"value,omitempty"`
+	// Since is the time that the condition started to hold.
+	Since time.Time `json:"since"`
+	// Time is the time that the alert fired or resolved.
+	Time time.Time `json:"time"`
+}
+
+// state is the state of the alert of a rule for a set of tags.
+type state struct {
+	tags map[string]string
+	// state is empty if the alert is inactive.
+	state string
+	since time.Time
+	value any
+	// seen is the time of the latest entry.
+	seen time.Time
+}
+
+type rule struct {
+	Rule
+	notifiers []Notifier
+	alerts    map[string]*state
+	// seeded is the key of the state that is seeded from the tags of the rule, until the first matching entry.
+	seeded string
+}
+
+type notification struct {
+	alert     Alert
+	notifiers []Notifier
+}
+
+// Engine evaluates the rules.
+type Engine struct {
+	rules    []*rule
+	interval time.Duration
+	now      func() time.Time
+	queue    chan notification
+
+	mu sync.Mutex
+}
+
+// NewEngine validates the rules and notifiers and returns a new Engine.
+func (c Config) NewEngine() (*Engine, error) {
+	if c.Interval < 0 {
+		return nil, fmt.Errorf("invalid interval '%s'", c.Interval)
+	}
+	if c.Interval == 0 {
+		c.Interval = defaultInterval
+	}
+	notifiers := make(map[string]Notifier, len(c.Notifiers))
+	names := make([]string, 0, len(c.Notifiers))
+	for name, nc := range c.Notifiers {
+		n, err := nc.NewNotifier()
+		if err != nil {
+			return nil, fmt.Errorf("notifier '%s': %w", name, err)
+		}
+		notifiers[name] = n
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	e := &Engine{
+		interval: c.Interval,
+		now:      time.Now,
+		queue:    make(chan notification, queueSize),
+	}
+	seen := make(map[string]bool, len(c.Rules))
+	for _, r := range c.Rules {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+		if seen[r.Name] {
+			return nil, fmt.Errorf("duplicate rule '%s'", r.Name)
+		}
+		seen[r.Name] = true
+		selected := r.Notifiers
+		if len(selected) == 0 {
+			selected = names
+		}
+		rl := &rule{
+			Rule:   r,
+			alerts: make(map[string]*state),
+		}
+		for _, name := range selected {
+			n, ok := notifiers[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown notifier '%s' in rule '%s'", name, r.Name)
+			}
+			rl.notifiers = append(rl.notifiers, n)
+		}
+		e.rules = append(e.rules, rl)
+	}
+	e.seed(e.now())
+	return e, nil
+}
+
+// seed watches the devices that absence rules identify by their tags from the start time, so that a device that
+// doesn't send entries after a restart fires the alert.
+func (e *Engine) seed(start time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, r := range e.rules {
+		if r.Absent == 0 || r.Tags[entry.IDTag] == "" {
+			continue
+		}
+		r.alerts = make(map[string]*state)
+		r.seeded = tagsKey(r.Tags)
+		r.alerts[r.seeded] = &state{
+			tags: r.Tags,
+			seen: start,
+		}
+	}
+}
+
+// Observe evaluates the rules that match the entry.
+func (e *Engine) Observe(ctx context.Context, ent entry.Entry) {
+	now := e.now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, r := range e.rules {
+		if !r.matches(ent) {
+			continue
+		}
+		if r.Absent > 0 {
+			if r.Field != "" {
+				if _, ok := ent.Fields[r.Field]; !ok {
+					continue
+				}
+			}
+			a := r.state(ent.Tags)
+			a.seen = now
+			if a.state == StateFiring {
+				e.notify(ctx, r, a, StateResolved, now)
+				a.state = ""
+			}
+			if r.seeded != "" {
+				// The entries of the device have more tags than the rule, so they are tracked instead.
+				if seeded := r.alerts[r.seeded]; seeded != a {
+					if seeded.state == StateFiring {
+						e.notify(ctx, r, seeded, StateResolved, now)
+					}
+					delete(r.alerts, r.seeded)
+				}
+				r.seeded = ""
+			}
+			continue
+		}
+		value, ok := ent.Fields[r.Field]
+		if !ok {
+			continue
+		}
+		v, ok := query.Float(value)
+		if !ok {
+			continue
+		}
+		a := r.state(ent.Tags)
+		a.value, a.seen = value, now
+		switch a.state {
+		case "":
+			if r.condition(v) {
+				a.state, a.since = StatePending, now
+				e.evaluateFor(ctx, r, a, now)
+			}
+		case StatePending:
+			if !r.condition(v) {
+				a.state = ""
+				break
+			}
+			e.evaluateFor(ctx, r, a, now)
+		case StateFiring:
+			if r.resolved(v) {
+				e.notify(ctx, r, a, StateResolved, now)
+				a.state = ""
+			}
+		}
+	}
+}
+
+// evaluateFor fires the pending alert if the condition held for the duration of the rule.
+func (e *Engine) evaluateFor(ctx context.Context, r *rule, a *state, now time.Time) {
+	if now.Sub(a.since) >= r.For {
+		a.state = StateFiring
+		e.notify(ctx, r, a, StateFiring, now)
+	}
+}
+
+// evaluate fires the pending alerts of which the duration passed and the absence alerts.
+func (e *Engine) evaluate(ctx context.Context) {
+	now := e.now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, r := range e.rules {
+		for _, a := range r.alerts {
+			switch {
+			case r.Absent > 0 && a.state == "" && now.Sub(a.seen) >= r.Absent:
+				a.state, a.since = StateFiring, a.seen
+				e.notify(ctx, r, a, StateFiring, now)
+			case a.state == StatePending:
+				e.evaluateFor(ctx, r, a, now)
+			}
+		}
+	}
+}
+
+// state returns the state of the alert of the rule for the tags.
+func (r *rule) state(tags map[string]string) *state {
+	key := tagsKey(tags)
+	a, ok := r.alerts[key]
+	if !ok {
+		a = &state{tags: tags}
+		r.alerts[key] = a
+	}
+	return a
+}
+
+// notify queues the notification of the alert. If the queue is full, the notification is dropped.
+func (e *Engine) notify(ctx context.Context, r *rule, a *state, st string, now time.Time) {
+	alert := Alert{
+		Rule:        r.Name,
+		State:       st,
+		Description: r.description(),
+		Measurement: r.Measurement,
+		Field:       r.Field,
+		Tags:        a.tags,
+		Value:       a.value,
+		Since:       a.since,
+		Time:        now,
+	}
+	logger := logger.LoggerFromContext(ctx).WithField("rule", r.Name).WithField("state", st)
+	if len(r.notifiers) == 0 {
+		logger.Debug("No notifiers for alert")
+		return
+	}
+	select {
+	case e.queue <- notification{alert: alert, notifiers: r.notifiers}:
+	default:
+		logger.Error("Alert queue full. Drop notification")
+	}
+}
+
+// Run evaluates the rules at the interval and delivers the notifications until the context is done.
+func (e *Engine) Run(ctx context.Context) {
+	go e.deliver(ctx)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.evaluate(ctx)
+		}
+	}
+}
+
+// deliver sends the queued notifications to the notifiers.
+func (e *Engine) deliver(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-e.queue:
+			for _, notifier := range n.notifiers {
+				if err := notifier.Notify(ctx, n.alert); err != nil {
+					logger.LoggerFromContext(ctx).WithError(err).WithField("rule", n.alert.Rule).Error("Failed to send alert notification")
+				}
+			}
+		}
+	}
+}
+
+// tagsKey returns the key of a set of tags.
+func tagsKey(tags map[string]string) string {
+	keys := entry.SortedKeys(tags)
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString(key)
+		b.WriteByte(0)
+		b.WriteString(tags[key])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
@@ -0,0 +1,237 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alert
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+)
+
+func newEngine(t *testing.T, rules []Rule, now *time.Time) *Engine {
+	t.Helper()
+	e, err := Config{
+		Rules:     rules,
+		Notifiers: map[string]NotifierConfig{"log": {Type: TypeLog}},
+	}.NewEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.now = func() time.Time { return *now }
+	e.seed(*now)
+	return e
+}
+
+// notifications returns the states of the queued notifications.
+func notifications(e *Engine) []string {
+	var states []string
+	for {
+		select {
+		case n := <-e.queue:
+			states = append(states, n.alert.Rule+":"+n.alert.Tags["id"]+":"+n.alert.State)
+		default:
+			return states
+		}
+	}
+}
+
+func expectNotifications(t *testing.T, e *Engine, expected ...string) {
+	t.Helper()
+	actual := notifications(e)
+	if len(actual) != len(expected) {
+		t.Fatalf("expected notifications %v, got %v", expected, actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("expected notifications %v, got %v", expected, actual)
+		}
+	}
+}
+
+func TestThreshold(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	e := newEngine(t, []Rule{{
+		Name:        "high-usage",
+		Measurement: "smartmeter",
+		Field:       "electricity_hourly_usage",
+		Operator:    ">",
+		Threshold:   5,
+		Hysteresis:  1,
+		For:         10 * time.Minute,
+	}}, &now)
+	observe := func(id string, value any) {
+		e.Observe(ctx, entry.Entry{
+			Measurement: "smartmeter",
+			Tags:        map[string]string{"id": id},
+			Fields:      map[string]any{"electricity_hourly_usage": value},
+		})
+	}
+
+	// The condition must hold for the duration.
+	observe("meter-1", 6.0)
+	observe("meter-2", 4.0)
+	now = now.Add(5 * time.Minute)
+	observe("meter-1", 4.0)
+	observe("meter-1", 7.0)
+	now = now.Add(9 * time.Minute)
+	e.evaluate(ctx)
+	expectNotifications(t, e)
+	now = now.Add(time.Minute)
+	e.evaluate(ctx)
+	expectNotifications(t, e, "high-usage:meter-1:firing")
+
+	// The alert resolves when the value drops below the threshold minus the hysteresis.
+	observe("meter-1", 4.5)
+	expectNotifications(t, e)
+	observe("meter-1", 3.5)
+	expectNotifications(t, e, "high-usage:meter-1:resolved")
+
+	// Values that are not numbers are ignored.
+	observe("meter-1", "high")
+	expectNotifications(t, e)
+}
+
+func TestThresholdWithoutDuration(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	e := newEngine(t, []Rule{{
+		Name:        "freezing",
+		Measurement: "climate",
+		Tags:        map[string]string{"room": "garden"},
+		Field:       "temperature",
+		Operator:    "<=",
+		Threshold:   0,
+	}}, &now)
+	for _, tc := range []struct {
+		room        string
+		temperature float64
+	}{
+		{"kitchen", -5},
+		{"garden", -1},
+		{"garden", -2},
+		{"garden", 1},
+	} {
+		e.Observe(ctx, entry.Entry{
+			Measurement: "climate",
+			Tags:        map[string]string{"id": "sensor-1", "room": tc.room},
+			Fields:      map[string]any{"temperature": tc.temperature},
+		})
+	}
+	expectNotifications(t, e, "freezing:sensor-1:firing", "freezing:sensor-1:resolved")
+}
+
+func TestAbsent(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	e := newEngine(t, []Rule{{
+		Name:        "silent",
+		Measurement: "smartmeter",
+		Absent:      15 * time.Minute,
+	}}, &now)
+	observe := func(id string) {
+		e.Observe(ctx, entry.Entry{
+			Measurement: "smartmeter",
+			Tags:        map[string]string{"id": id},
+			Fields:      map[string]any{"power": 1.5},
+		})
+	}
+
+	observe("meter-1")
+	observe("meter-2")
+	now = now.Add(10 * time.Minute)
+	observe("meter-2")
+	now = now.Add(5 * time.Minute)
+	e.evaluate(ctx)
+	expectNotifications(t, e, "silent:meter-1:firing")
+	// Firing alerts don't notify again.
+	now = now.Add(time.Minute)
+	e.evaluate(ctx)
+	expectNotifications(t, e)
+
+	observe("meter-1")
+	expectNotifications(t, e, "silent:meter-1:resolved")
+}
+
+func TestConfig(t *testing.T) {
+	for _, c := range []Config{
+		{Interval: -time.Second},
+		{Rules: []Rule{{Measurement: "smartmeter", Field: "power", Operator: ">"}}},
+		{Rules: []Rule{{Name: "home/rule", Measurement: "smartmeter", Field: "power", Operator: ">"}}},
+		{Rules: []Rule{{Name: "rule", Field: "power", Operator: ">"}}},
+		{Rules: []Rule{{Name: "rule", Measurement: "smartmeter", Operator: ">"}}},
+		{Rules: []Rule{{Name: "rule", Measurement: "smartmeter", Field: "power", Operator: "=~"}}},
+		{Rules: []Rule{{Name: "rule", Measurement: "smartmeter", Field: "power", Operator: "==", Hysteresis: 1}}},
+		{Rules: []Rule{{Name: "rule", Measurement: "smartmeter", Operator: ">", Absent: time.Minute}}},
+		{Rules: []Rule{{Name: "rule", Measurement: "smartmeter", Absent: time.Minute, Notifiers: []string{"unknown"}}}},
+		{Rules: []Rule{
+			{Name: "rule", Measurement: "smartmeter", Absent: time.Minute},
+			{Name: "rule", Measurement: "climate", Absent: time.Minute},
+		}},
+		{Notifiers: map[string]NotifierConfig{"email": {Type: "email"}}},
+	} {
+		if _, err := c.NewEngine(); err == nil {
+			t.Fatalf("expected error for %+v", c)
+		}
+	}
+}
+
+func TestAbsentSeeded(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	e := newEngine(t, []Rule{
+		{
+			Name:        "silent",
+			Measurement: "smartmeter",
+			Tags:        map[string]string{"id": "meter-1"},
+			Absent:      15 * time.Minute,
+		},
+		{
+			Name:        "silent-room",
+			Measurement: "climate",
+			Tags:        map[string]string{"id": "climate"},
+			Absent:      15 * time.Minute,
+		},
+		{
+			// Rules that don't identify a device are not seeded.
+			Name:        "silent-any",
+			Measurement: "smartmeter",
+			Absent:      15 * time.Minute,
+		},
+	}, &now)
+
+	// The devices of the rules are watched from the start, without entries.
+	now = now.Add(15 * time.Minute)
+	e.evaluate(ctx)
+	expectNotifications(t, e, "silent:meter-1:firing", "silent-room:climate:firing")
+
+	e.Observe(ctx, entry.Entry{
+		Measurement: "smartmeter",
+		Tags:        map[string]string{"id": "meter-1"},
+		Fields:      map[string]any{"power": 1.5},
+	})
+	// The entries have more tags than the rule, so the seeded alert resolves and the entries are tracked instead.
+	e.Observe(ctx, entry.Entry{
+		Measurement: "climate",
+		Tags:        map[string]string{"id": "climate", "room": "kitchen"},
+		Fields:      map[string]any{"temperature": 21.5},
+	})
+	expectNotifications(t, e, "silent:meter-1:resolved", "silent-room:climate:resolved")
+	if n := len(e.rules[1].alerts); n != 1 {
+		t.Fatalf("expected 1 alert of the room rule, got %d", n)
+	}
+}
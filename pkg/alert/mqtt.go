@@ -0,0 +1,143 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/topic"
+)
+
+// topicLevelEscaper replaces the characters that are not allowed in a topic level.
+var topicLevelEscaper = strings.NewReplacer(topic.Separator, "_", topic.Wildcard, "_", topic.PartWildcard, "_", "\x00", "_")
+
+const (
+	defaultMQTTTopic    = "alerts"
+	defaultMQTTClientID = "datasink-alerts"
+)
+
+// MQTTConfig configures the MQTT notifier.
+type MQTTConfig struct {
+	Addr     string        `name:"address" description:"address of the MQTT broker, like 'localhost:1883'"`
+	Username string        `name:"username" description:"username to connect with"`
+	Password string        `name:"password" description:"password to connect with"`
+	ClientID string        `name:"client-id" description:"client ID to connect with (default 'datasink-alerts')"`
+	Topic    string        `name:"topic" description:"topic prefix. Alerts are published to '<topic>/<rule>/<tag>=<value>/...' (default 'alerts')"`
+	Retain   bool          `name:"retain" description:"retain the latest alert of each rule and set of tags"`
+	Timeout  time.Duration `name:"timeout" description:"timeout of publishing an alert (default 10s)"`
+}
+
+// Publisher publishes the alerts as JSON to an MQTT broker.
+// A connection is made for every alert, since alerts are rare.
+type Publisher struct {
+	c MQTTConfig
+}
+
+// NewPublisher returns a new Publisher.
+func (c MQTTConfig) NewPublisher() (*Publisher, error) {
+	if c.Addr == "" {
+		return nil, fmt.Errorf("invalid MQTT address '%s'", c.Addr)
+	}
+	if c.Topic == "" {
+		c.Topic = defaultMQTTTopic
+	}
+	if err := topic.ValidateTopic(c.Topic); err != nil {
+		return nil, fmt.Errorf("invalid MQTT topic '%s'", c.Topic)
+	}
+	if c.ClientID == "" {
+		c.ClientID = defaultMQTTClientID
+	}
+	if c.Timeout < 0 {
+		return nil, fmt.Errorf("invalid timeout '%s'", c.Timeout)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultTimeout
+	}
+	return &Publisher{c: c}, nil
+}
+
+// topic returns the topic of the alert. The tags are part of the topic, so that every set of tags has its own retained alert.
+func (p *Publisher) topic(a Alert) string {
+	parts := []string{p.c.Topic, a.Rule}
+	for _, key := range entry.SortedKeys(a.Tags) {
+		parts = append(parts, topicLevelEscaper.Replace(key)+"="+topicLevelEscaper.Replace(a.Tags[key]))
+	}
+	return strings.Join(parts, topic.Separator)
+}
+
+// Notify implements Notifier. The alert is published with QoS 1.
+func (p *Publisher) Notify(ctx context.Context, a Alert) error {
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.c.Timeout)
+	defer cancel()
+	conn, err := mqttnet.DialContext(ctx, "tcp", p.c.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.NetConn().SetDeadline(deadline)
+	}
+
+	if err := conn.Send(&packet.ConnectPacket{
+		ProtocolName:  "MQTT",
+		ProtocolLevel: 4,
+		CleanStart:    true,
+		ClientID:      p.c.ClientID,
+		Username:      p.c.Username,
+		Password:      []byte(p.c.Password),
+	}); err != nil {
+		return err
+	}
+	res, err := conn.Receive()
+	if err != nil {
+		return err
+	}
+	connack, ok := res.(*packet.ConnackPacket)
+	if !ok {
+		return fmt.Errorf("unexpected MQTT packet type %d", res.PacketType())
+	}
+	if connack.ReturnCode != packet.ConnectAccepted {
+		return fmt.Errorf("connect to MQTT broker: %w", connack.ReturnCode)
+	}
+
+	if err := conn.Send(&packet.PublishPacket{
+		QoS:              packet.AtLeastOnce,
+		Retain:           p.c.Retain,
+		PacketIdentifier: 1,
+		TopicName:        p.topic(a),
+		Message:          payload,
+	}); err != nil {
+		return err
+	}
+	res, err = conn.Receive()
+	if err != nil {
+		return err
+	}
+	if _, ok := res.(*packet.PubackPacket); !ok {
+		return fmt.Errorf("unexpected MQTT packet type %d", res.PacketType())
+	}
+	return conn.Send(&packet.DisconnectPacket{})
+}
@@ -0,0 +1,77 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alert
+
+import (
+	"context"
+	"fmt"
+
+	"krishnaiyer.dev/golang/dry/pkg/logger"
+)
+
+// Notifier types.
+const (
+	TypeLog     = "log"
+	TypeWebhook = "webhook"
+	TypeMQTT    = "mqtt"
+)
+
+// Notifier sends alert notifications.
+type Notifier interface {
+	Notify(ctx context.Context, a Alert) error
+}
+
+// NotifierConfig configures a notifier.
+type NotifierConfig struct {
+	Type    string        `name:"type" description:"notifier type. Supported values are 'log', 'webhook' and 'mqtt'"`
+	Webhook WebhookConfig `name:"webhook" description:"webhook configuration"`
+	MQTT    MQTTConfig    `name:"mqtt" description:"MQTT configuration"`
+}
+
+// NewNotifier returns the notifier of the type.
+func (c NotifierConfig) NewNotifier() (Notifier, error) {
+	switch c.Type {
+	case TypeLog:
+		return logNotifier{}, nil
+	case TypeWebhook:
+		return c.Webhook.NewWebhook()
+	case TypeMQTT:
+		return c.MQTT.NewPublisher()
+	default:
+		return nil, fmt.Errorf("invalid notifier type '%s'. Supported values are '%s', '%s' and '%s'", c.Type, TypeLog, TypeWebhook, TypeMQTT)
+	}
+}
+
+// logNotifier logs the alerts.
+type logNotifier struct{}
+
+// Notify implements Notifier.
+func (logNotifier) Notify(ctx context.Context, a Alert) error {
+	logger := logger.LoggerFromContext(ctx).
+		WithField("rule", a.Rule).
+		WithField("description", a.Description).
+		WithField("measurement", a.Measurement).
+		WithField("tags", a.Tags).
+		WithField("since", a.Since)
+	if a.Value != nil {
+		logger = logger.WithField("value", a.Value)
+	}
+	if a.State == StateFiring {
+		logger.Warn("Alert firing")
+	} else {
+		logger.Info("Alert resolved")
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+)
+
+var testAlert = Alert{
+	Rule:        "high-usage",
+	State:       StateFiring,
+	Description: "electricity_hourly_usage > 5",
+	Measurement: "smartmeter",
+	Field:       "electricity_hourly_usage",
+	Tags:        map[string]string{"id": "meter-1"},
+	Value:       6.5,
+	Since:       time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC),
+	Time:        time.Date(2022, 12, 1, 12, 10, 0, 0, time.UTC),
+}
+
+func TestWebhook(t *testing.T) {
+	var (
+		received Alert
+		auth     string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		auth = r.Header.Get("Authorization")
+		b, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	w, err := WebhookConfig{
+		URL:     srv.URL,
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+	}.NewWebhook()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Notify(context.Background(), testAlert); err != nil {
+		t.Fatal(err)
+	}
+	if received.Rule != testAlert.Rule || received.State != StateFiring || received.Value != 6.5 || auth != "Bearer secret" {
+		t.Fatalf("unexpected alert %+v with authorization '%s'", received, auth)
+	}
+
+	w, err = WebhookConfig{URL: srv.URL + "/unknown"}.NewWebhook()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Notify(context.Background(), testAlert); err == nil {
+		t.Fatal("expected error for status 404")
+	}
+	if _, err := (WebhookConfig{URL: "localhost:8080"}).NewWebhook(); err == nil {
+		t.Fatal("expected error for invalid url")
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	publishCh := make(chan *packet.PublishPacket, 1)
+	go func() {
+		inner, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		conn := mqttnet.NewConn(inner, "tcp")
+		defer conn.Close()
+		pkt, err := conn.Receive()
+		if err != nil {
+			return
+		}
+		if connect, ok := pkt.(*packet.ConnectPacket); !ok || connect.Username != "alerts" || string(connect.Password) != "secret" {
+			conn.Send(&packet.ConnackPacket{ReturnCode: packet.ConnectNotAuthorized})
+			return
+		}
+		conn.Send(&packet.ConnackPacket{})
+		if pkt, err = conn.Receive(); err != nil {
+			return
+		}
+		publish := pkt.(*packet.PublishPacket)
+		conn.Send(&packet.PubackPacket{PacketIdentifier: publish.PacketIdentifier})
+		publishCh <- publish
+		conn.Receive()
+	}()
+
+	p, err := MQTTConfig{
+		Addr:     lis.Addr().String(),
+		Username: "alerts",
+		Password: "secret",
+		Topic:    "home/alerts",
+	}.NewPublisher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Notify(context.Background(), testAlert); err != nil {
+		t.Fatal(err)
+	}
+	publish := <-publishCh
+	if publish.TopicName != "home/alerts/high-usage/id=meter-1" || publish.QoS != packet.AtLeastOnce {
+		t.Fatalf("unexpected publish to '%s' with QoS %d", publish.TopicName, publish.QoS)
+	}
+	var received Alert
+	if err := json.Unmarshal(publish.Message, &received); err != nil {
+		t.Fatal(err)
+	}
+	if received.Rule != testAlert.Rule || !received.Time.Equal(testAlert.Time) {
+		t.Fatalf("unexpected alert %+v", received)
+	}
+
+	if topic := p.topic(Alert{Rule: "cold", Tags: map[string]string{"room": "kitchen/+", "id": "sensor-1"}}); topic != "home/alerts/cold/id=sensor-1/room=kitchen__" {
+		t.Fatalf("unexpected topic '%s'", topic)
+	}
+
+	if _, err := (MQTTConfig{Addr: "localhost:1883", Topic: "alerts/#"}).NewPublisher(); err == nil {
+		t.Fatal("expected error for invalid topic")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// defaultTimeout is the default timeout of sending a notification.
+const defaultTimeout = 10 * time.Second
+
+// WebhookConfig configures the webhook notifier.
+type WebhookConfig struct {
+	URL     string            `name:"url" description:"URL that the alerts are posted to as JSON"`
+	Headers map[string]string `name:"headers" description:"headers to add to the requests, like 'Authorization'"`
+	Timeout time.Duration     `name:"timeout" description:"timeout of the requests (default 10s)"`
+}
+
+// Webhook posts the alerts as JSON.
+type Webhook struct {
+	c      WebhookConfig
+	client *http.Client
+}
+
+// NewWebhook returns a new Webhook.
+func (c WebhookConfig) NewWebhook() (*Webhook, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook url '%s'", c.URL)
+	}
+	if c.Timeout < 0 {
+		return nil, fmt.Errorf("invalid timeout '%s'", c.Timeout)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultTimeout
+	}
+	return &Webhook{
+		c:      c,
+		client: &http.Client{Timeout: c.Timeout},
+	}, nil
+}
+
+// Notify implements Notifier.
+func (w *Webhook) Notify(ctx context.Context, a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.c.Headers {
+		req.Header.Set(k, v)
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/exporter"
+	"krishnaiyer.dev/golang/datasink/pkg/database/file"
+	"krishnaiyer.dev/golang/datasink/pkg/database/influxdb"
+	"krishnaiyer.dev/golang/datasink/pkg/database/postgres"
+	"krishnaiyer.dev/golang/datasink/pkg/database/remote"
+	"krishnaiyer.dev/golang/datasink/pkg/database/sqlite"
+)
+
+// The built-in backends.
+// Add the configuration section of a new backend to Config and register it here.
+func init() {
+	Register("file",
+		func(c Config) file.Config { return c.File },
+		func(ctx context.Context, c file.Config) (Database, error) {
+			s, err := c.NewSink(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return s, nil
+		},
+		nil,
+	)
+	Register("http",
+		func(c Config) remote.Config { return c.HTTP },
+		func(ctx context.Context, c remote.Config) (Database, error) {
+			cl, err := c.NewClient(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return cl, nil
+		},
+		nil,
+	)
+	Register("influxdb",
+		func(c Config) influxdb.Config { return c.InfluxDB },
+		func(ctx context.Context, c influxdb.Config) (Database, error) {
+			return c.NewClient(ctx), nil
+		},
+		func(ctx context.Context, c influxdb.Config) error {
+			return c.Setup(ctx)
+		},
+	)
+	Register("postgres",
+		func(c Config) postgres.Config { return c.Postgres },
+		func(ctx context.Context, c postgres.Config) (Database, error) {
+			cl, err := c.NewClient(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return cl, nil
+		},
+		func(ctx context.Context, c postgres.Config) error {
+			return c.Setup(ctx)
+		},
+	)
+	Register("prometheus",
+		func(c Config) exporter.Config { return c.Prometheus },
+		func(ctx context.Context, c exporter.Config) (Database, error) {
+			e, err := c.NewExporter(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return e, nil
+		},
+		nil,
+	)
+	Register("sqlite",
+		func(c Config) sqlite.Config { return c.SQLite },
+		func(ctx context.Context, c sqlite.Config) (Database, error) {
+			cl, err := c.NewClient(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return cl, nil
+		},
+		func(ctx context.Context, c sqlite.Config) error {
+			return c.Setup(ctx)
+		},
+	)
+}
@@ -20,21 +20,41 @@ import (
 	"time"
 
 	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/exporter"
+	"krishnaiyer.dev/golang/datasink/pkg/database/file"
 	"krishnaiyer.dev/golang/datasink/pkg/database/influxdb"
+	"krishnaiyer.dev/golang/datasink/pkg/database/postgres"
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+	"krishnaiyer.dev/golang/datasink/pkg/database/remote"
+	"krishnaiyer.dev/golang/datasink/pkg/database/sqlite"
+	"krishnaiyer.dev/golang/datasink/pkg/database/wal"
 )
 
 // Config defines the database configuration.
 type Config struct {
-	Type     string          `name:"type" description:"The type of database to use. Supported values are 'influxdb'"`
-	InfluxDB influxdb.Config `name:"influxdb"`
+	Type       string          `name:"type" description:"The type of database to use. Supported values are 'file', 'http', 'influxdb', 'postgres', 'prometheus' and 'sqlite'"`
+	File       file.Config     `name:"file"`
+	HTTP       remote.Config   `name:"http"`
+	InfluxDB   influxdb.Config `name:"influxdb"`
+	Postgres   postgres.Config `name:"postgres"`
+	Prometheus exporter.Config `name:"prometheus"`
+	SQLite     sqlite.Config   `name:"sqlite"`
+	Buffer     wal.Config      `name:"buffer" description:"on-disk write-ahead buffer for database outages"`
+	Sinks      []SinkConfig    `name:"sinks" description:"named databases that entries are written to. If set, the database of this section is not used"`
 }
 
 // Database is a database.
 type Database interface {
 	// Record records an entry.
 	Record(ctx context.Context, entry entry.Entry) error
-	// Query queries the database.
+	// Query queries the database with a query in the language of the database.
 	Query(ctx context.Context, query string) (map[time.Time]any, error)
+	// Select selects the series of a query.
+	Select(ctx context.Context, q query.Query) ([]query.Series, error)
+	// Measurements returns the names of the measurements, sorted by name.
+	Measurements(ctx context.Context) ([]string, error)
+	// Ping returns an error if the database is not reachable or the credentials are invalid.
+	Ping(ctx context.Context) error
 	// Close closes the database.
 	Close(ctx context.Context)
 }
@@ -15,10 +15,55 @@
 // Package entry defines data entries.
 package entry
 
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// IDTag is the tag that identifies the device of an entry.
+const IDTag = "id"
+
+// ErrRejected matches the errors of entries that a database rejects for good, like entries with unsupported values.
+// Writing such an entry again fails the same way, so it should not be retried.
+var ErrRejected = errors.New("entry rejected")
+
+// rejectedError is an error that matches ErrRejected.
+type rejectedError struct {
+	err error
+}
+
+// Error implements error.
+func (e rejectedError) Error() string { return e.err.Error() }
+
+// Unwrap returns the wrapped error.
+func (e rejectedError) Unwrap() error { return e.err }
+
+// Is returns true for ErrRejected.
+func (e rejectedError) Is(target error) bool { return target == ErrRejected }
+
+// Reject returns the error as an error that matches ErrRejected.
+func Reject(err error) error {
+	return rejectedError{err: err}
+}
+
 // Entry is a database entry.
 type Entry struct {
 	// A measurement is synonymous with a table in a relational database.
 	Measurement string                 `json:"measurement"`
 	Tags        map[string]string      `json:"tags"`
 	Fields      map[string]interface{} `json:"fields"`
+	// Time is the time of the measurement as reported by the device.
+	// If zero, the time the entry is recorded is used.
+	Time time.Time `json:"time,omitempty"`
+}
+
+// SortedKeys returns the keys of a map in increasing order, like the tags or the fields of an entry.
+func SortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
@@ -0,0 +1,278 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package exporter exports the latest values of entries as Prometheus metrics.
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+	"krishnaiyer.dev/golang/datasink/pkg/metrics"
+)
+
+// DefaultStaleness is the default time after which series that are not updated are removed.
+const DefaultStaleness = 5 * time.Minute
+
+// Config configures the exporter.
+type Config struct {
+	Namespace string        `name:"namespace" description:"prefix of the metric names"`
+	Monotonic []string      `name:"monotonic" description:"fields that only increase, like meter readings, as 'field' or 'measurement.field'. These are exported as counters"`
+	Staleness time.Duration `name:"staleness" description:"series that are not updated for this long are removed (default 5m)"`
+}
+
+// series is the latest value of a field of a measurement with a set of tags.
+type series struct {
+	name    string
+	help    string
+	counter bool
+	labels  map[string]string
+	value   float64
+	updated time.Time
+}
+
+// Exporter keeps the latest numeric value of every field of every measurement and tag set.
+// The values are served with the metrics of the pipeline. Fields are named <namespace>_<measurement>_<field> and tags are labels.
+type Exporter struct {
+	cfg       Config
+	monotonic map[string]bool
+	remove    func()
+	now       func() time.Time
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// NewExporter returns a new exporter and adds its values to the metrics.
+// Use Close() to remove the values from the metrics.
+func (c Config) NewExporter(ctx context.Context) (*Exporter, error) {
+	if c.Staleness == 0 {
+		c.Staleness = DefaultStaleness
+	}
+	if c.Staleness < 0 {
+		return nil, fmt.Errorf("invalid staleness '%s'", c.Staleness)
+	}
+	if c.Namespace != "" && sanitize(c.Namespace) != c.Namespace {
+		return nil, fmt.Errorf("invalid namespace '%s'", c.Namespace)
+	}
+	e := &Exporter{
+		cfg:       c,
+		monotonic: make(map[string]bool, len(c.Monotonic)),
+		now:       time.Now,
+		series:    make(map[string]*series),
+	}
+	for _, field := range c.Monotonic {
+		e.monotonic[field] = true
+	}
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(e); err != nil {
+		return nil, err
+	}
+	e.remove = metrics.AddGatherer(registry)
+	return e, nil
+}
+
+// Record implements Database.
+// Numeric and boolean fields are kept. Other fields are ignored.
+func (e *Exporter) Record(ctx context.Context, en entry.Entry) error {
+	labels := make(map[string]string, len(en.Tags))
+	for key, value := range en.Tags {
+		labels[LabelName(key)] = value
+	}
+	now := e.now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for field, value := range en.Fields {
+		v, ok := Value(value)
+		if !ok {
+			continue
+		}
+		counter := e.monotonic[field] || e.monotonic[en.Measurement+"."+field]
+		name := MetricName(e.cfg.Namespace, en.Measurement, field)
+		help := fmt.Sprintf("Latest value of field %s of measurement %s.", field, en.Measurement)
+		if counter && !strings.HasSuffix(name, "_total") {
+			name += "_total"
+		}
+		key := seriesKey(name, labels)
+		s, ok := e.series[key]
+		if !ok {
+			s = &series{
+				name:    name,
+				help:    help,
+				counter: counter,
+				labels:  labels,
+			}
+			e.series[key] = s
+		} else if s.help != help || s.counter != counter {
+			// Another field has the same metric name.
+			continue
+		}
+		s.value = v
+		s.updated = now
+	}
+	return nil
+}
+
+// Query implements Database.
+// Queries are not supported. Use Prometheus to query the values.
+func (e *Exporter) Query(ctx context.Context, query string) (map[time.Time]any, error) {
+	return nil, errors.New("queries are not supported by the prometheus database")
+}
+
+// Select implements Database.
+// Queries are not supported. Use Prometheus to query the values.
+func (e *Exporter) Select(ctx context.Context, q query.Query) ([]query.Series, error) {
+	return nil, errors.New("queries are not supported by the prometheus database")
+}
+
+// Measurements implements Database.
+// Queries are not supported.
+func (e *Exporter) Measurements(ctx context.Context) ([]string, error) {
+	return nil, errors.New("queries are not supported by the prometheus database")
+}
+
+// Ping implements Database.
+func (e *Exporter) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close implements Database.
+// The values are removed from the metrics.
+func (e *Exporter) Close(ctx context.Context) {
+	e.remove()
+}
+
+// Describe implements prometheus.Collector.
+// The metrics depend on the entries, so the exporter is an unchecked collector.
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+// Series that are not updated within the staleness period are removed.
+// Series of the same metric have the same labels. Labels of tags that an entry doesn't have are empty.
+// Different fields may have the same metric name after sanitizing. Series that have the same name as a series of
+// another field, of another type or with the same label values are skipped, so that the metrics can still be served.
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	now := e.now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	labelNames := make(map[string]map[string]bool)
+	for key, s := range e.series {
+		if now.Sub(s.updated) > e.cfg.Staleness {
+			delete(e.series, key)
+			continue
+		}
+		names, ok := labelNames[s.name]
+		if !ok {
+			names = make(map[string]bool)
+			labelNames[s.name] = names
+		}
+		for name := range s.labels {
+			names[name] = true
+		}
+	}
+	type metric struct {
+		desc    *prometheus.Desc
+		help    string
+		counter bool
+		values  map[string]bool
+	}
+	families := make(map[string]*metric, len(labelNames))
+	for _, key := range entry.SortedKeys(e.series) {
+		s := e.series[key]
+		names := entry.SortedKeys(labelNames[s.name])
+		m, ok := families[s.name]
+		if !ok {
+			m = &metric{
+				desc:    prometheus.NewDesc(s.name, s.help, names, nil),
+				help:    s.help,
+				counter: s.counter,
+				values:  make(map[string]bool),
+			}
+			families[s.name] = m
+		}
+		if s.help != m.help || s.counter != m.counter {
+			continue
+		}
+		values := make([]string, len(names))
+		for i, name := range names {
+			values[i] = s.labels[name]
+		}
+		valuesKey := strings.Join(values, "\x00")
+		if m.values[valuesKey] {
+			continue
+		}
+		m.values[valuesKey] = true
+		typ := prometheus.GaugeValue
+		if s.counter {
+			typ = prometheus.CounterValue
+		}
+		c, err := prometheus.NewConstMetric(m.desc, typ, s.value, values...)
+		if err != nil {
+			continue
+		}
+		ch <- c
+	}
+}
+
+// Value returns the value of numeric and boolean fields. Booleans are 0 and 1.
+func Value(value any) (float64, bool) {
+	return query.Float(value)
+}
+
+// sanitize replaces the characters that are not allowed in metric and label names with underscores.
+func sanitize(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= '0' && c <= '9' && i > 0) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// MetricName returns the name of the metric of a field of a measurement.
+// Characters that are not allowed in metric names are replaced with underscores.
+func MetricName(namespace, measurement, field string) string {
+	return prometheus.BuildFQName(namespace, sanitize(measurement), sanitize(field))
+}
+
+// LabelName returns the label name of a tag.
+// Characters that are not allowed in label names are replaced with underscores. Label names that start with two underscores are reserved.
+func LabelName(tag string) string {
+	name := sanitize(tag)
+	if strings.HasPrefix(name, "__") {
+		name = "tag" + name[1:]
+	}
+	return name
+}
+
+// seriesKey returns the key of a series of a metric with the labels.
+func seriesKey(name string, labels map[string]string) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, key := range entry.SortedKeys(labels) {
+		b.WriteByte(0)
+		b.WriteString(key)
+		b.WriteByte(0)
+		b.WriteString(labels[key])
+	}
+	return b.String()
+}
@@ -0,0 +1,220 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/metrics"
+)
+
+func TestExporter(t *testing.T) {
+	ctx := context.Background()
+	e, err := Config{
+		Namespace: "home",
+		Monotonic: []string{"smartmeter.electricity_delivered_1"},
+		Staleness: time.Minute,
+	}.NewExporter(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	e.now = func() time.Time { return now }
+
+	for _, en := range []entry.Entry{
+		{
+			Measurement: "smartmeter",
+			Tags:        map[string]string{"id": "meter-1"},
+			Fields: map[string]any{
+				"electricity_delivered_1":  1234.5,
+				"electricity_tariff":       1,
+				"electricity_equipment_id": "E0001",
+			},
+		},
+		{
+			Measurement: "smartmeter",
+			Tags:        map[string]string{"id": "meter-1"},
+			Fields:      map[string]any{"electricity_delivered_1": 1235.0},
+		},
+		{
+			Measurement: "climate",
+			Tags:        map[string]string{"room": "living"},
+			Fields:      map[string]any{"temperature": 21.5, "heating": true},
+		},
+		{
+			Measurement: "climate",
+			Tags:        map[string]string{"room": "attic", "sensor-id": "s1"},
+			Fields:      map[string]any{"temperature": float32(18)},
+		},
+	} {
+		if err := e.Record(ctx, en); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := `
+# HELP home_climate_heating Latest value of field heating of measurement climate.
+# TYPE home_climate_heating gauge
+home_climate_heating{room="living"} 1
+# HELP home_climate_temperature Latest value of field temperature of measurement climate.
+# TYPE home_climate_temperature gauge
+home_climate_temperature{room="attic",sensor_id="s1"} 18
+home_climate_temperature{room="living",sensor_id=""} 21.5
+# HELP home_smartmeter_electricity_delivered_1_total Latest value of field electricity_delivered_1 of measurement smartmeter.
+# TYPE home_smartmeter_electricity_delivered_1_total counter
+home_smartmeter_electricity_delivered_1_total{id="meter-1"} 1235
+# HELP home_smartmeter_electricity_tariff Latest value of field electricity_tariff of measurement smartmeter.
+# TYPE home_smartmeter_electricity_tariff gauge
+home_smartmeter_electricity_tariff{id="meter-1"} 1
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The values are served with the metrics of the pipeline until the exporter is closed.
+	if body := serveMetrics(t); !strings.Contains(body, `home_climate_heating{room="living"} 1`) {
+		t.Fatalf("expected exported values in metrics:\n%s", body)
+	}
+
+	// Only the smart meter keeps reporting.
+	now = now.Add(45 * time.Second)
+	if err := e.Record(ctx, entry.Entry{
+		Measurement: "smartmeter",
+		Tags:        map[string]string{"id": "meter-1"},
+		Fields:      map[string]any{"electricity_delivered_1": 1236.0},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(30 * time.Second)
+	expected = `
+# HELP home_smartmeter_electricity_delivered_1_total Latest value of field electricity_delivered_1 of measurement smartmeter.
+# TYPE home_smartmeter_electricity_delivered_1_total counter
+home_smartmeter_electricity_delivered_1_total{id="meter-1"} 1236
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+
+	e.Close(ctx)
+	if body := serveMetrics(t); strings.Contains(body, "home_smartmeter") {
+		t.Fatalf("expected no exported values in metrics after close:\n%s", body)
+	}
+}
+
+func TestCollisions(t *testing.T) {
+	ctx := context.Background()
+	e, err := Config{
+		Namespace: "home",
+		Monotonic: []string{"energy"},
+	}.NewExporter(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close(ctx)
+
+	for _, en := range []entry.Entry{
+		// Fields with the same metric name after sanitizing.
+		{
+			Measurement: "climate",
+			Tags:        map[string]string{"room": "attic"},
+			Fields:      map[string]any{"temperature_c": 18.0},
+		},
+		{
+			Measurement: "climate",
+			Tags:        map[string]string{"room": "living"},
+			Fields:      map[string]any{"temperature-c": 21.5},
+		},
+		{
+			Measurement: "climate",
+			Tags:        map[string]string{"room": "attic"},
+			Fields:      map[string]any{"temperature-c": 19.0},
+		},
+		// A gauge with the name of a counter.
+		{
+			Measurement: "meter",
+			Tags:        map[string]string{"id": "meter-1"},
+			Fields:      map[string]any{"energy": 1234.5},
+		},
+		{
+			Measurement: "meter",
+			Tags:        map[string]string{"id": "meter-2"},
+			Fields:      map[string]any{"energy_total": 42.0},
+		},
+		// Series with the same label values once the labels of the metric are added.
+		{
+			Measurement: "meter",
+			Tags:        map[string]string{"id": "meter-1"},
+			Fields:      map[string]any{"power": 1.5},
+		},
+		{
+			Measurement: "meter",
+			Tags:        map[string]string{"id": "meter-1", "phase": ""},
+			Fields:      map[string]any{"power": 2.5},
+		},
+	} {
+		if err := e.Record(ctx, en); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := `
+# HELP home_climate_temperature_c Latest value of field temperature_c of measurement climate.
+# TYPE home_climate_temperature_c gauge
+home_climate_temperature_c{room="attic"} 18
+# HELP home_meter_energy_total Latest value of field energy of measurement meter.
+# TYPE home_meter_energy_total counter
+home_meter_energy_total{id="meter-1"} 1234.5
+# HELP home_meter_power Latest value of field power of measurement meter.
+# TYPE home_meter_power gauge
+home_meter_power{id="meter-1",phase=""} 1.5
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+	if body := serveMetrics(t); !strings.Contains(body, `home_meter_energy_total{id="meter-1"} 1234.5`) {
+		t.Fatalf("expected exported values in metrics:\n%s", body)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	ctx := context.Background()
+	if _, err := (Config{Namespace: "my-home"}).NewExporter(ctx); err == nil {
+		t.Fatal("expected error for invalid namespace")
+	}
+	if _, err := (Config{Staleness: -time.Second}).NewExporter(ctx); err == nil {
+		t.Fatal("expected error for invalid staleness")
+	}
+}
+
+func serveMetrics(t *testing.T) string {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
@@ -0,0 +1,276 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+	"krishnaiyer.dev/golang/datasink/pkg/metrics"
+	"krishnaiyer.dev/golang/dry/pkg/logger"
+)
+
+// DefaultSinkQueueSize is the default number of entries that are queued per sink.
+const DefaultSinkQueueSize = 256
+
+// SinkConfig is the configuration of a named sink.
+type SinkConfig struct {
+	Name      string `name:"name" description:"name of the sink"`
+	Database  Config `name:"database" description:"database of the sink"`
+	Filter    Filter `name:"filter" description:"entries to write to the sink. If empty, all entries are written"`
+	QueueSize int    `name:"queue-size" description:"number of entries that are queued for the sink. Entries are dropped for the sink if the queue is full (default 256)"`
+}
+
+// Filter selects entries by measurement and tags.
+type Filter struct {
+	Measurements []string          `name:"measurements" description:"measurements to write. If empty, all measurements are written"`
+	Tags         map[string]string `name:"tags" description:"patterns that tag values must match, by tag. Patterns support the '*' and '?' wildcards"`
+}
+
+// validate returns an error if a pattern is invalid.
+func (f Filter) validate() error {
+	for tag, pattern := range f.Tags {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%s' for tag '%s'", pattern, tag)
+		}
+	}
+	return nil
+}
+
+// Matches returns true if the entry matches the filter.
+func (f Filter) Matches(e entry.Entry) bool {
+	if len(f.Measurements) > 0 {
+		found := false
+		for _, m := range f.Measurements {
+			if m == e.Measurement {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for tag, pattern := range f.Tags {
+		value, ok := e.Tags[tag]
+		if !ok {
+			return false
+		}
+		if ok, _ := path.Match(pattern, value); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// sink writes the entries in its queue to its database.
+type sink struct {
+	name   string
+	db     Database
+	filter Filter
+	queue  chan entry.Entry
+}
+
+// run writes entries from the queue until the queue is closed.
+func (s *sink) run(ctx context.Context) {
+	logger := logger.LoggerFromContext(ctx).WithField("sink", s.name)
+	for e := range s.queue {
+		if err := s.db.Record(ctx, e); err != nil {
+			logger.WithError(err).Error("Error writing to sink")
+		}
+	}
+}
+
+// ErrClosed is returned when recording an entry after the database is closed.
+var ErrClosed = errors.New("database closed")
+
+// Fanout writes entries to every sink that matches the entry.
+// Each sink has its own queue so a slow or failing sink doesn't block the others.
+type Fanout struct {
+	sinks []*sink
+	wg    sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newFanout creates the sinks and starts writing to them.
+func (c Config) newFanout(ctx context.Context) (*Fanout, error) {
+	sinks := make([]*sink, 0, len(c.Sinks))
+	closeSinks := func() {
+		for _, s := range sinks {
+			s.db.Close(ctx)
+		}
+	}
+	names := make(map[string]bool, len(c.Sinks))
+	for i, sc := range c.Sinks {
+		if sc.Name == "" {
+			sc.Name = fmt.Sprintf("%d", i)
+		}
+		if names[sc.Name] {
+			closeSinks()
+			return nil, fmt.Errorf("duplicate sink name '%s'", sc.Name)
+		}
+		names[sc.Name] = true
+		if len(sc.Database.Sinks) > 0 {
+			closeSinks()
+			return nil, fmt.Errorf("sink '%s': nested sinks are not supported", sc.Name)
+		}
+		if err := sc.Filter.validate(); err != nil {
+			closeSinks()
+			return nil, fmt.Errorf("sink '%s': %w", sc.Name, err)
+		}
+		db, err := sc.Database.New(ctx)
+		if err != nil {
+			closeSinks()
+			return nil, fmt.Errorf("sink '%s': %w", sc.Name, err)
+		}
+		if sc.QueueSize == 0 {
+			sc.QueueSize = DefaultSinkQueueSize
+		}
+		sinks = append(sinks, &sink{
+			name:   sc.Name,
+			db:     db,
+			filter: sc.Filter,
+			queue:  make(chan entry.Entry, sc.QueueSize),
+		})
+	}
+	return startFanout(ctx, sinks), nil
+}
+
+// startFanout starts writing to the sinks.
+// The sinks write with a context that is not canceled, so that the queued entries are still written when the context is
+// canceled before Close. The sinks stop when their queues are closed.
+func startFanout(ctx context.Context, sinks []*sink) *Fanout {
+	f := &Fanout{
+		sinks: sinks,
+	}
+	runCtx := logger.NewContextWithLogger(context.Background(), logger.LoggerFromContext(ctx))
+	for _, s := range sinks {
+		f.wg.Add(1)
+		go func(s *sink) {
+			defer f.wg.Done()
+			s.run(runCtx)
+		}(s)
+	}
+	return f
+}
+
+// Record implements Database.
+// The entry is queued for every matching sink. If the queue of a sink is full, the entry is dropped for that sink and
+// the drop is logged and counted. It returns an error only if all matching sinks dropped the entry.
+// Entries without time are recorded at the time they are queued.
+func (f *Fanout) Record(ctx context.Context, e entry.Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return ErrClosed
+	}
+	var (
+		matched int
+		dropped []string
+	)
+	for _, s := range f.sinks {
+		if !s.filter.Matches(e) {
+			continue
+		}
+		matched++
+		select {
+		case s.queue <- e:
+		default:
+			dropped = append(dropped, s.name)
+			metrics.DatabaseSinkDrops.WithLabelValues(s.name).Inc()
+		}
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	if len(dropped) == matched {
+		return fmt.Errorf("sink queue full, entry dropped for sinks '%s'", strings.Join(dropped, "', '"))
+	}
+	logger.LoggerFromContext(ctx).WithField("sinks", dropped).WithField("measurement", e.Measurement).Warn("Sink queue full, entry dropped")
+	return nil
+}
+
+// Query implements Database.
+// The query is run on the first sink.
+func (f *Fanout) Query(ctx context.Context, query string) (map[time.Time]any, error) {
+	if len(f.sinks) == 0 {
+		return nil, errors.New("no sinks configured")
+	}
+	return f.sinks[0].db.Query(ctx, query)
+}
+
+// Select implements Database.
+// The query is run on the first sink.
+func (f *Fanout) Select(ctx context.Context, q query.Query) ([]query.Series, error) {
+	if len(f.sinks) == 0 {
+		return nil, errors.New("no sinks configured")
+	}
+	return f.sinks[0].db.Select(ctx, q)
+}
+
+// Measurements implements Database.
+// The measurements of the first sink are returned.
+func (f *Fanout) Measurements(ctx context.Context) ([]string, error) {
+	if len(f.sinks) == 0 {
+		return nil, errors.New("no sinks configured")
+	}
+	return f.sinks[0].db.Measurements(ctx)
+}
+
+// Ping implements Database.
+// It returns an error if any of the sinks is not reachable.
+func (f *Fanout) Ping(ctx context.Context) error {
+	var errs []string
+	for _, s := range f.sinks {
+		if err := s.db.Ping(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("sink '%s': %s", s.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Close implements Database.
+// The queued entries are written before the sinks are closed. Entries recorded after Close are rejected with ErrClosed.
+func (f *Fanout) Close(ctx context.Context) {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.closed = true
+	for _, s := range f.sinks {
+		close(s.queue)
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+	for _, s := range f.sinks {
+		s.db.Close(ctx)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/wal"
+)
+
+// blockingDatabase records entries once it is unblocked. Like the backends, it fails with a canceled context.
+type blockingDatabase struct {
+	mockDatabase
+	unblock chan struct{}
+
+	mu      sync.Mutex
+	entries []entry.Entry
+}
+
+func (db *blockingDatabase) Record(ctx context.Context, e entry.Entry) error {
+	<-db.unblock
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.entries = append(db.entries, e)
+	return nil
+}
+
+func (db *blockingDatabase) recorded() []entry.Entry {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]entry.Entry(nil), db.entries...)
+}
+
+func TestFilter(t *testing.T) {
+	e := entry.Entry{
+		Measurement: "smartmeter",
+		Tags:        map[string]string{"id": "meter-1", "location": "home"},
+	}
+	for _, tc := range []struct {
+		Name    string
+		Filter  Filter
+		Matches bool
+	}{
+		{Name: "Empty", Filter: Filter{}, Matches: true},
+		{Name: "Measurement", Filter: Filter{Measurements: []string{"climate", "smartmeter"}}, Matches: true},
+		{Name: "OtherMeasurement", Filter: Filter{Measurements: []string{"climate"}}, Matches: false},
+		{Name: "Tag", Filter: Filter{Tags: map[string]string{"id": "meter-*"}}, Matches: true},
+		{Name: "OtherTag", Filter: Filter{Tags: map[string]string{"id": "sensor-*"}}, Matches: false},
+		{Name: "MissingTag", Filter: Filter{Tags: map[string]string{"room": "*"}}, Matches: false},
+		{Name: "All", Filter: Filter{Measurements: []string{"smartmeter"}, Tags: map[string]string{"id": "meter-?", "location": "home"}}, Matches: true},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			if matches := tc.Filter.Matches(e); matches != tc.Matches {
+				t.Fatalf("expected match %v, got %v", tc.Matches, matches)
+			}
+		})
+	}
+}
+
+func TestFanout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fast := &blockingDatabase{unblock: make(chan struct{})}
+	close(fast.unblock)
+	slow := &blockingDatabase{unblock: make(chan struct{})}
+	archive := &blockingDatabase{unblock: make(chan struct{})}
+	close(archive.unblock)
+
+	f := startFanout(ctx, []*sink{
+		{name: "fast", db: fast, queue: make(chan entry.Entry, 1)},
+		{name: "slow", db: slow, queue: make(chan entry.Entry, 1)},
+		{name: "archive", db: archive, filter: Filter{Measurements: []string{"smartmeter"}}, queue: make(chan entry.Entry, 10)},
+	})
+
+	// The slow sink blocks on the first entry and queues the second. Further entries are dropped for the slow sink only,
+	// which doesn't fail the write since the other sinks store them.
+	for i := 0; i < 5; i++ {
+		measurement := "smartmeter"
+		if i%2 == 1 {
+			measurement = "climate"
+		}
+		err := f.Record(ctx, entry.Entry{Measurement: measurement, Fields: map[string]any{"value": i}})
+		if err != nil {
+			t.Fatalf("unexpected error for entry %d: %v", i, err)
+		}
+		// Give the slow sink time to take the first entry from its queue.
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The queued entries are written when the context is canceled before closing.
+	cancel()
+	close(slow.unblock)
+	f.Close(context.Background())
+	if n := len(fast.recorded()); n != 5 {
+		t.Fatalf("expected 5 entries in the fast sink, got %d", n)
+	}
+	if n := len(slow.recorded()); n != 2 {
+		t.Fatalf("expected 2 entries in the slow sink, got %d", n)
+	}
+	entries := archive.recorded()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries in the archive sink, got %d", len(entries))
+	}
+	for _, e := range entries {
+		if e.Measurement != "smartmeter" || e.Time.IsZero() {
+			t.Fatalf("unexpected entry %+v", e)
+		}
+	}
+}
+
+func TestFanoutDropped(t *testing.T) {
+	ctx := context.Background()
+	// The sinks are not started, so their queues are full.
+	f := &Fanout{sinks: []*sink{
+		{name: "a", db: &mockDatabase{}, queue: make(chan entry.Entry)},
+		{name: "b", db: &mockDatabase{}, filter: Filter{Measurements: []string{"climate"}}, queue: make(chan entry.Entry)},
+	}}
+	defer f.Close(ctx)
+	// The write fails if all matching sinks dropped the entry.
+	if err := f.Record(ctx, entry.Entry{Measurement: "smartmeter"}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestFanoutClosed(t *testing.T) {
+	ctx := context.Background()
+	db := &blockingDatabase{unblock: make(chan struct{})}
+	close(db.unblock)
+	f := startFanout(ctx, []*sink{
+		{name: "db", db: db, queue: make(chan entry.Entry, 1)},
+	})
+	f.Close(ctx)
+	// Entries recorded after closing are rejected instead of being sent on a closed queue.
+	if err := f.Record(ctx, entry.Entry{Measurement: "smartmeter"}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v, got %v", ErrClosed, err)
+	}
+	f.Close(ctx)
+}
+
+func TestFanoutConfig(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		Name   string
+		Buffer string
+		Sinks  []SinkConfig
+	}{
+		{Name: "InvalidType", Sinks: []SinkConfig{{Name: "a", Database: Config{Type: "unknown"}}}},
+		{Name: "DuplicateName", Sinks: []SinkConfig{{Name: "a", Database: Config{Type: "influxdb"}}, {Name: "a", Database: Config{Type: "influxdb"}}}},
+		{Name: "InvalidPattern", Sinks: []SinkConfig{{Name: "a", Database: Config{Type: "influxdb"}, Filter: Filter{Tags: map[string]string{"id": "["}}}}},
+		{Name: "Nested", Sinks: []SinkConfig{{Name: "a", Database: Config{Sinks: []SinkConfig{{Name: "b"}}}}}},
+		{Name: "Buffer", Buffer: "buffer", Sinks: []SinkConfig{{Name: "a", Database: Config{Type: "influxdb"}}}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			if _, err := (Config{Sinks: tc.Sinks, Buffer: wal.Config{Dir: tc.Buffer}}).New(ctx); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
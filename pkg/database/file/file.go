@@ -0,0 +1,446 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package file appends entries to local files that are rotated by size and age.
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/lineprotocol"
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+)
+
+const (
+	// EncodingJSONL writes an entry per line as JSON.
+	EncodingJSONL = "jsonl"
+	// EncodingCSV writes a CSV file per measurement.
+	EncodingCSV = "csv"
+	// EncodingLineProtocol writes an entry per line as InfluxDB line protocol.
+	EncodingLineProtocol = "line-protocol"
+
+	// DefaultMaxSize is the default size after which a file is rotated.
+	DefaultMaxSize = 64 << 20
+
+	// entriesFile is the name of the file of the encodings that write all entries to the same file.
+	entriesFile = "entries"
+	// rotatedTimeFormat is the format of the time in the names of rotated files.
+	rotatedTimeFormat = "20060102T150405.000000000Z"
+)
+
+var extensions = map[string]string{
+	EncodingJSONL:        ".jsonl",
+	EncodingCSV:          ".csv",
+	EncodingLineProtocol: ".lp",
+}
+
+// Config configures the files.
+type Config struct {
+	Dir            string        `name:"dir" description:"directory of the files"`
+	Encoding       string        `name:"encoding" description:"encoding of the entries. Supported values are 'jsonl' (default), 'csv' and 'line-protocol'"`
+	MaxSize        int64         `name:"max-size" description:"size in bytes after which a file is rotated (default 64MiB)"`
+	RotateInterval time.Duration `name:"rotate-interval" description:"age after which a file is rotated. Leave empty to only rotate by size"`
+	Gzip           bool          `name:"gzip" description:"compress rotated files with gzip"`
+	MaxFiles       int           `name:"max-files" description:"number of rotated files that are kept per file. Leave empty to keep all rotated files"`
+}
+
+// record is an entry in JSON Lines.
+type record struct {
+	entry.Entry
+	// RecordedAt is the time the entry is recorded.
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// file is an open file.
+type file struct {
+	name   string
+	path   string
+	f      *os.File
+	size   int64
+	opened time.Time
+	// columns are the columns of the CSV header.
+	columns []string
+}
+
+// Sink appends entries to files.
+// JSON Lines and line protocol are written to a single file. CSV is written to a file per measurement with a header.
+type Sink struct {
+	cfg Config
+	ext string
+	now func() time.Time
+
+	mu    sync.Mutex
+	files map[string]*file
+}
+
+// NewSink creates the directory and returns a new sink.
+// Use Close() to close the files after done.
+func (c Config) NewSink(ctx context.Context) (*Sink, error) {
+	if c.Encoding == "" {
+		c.Encoding = EncodingJSONL
+	}
+	if c.MaxSize == 0 {
+		c.MaxSize = DefaultMaxSize
+	}
+	ext, ok := extensions[c.Encoding]
+	if !ok {
+		return nil, fmt.Errorf("invalid encoding '%s'. Supported values are '%s', '%s' and '%s'", c.Encoding, EncodingJSONL, EncodingCSV, EncodingLineProtocol)
+	}
+	if c.Dir == "" {
+		return nil, errors.New("no directory configured")
+	}
+	if c.MaxSize < 0 {
+		return nil, fmt.Errorf("invalid max size '%d'", c.MaxSize)
+	}
+	if c.MaxFiles < 0 {
+		return nil, fmt.Errorf("invalid max files '%d'", c.MaxFiles)
+	}
+	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Sink{
+		cfg:   c,
+		ext:   ext,
+		now:   time.Now,
+		files: make(map[string]*file),
+	}, nil
+}
+
+// Record implements Database.
+// Entries without time are recorded at the current time.
+func (s *Sink) Record(ctx context.Context, e entry.Entry) error {
+	now := s.now()
+	if e.Time.IsZero() {
+		e.Time = now
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch s.cfg.Encoding {
+	case EncodingCSV:
+		return s.recordCSV(e, now)
+	case EncodingLineProtocol:
+		var buf bytes.Buffer
+		lineprotocol.Append(&buf, e)
+		if buf.Len() == 0 {
+			return nil
+		}
+		return s.write(entriesFile, buf.Bytes(), now)
+	default:
+		line, err := json.Marshal(record{
+			Entry:      e,
+			RecordedAt: now,
+		})
+		if err != nil {
+			return entry.Reject(err)
+		}
+		return s.write(entriesFile, append(line, '\n'), now)
+	}
+}
+
+// recordCSV writes the entry to the file of the measurement.
+// If the entry has tags or fields that are not in the header, the file is rotated and the new file has a header with all columns.
+func (s *Sink) recordCSV(e entry.Entry, now time.Time) error {
+	name := fileName(e.Measurement)
+	f, err := s.open(name, now)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(f.columns))
+	for _, column := range f.columns {
+		known[column] = true
+	}
+	var added []string
+	for _, keys := range [][]string{entry.SortedKeys(e.Tags), entry.SortedKeys(e.Fields)} {
+		for _, key := range keys {
+			if !known[key] {
+				known[key] = true
+				added = append(added, key)
+			}
+		}
+	}
+	if len(added) > 0 {
+		columns := []string{"time"}
+		if len(f.columns) > 0 {
+			columns = append(columns, f.columns[1:]...)
+		}
+		columns = append(columns, added...)
+		if f.size > 0 {
+			if err := s.rotate(f, now); err != nil {
+				return err
+			}
+		}
+		if f, err = s.open(name, now); err != nil {
+			return err
+		}
+		header, err := csvLine(columns)
+		if err != nil {
+			return err
+		}
+		if err := s.writeFile(f, header); err != nil {
+			return err
+		}
+		f.columns = columns
+	}
+
+	values := make([]string, len(f.columns))
+	values[0] = e.Time.UTC().Format(time.RFC3339Nano)
+	for i, column := range f.columns[1:] {
+		if tag, ok := e.Tags[column]; ok {
+			values[i+1] = tag
+		} else if field, ok := e.Fields[column]; ok {
+			values[i+1] = fmt.Sprint(field)
+		}
+	}
+	line, err := csvLine(values)
+	if err != nil {
+		return err
+	}
+	return s.write(name, line, now)
+}
+
+// write writes the line to the named file. The file is rotated first if it is too large or too old.
+func (s *Sink) write(name string, line []byte, now time.Time) error {
+	f, err := s.open(name, now)
+	if err != nil {
+		return err
+	}
+	if f.size > 0 && (f.size+int64(len(line)) > s.cfg.MaxSize || (s.cfg.RotateInterval > 0 && now.Sub(f.opened) >= s.cfg.RotateInterval)) {
+		columns := f.columns
+		if err := s.rotate(f, now); err != nil {
+			return err
+		}
+		if f, err = s.open(name, now); err != nil {
+			return err
+		}
+		if columns != nil {
+			// Rotated CSV files start with the same header.
+			header, err := csvLine(columns)
+			if err != nil {
+				return err
+			}
+			if err := s.writeFile(f, header); err != nil {
+				return err
+			}
+			f.columns = columns
+		}
+	}
+	return s.writeFile(f, line)
+}
+
+func (s *Sink) writeFile(f *file, b []byte) error {
+	n, err := f.f.Write(b)
+	f.size += int64(n)
+	return err
+}
+
+// open returns the named file and opens it if it isn't open.
+// The header of an existing CSV file is read to append rows with the same columns.
+func (s *Sink) open(name string, now time.Time) (*file, error) {
+	if f, ok := s.files[name]; ok {
+		return f, nil
+	}
+	path := filepath.Join(s.cfg.Dir, name+s.ext)
+	osFile, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := osFile.Stat()
+	if err != nil {
+		osFile.Close()
+		return nil, err
+	}
+	f := &file{
+		name:   name,
+		path:   path,
+		f:      osFile,
+		size:   info.Size(),
+		opened: now,
+	}
+	if s.cfg.Encoding == EncodingCSV && f.size > 0 {
+		if f.columns, err = readHeader(path); err != nil {
+			osFile.Close()
+			return nil, err
+		}
+	}
+	s.files[name] = f
+	return f, nil
+}
+
+// rotate closes the file and renames it with the current time. The rotated file is compressed if configured.
+// If there are more rotated files than configured, the oldest rotated files are removed.
+func (s *Sink) rotate(f *file, now time.Time) error {
+	delete(s.files, f.name)
+	if err := f.f.Close(); err != nil {
+		return err
+	}
+	rotated := filepath.Join(s.cfg.Dir, fmt.Sprintf("%s-%s%s", f.name, now.UTC().Format(rotatedTimeFormat), s.ext))
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	if s.cfg.Gzip {
+		if err := compress(rotated); err != nil {
+			return err
+		}
+	}
+	if s.cfg.MaxFiles > 0 {
+		return s.prune(f.name)
+	}
+	return nil
+}
+
+// prune removes the oldest rotated files of the named file that exceed the maximum number of files.
+func (s *Sink) prune(name string) error {
+	pattern := regexp.MustCompile(`^` + regexp.QuoteMeta(name) + `-\d{8}T\d{6}\.\d{9}Z` + regexp.QuoteMeta(s.ext) + `(\.gz)?$`)
+	entries, err := os.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	var rotated []string
+	for _, e := range entries {
+		if pattern.MatchString(e.Name()) {
+			rotated = append(rotated, e.Name())
+		}
+	}
+	// The names sort by the time of rotation.
+	sort.Strings(rotated)
+	for len(rotated) > s.cfg.MaxFiles {
+		if err := os.Remove(filepath.Join(s.cfg.Dir, rotated[0])); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// Query implements Database.
+// Queries are not supported.
+func (s *Sink) Query(ctx context.Context, query string) (map[time.Time]any, error) {
+	return nil, errors.New("queries are not supported by the file database")
+}
+
+// Select implements Database.
+// Queries are not supported.
+func (s *Sink) Select(ctx context.Context, q query.Query) ([]query.Series, error) {
+	return nil, errors.New("queries are not supported by the file database")
+}
+
+// Measurements implements Database.
+// Queries are not supported.
+func (s *Sink) Measurements(ctx context.Context) ([]string, error) {
+	return nil, errors.New("queries are not supported by the file database")
+}
+
+// Ping implements Database.
+// It returns an error if the directory doesn't exist.
+func (s *Sink) Ping(ctx context.Context) error {
+	info, err := os.Stat(s.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", s.cfg.Dir)
+	}
+	return nil
+}
+
+// Close implements Database.
+func (s *Sink) Close(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, f := range s.files {
+		f.f.Close()
+		delete(s.files, name)
+	}
+}
+
+// compress compresses the file with gzip and removes the original.
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	w := gzip.NewWriter(dst)
+	if _, err := io.Copy(w, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// readHeader reads the header of a CSV file.
+func readHeader(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header, err := csv.NewReader(bufio.NewReader(f)).Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid header of '%s': %w", path, err)
+	}
+	return header, nil
+}
+
+// csvLine returns the CSV encoding of the values.
+func csvLine(values []string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(values); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// fileName returns the name of the file of a measurement. Characters other than letters, digits, '_', '-' and '.' are replaced with '_'.
+func fileName(measurement string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, measurement)
+	if name == "" || strings.Trim(name, ".") == "" {
+		return "_"
+	}
+	return name
+}
@@ -0,0 +1,233 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+)
+
+func newSink(t *testing.T, c Config, now *time.Time) *Sink {
+	t.Helper()
+	s, err := c.NewSink(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return *now }
+	t.Cleanup(func() { s.Close(context.Background()) })
+	return s
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestJSONL(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	now := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	s := newSink(t, Config{Dir: dir}, &now)
+	if err := s.Record(ctx, entry.Entry{
+		Measurement: "smartmeter",
+		Tags:        map[string]string{"id": "meter-1"},
+		Fields:      map[string]any{"electricity_delivered_1": 1234.567},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var r struct {
+		Measurement string            `json:"measurement"`
+		Tags        map[string]string `json:"tags"`
+		Fields      map[string]any    `json:"fields"`
+		Time        time.Time         `json:"time"`
+		RecordedAt  time.Time         `json:"recorded_at"`
+	}
+	if err := json.Unmarshal([]byte(readFile(t, filepath.Join(dir, "entries.jsonl"))), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Measurement != "smartmeter" || r.Tags["id"] != "meter-1" || r.Fields["electricity_delivered_1"] != 1234.567 {
+		t.Fatalf("unexpected record %+v", r)
+	}
+	if !r.Time.Equal(now) || !r.RecordedAt.Equal(now) {
+		t.Fatalf("expected time %s, got %s and %s", now, r.Time, r.RecordedAt)
+	}
+}
+
+func TestLineProtocol(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	now := time.Unix(0, 1669896000000000000)
+	s := newSink(t, Config{Dir: dir, Encoding: EncodingLineProtocol}, &now)
+	for _, e := range []entry.Entry{
+		{Measurement: "smartmeter", Tags: map[string]string{"id": "meter-1"}, Fields: map[string]any{"power": 1.5}},
+		{Measurement: "smartmeter"},
+	} {
+		if err := s.Record(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := "smartmeter,id=meter-1 power=1.5 1669896000000000000\n"
+	if actual := readFile(t, filepath.Join(dir, "entries.lp")); actual != expected {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestCSV(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	now := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	s := newSink(t, Config{Dir: dir, Encoding: EncodingCSV}, &now)
+	for _, e := range []entry.Entry{
+		{Measurement: "smartmeter", Tags: map[string]string{"id": "meter-1"}, Fields: map[string]any{"power": 1.5}},
+		{Measurement: "smartmeter", Fields: map[string]any{"power": 2}},
+		{Measurement: "weather/outside", Fields: map[string]any{"temperature": 3.5}},
+	} {
+		if err := s.Record(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now = now.Add(time.Second)
+	if err := s.Record(ctx, entry.Entry{
+		Measurement: "smartmeter",
+		Tags:        map[string]string{"id": "meter-1"},
+		Fields:      map[string]any{"gas": 10, "power": 3},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close(ctx)
+
+	expected := []string{"smartmeter-20221201T120001.000000000Z.csv", "smartmeter.csv", "weather_outside.csv"}
+	if actual := listDir(t, dir); strings.Join(actual, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected files %v, got %v", expected, actual)
+	}
+	for name, expected := range map[string]string{
+		"smartmeter-20221201T120001.000000000Z.csv": "time,id,power\n2022-12-01T12:00:00Z,meter-1,1.5\n2022-12-01T12:00:00Z,,2\n",
+		"smartmeter.csv":      "time,id,power,gas\n2022-12-01T12:00:01Z,meter-1,3,10\n",
+		"weather_outside.csv": "time,temperature\n2022-12-01T12:00:00Z,3.5\n",
+	} {
+		if actual := readFile(t, filepath.Join(dir, name)); actual != expected {
+			t.Fatalf("expected %s to be %q, got %q", name, expected, actual)
+		}
+	}
+
+	// The header of an existing file is reused.
+	s = newSink(t, Config{Dir: dir, Encoding: EncodingCSV}, &now)
+	if err := s.Record(ctx, entry.Entry{Measurement: "smartmeter", Fields: map[string]any{"gas": 11}}); err != nil {
+		t.Fatal(err)
+	}
+	expectedContent := "time,id,power,gas\n2022-12-01T12:00:01Z,meter-1,3,10\n2022-12-01T12:00:01Z,,,11\n"
+	if actual := readFile(t, filepath.Join(dir, "smartmeter.csv")); actual != expectedContent {
+		t.Fatalf("expected %q, got %q", expectedContent, actual)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	now := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	s := newSink(t, Config{
+		Dir:            dir,
+		Encoding:       EncodingLineProtocol,
+		MaxSize:        100,
+		RotateInterval: time.Hour,
+		Gzip:           true,
+		MaxFiles:       2,
+	}, &now)
+	record := func() {
+		t.Helper()
+		if err := s.Record(ctx, entry.Entry{Measurement: "smartmeter", Fields: map[string]any{"power": 1.5}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every line is 42 bytes, so the third line rotates the file.
+	for i := 0; i < 3; i++ {
+		record()
+		now = now.Add(time.Second)
+	}
+	expected := []string{"entries-20221201T120002.000000000Z.lp.gz", "entries.lp"}
+	if actual := listDir(t, dir); strings.Join(actual, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected files %v, got %v", expected, actual)
+	}
+	f, err := os.Open(filepath.Join(dir, expected[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines != 2 {
+		t.Fatalf("expected 2 lines in rotated file, got %d", lines)
+	}
+
+	// The file is rotated after the interval. Only the latest rotated files are kept.
+	for i := 0; i < 2; i++ {
+		now = now.Add(time.Hour)
+		record()
+	}
+	expected = []string{"entries-20221201T130003.000000000Z.lp.gz", "entries-20221201T140003.000000000Z.lp.gz", "entries.lp"}
+	if actual := listDir(t, dir); strings.Join(actual, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected files %v, got %v", expected, actual)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	ctx := context.Background()
+	for _, c := range []Config{
+		{},
+		{Dir: t.TempDir(), Encoding: "xml"},
+		{Dir: t.TempDir(), MaxSize: -1},
+		{Dir: t.TempDir(), MaxFiles: -1},
+	} {
+		if _, err := c.NewSink(ctx); err == nil {
+			t.Fatalf("expected error for %+v", c)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+)
+
+// fluxUnits are the units of Flux durations, from large to small.
+var fluxUnits = []struct {
+	unit string
+	d    time.Duration
+}{
+	{"h", time.Hour},
+	{"m", time.Minute},
+	{"s", time.Second},
+	{"ms", time.Millisecond},
+	{"us", time.Microsecond},
+	{"ns", time.Nanosecond},
+}
+
+// flux returns the Flux script of a normalized query.
+func flux(bucket string, q query.Query) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "from(bucket: %s)\n", fluxString(bucket))
+	fmt.Fprintf(&b, "\t|> range(start: %s, stop: %s)\n", q.Start.UTC().Format(time.RFC3339Nano), q.Stop.UTC().Format(time.RFC3339Nano))
+	fmt.Fprintf(&b, "\t|> filter(fn: (r) => r._measurement == %s)\n", fluxString(q.Measurement))
+	if len(q.Fields) > 0 {
+		conditions := make([]string, len(q.Fields))
+		for i, field := range q.Fields {
+			conditions[i] = "r._field == " + fluxString(field)
+		}
+		fmt.Fprintf(&b, "\t|> filter(fn: (r) => %s)\n", strings.Join(conditions, " or "))
+	}
+	for _, tag := range entry.SortedKeys(q.Tags) {
+		fmt.Fprintf(&b, "\t|> filter(fn: (r) => r[%s] == %s)\n", fluxString(tag), fluxString(q.Tags[tag]))
+	}
+	if q.Window > 0 {
+		fmt.Fprintf(&b, "\t|> aggregateWindow(every: %s, fn: %s, timeSrc: \"_start\", createEmpty: false)\n", fluxDuration(q.Window), q.Aggregate)
+	}
+	return b.String()
+}
+
+// fluxString returns a Flux string literal. Interpolation is escaped.
+func fluxString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// fluxDuration returns a Flux duration literal in the largest unit that the duration is a multiple of.
+func fluxDuration(d time.Duration) string {
+	for _, u := range fluxUnits {
+		if d%u.d == 0 {
+			return fmt.Sprintf("%d%s", d/u.d, u.unit)
+		}
+	}
+	return fmt.Sprintf("%dns", d)
+}
@@ -0,0 +1,83 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"testing"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+)
+
+func TestFlux(t *testing.T) {
+	start := time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		Name     string
+		Query    query.Query
+		Expected string
+	}{
+		{
+			Name: "Raw",
+			Query: query.Query{
+				Measurement: "smartmeter",
+				Start:       start,
+				Stop:        start.Add(90 * time.Minute),
+			},
+			Expected: `from(bucket: "test")
+	|> range(start: 2022-12-01T00:00:00Z, stop: 2022-12-01T01:30:00Z)
+	|> filter(fn: (r) => r._measurement == "smartmeter")
+`,
+		},
+		{
+			Name: "Aggregate",
+			Query: query.Query{
+				Measurement: "smartmeter",
+				Fields:      []string{"power", "gas"},
+				Tags:        map[string]string{"id": "meter-1", "location": `"home" ${x}`},
+				Start:       start,
+				Stop:        start.Add(time.Hour),
+				Window:      90 * time.Second,
+				Aggregate:   query.AggregateMax,
+			},
+			Expected: `from(bucket: "test")
+	|> range(start: 2022-12-01T00:00:00Z, stop: 2022-12-01T01:00:00Z)
+	|> filter(fn: (r) => r._measurement == "smartmeter")
+	|> filter(fn: (r) => r._field == "power" or r._field == "gas")
+	|> filter(fn: (r) => r["id"] == "meter-1")
+	|> filter(fn: (r) => r["location"] == "\"home\" \${x}")
+	|> aggregateWindow(every: 90s, fn: max, timeSrc: "_start", createEmpty: false)
+`,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			if actual := flux("test", tc.Query); actual != tc.Expected {
+				t.Fatalf("expected\n%s\ngot\n%s", tc.Expected, actual)
+			}
+		})
+	}
+}
+
+func TestFluxDuration(t *testing.T) {
+	for d, expected := range map[time.Duration]string{
+		time.Hour:               "1h",
+		90 * time.Minute:        "90m",
+		1500 * time.Millisecond: "1500ms",
+		time.Nanosecond:         "1ns",
+	} {
+		if actual := fluxDuration(d); actual != expected {
+			t.Fatalf("expected %s to be %s, got %s", d, expected, actual)
+		}
+	}
+}
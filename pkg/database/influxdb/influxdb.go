@@ -17,17 +17,25 @@ package influxdb
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"sort"
+	"strings"
 	"time"
 
 	influxdb "github.com/influxdata/influxdb-client-go/v2"
+	influxhttp "github.com/influxdata/influxdb-client-go/v2/api/http"
 	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
 	"krishnaiyer.dev/golang/dry/pkg/logger"
 )
 
 const (
 	// DefaultWriteTimeout is the default write timeout.
 	DefaultWriteTimeout = 5 * time.Second
+	// DefaultMaxClockSkew is the default maximum difference between the device time and the server time.
+	DefaultMaxClockSkew = 24 * time.Hour
 )
 
 // SetupOptions are used to setup the database.
@@ -41,6 +49,7 @@ type SetupOptions struct {
 // This scales well but is also more prone to error.
 // In case of a crash, data may be lost.
 // If set to false (default), blocking write API is used, which is more reliable.
+// Combine blocking writes with the write-ahead buffer of the database to avoid losing data during outages.
 type NonBlockingWrites struct {
 	Enabled       bool `name:"enabled" description:"enable non-blocking writes"`
 	BatchSize     int  `name:"batch_size" description:"batch size"`
@@ -55,6 +64,7 @@ type Config struct {
 	Bucket            string            `name:"bucket" description:"data bucket"`
 	Organization      string            `name:"organization" description:"organization"`
 	WriteTimeout      time.Duration     `name:"write_timeout" description:"write timeout in seconds (for blocking writes)"`
+	MaxClockSkew      time.Duration     `name:"max_clock_skew" description:"maximum difference between the device time and the server time. Entries outside this window are recorded at the server time (default 24h)"`
 	SetupOpts         SetupOptions      `name:"setup" description:"setup options"`
 }
 
@@ -89,9 +99,14 @@ func (c *Config) NewClient(ctx context.Context) *Client {
 		options.SetBatchSize(uint(c.NonBlockingWrites.BatchSize))
 		options.SetFlushInterval(uint(c.NonBlockingWrites.FlushInterval))
 	}
+	httpClient := options.HTTPClient()
+	httpClient.Transport = instrumentedTransport{httpClient.Transport}
 	if c.WriteTimeout == 0 {
 		c.WriteTimeout = DefaultWriteTimeout
 	}
+	if c.MaxClockSkew == 0 {
+		c.MaxClockSkew = DefaultMaxClockSkew
+	}
 	cl := influxdb.NewClientWithOptions(c.Address, c.Token,
 		options,
 	)
@@ -118,7 +133,7 @@ func (c *Client) Record(ctx context.Context, entry entry.Entry) error {
 		entry.Measurement,
 		entry.Tags,
 		entry.Fields,
-		time.Now(),
+		c.pointTime(ctx, entry),
 	)
 	if c.cfg.NonBlockingWrites.Enabled {
 		writeAPI := c.cl.WriteAPI(c.cfg.Organization, c.cfg.Bucket)
@@ -128,7 +143,40 @@ func (c *Client) Record(ctx context.Context, entry entry.Entry) error {
 	ctx, cancel := context.WithTimeout(ctx, c.cfg.WriteTimeout)
 	defer cancel()
 	writeAPI := c.cl.WriteAPIBlocking(c.cfg.Organization, c.cfg.Bucket)
-	return writeAPI.WritePoint(ctx, point)
+	return writeError(writeAPI.WritePoint(ctx, point))
+}
+
+// writeError marks the errors of points that the server rejects for good, like field type conflicts, as rejected.
+func writeError(err error) error {
+	var httpErr *influxhttp.Error
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+			return entry.Reject(err)
+		}
+	}
+	return err
+}
+
+// Ping implements Database.
+// Looking up the bucket checks that the server is reachable, the token is valid and the bucket exists.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.cl.BucketsAPI().FindBucketByName(ctx, c.cfg.Bucket)
+	return err
+}
+
+// pointTime returns the time of the entry if it is within the clock skew window and the server time otherwise.
+func (c *Client) pointTime(ctx context.Context, entry entry.Entry) time.Time {
+	now := time.Now()
+	if entry.Time.IsZero() {
+		return now
+	}
+	skew := now.Sub(entry.Time)
+	if skew > c.cfg.MaxClockSkew || skew < -c.cfg.MaxClockSkew {
+		logger.LoggerFromContext(ctx).WithField("measurement", entry.Measurement).WithField("time", entry.Time).WithField("skew", skew).Warn("Entry time outside clock skew window, use server time")
+		return now
+	}
+	return entry.Time
 }
 
 func (c *Client) Query(ctx context.Context, query string) (map[time.Time]any, error) {
@@ -156,3 +204,59 @@ func (c *Client) Query(ctx context.Context, query string) (map[time.Time]any, er
 	}
 	return ret, nil
 }
+
+// Select implements Database.
+// The query is translated to Flux. The columns of the records that are not Flux columns are the tags.
+func (c *Client) Select(ctx context.Context, q query.Query) ([]query.Series, error) {
+	q, err := q.Normalize(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	script := flux(c.cfg.Bucket, q)
+	logger.LoggerFromContext(ctx).WithField("query", script).Debug("Run query")
+
+	result, err := c.cl.QueryAPI(c.cfg.Organization).Query(ctx, script)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	collector := query.NewCollector()
+	for result.Next() {
+		record := result.Record()
+		tags := make(map[string]string)
+		for key, value := range record.Values() {
+			if strings.HasPrefix(key, "_") || key == "result" || key == "table" {
+				continue
+			}
+			if v, ok := value.(string); ok {
+				tags[key] = v
+			}
+		}
+		collector.Add(record.Measurement(), record.Field(), tags, record.Time(), record.Value())
+	}
+	if err := result.Err(); err != nil {
+		return nil, fmt.Errorf("query parsing error: %w", err)
+	}
+	return collector.Series(), nil
+}
+
+// Measurements implements Database.
+func (c *Client) Measurements(ctx context.Context) ([]string, error) {
+	script := fmt.Sprintf("import \"influxdata/influxdb/schema\"\n\nschema.measurements(bucket: %s)\n", fluxString(c.cfg.Bucket))
+	result, err := c.cl.QueryAPI(c.cfg.Organization).Query(ctx, script)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	measurements := []string{}
+	for result.Next() {
+		if measurement, ok := result.Record().Value().(string); ok {
+			measurements = append(measurements, measurement)
+		}
+	}
+	if err := result.Err(); err != nil {
+		return nil, fmt.Errorf("query parsing error: %w", err)
+	}
+	sort.Strings(measurements)
+	return measurements, nil
+}
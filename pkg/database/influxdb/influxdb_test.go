@@ -18,8 +18,10 @@ import (
 	"context"
 	"os"
 	"testing"
+	"time"
 
 	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
 	"krishnaiyer.dev/golang/dry/pkg/logger"
 )
 
@@ -102,4 +104,17 @@ func TestInfluxDB(t *testing.T) {
 		t.Fatal(err)
 	}
 	t.Log(val)
+
+	series, err := client.Select(ctx, query.Query{
+		Measurement: "test",
+		Fields:      []string{"field1"},
+		Tags:        map[string]string{"tag1": "value1"},
+		Start:       time.Now().Add(-time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 1 || len(series[0].Rows) != 3 {
+		t.Fatalf("expected a series with 3 rows, got %v", series)
+	}
 }
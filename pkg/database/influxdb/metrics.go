@@ -0,0 +1,82 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/metrics"
+)
+
+const (
+	databaseLabel = "influxdb"
+	writePath     = "/api/v2/write"
+)
+
+// instrumentedTransport records the metrics of write requests.
+// Both the blocking and the non-blocking write API send batches of points in the line protocol through it.
+type instrumentedTransport struct {
+	http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Path, writePath) {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	if n, ok := batchSize(req); ok {
+		metrics.DatabaseWriteBatchSize.WithLabelValues(databaseLabel).Observe(float64(n))
+	}
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	metrics.DatabaseWriteDuration.WithLabelValues(databaseLabel).Observe(time.Since(start).Seconds())
+	if err != nil || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		metrics.DatabaseWriteErrors.WithLabelValues(databaseLabel).Inc()
+	}
+	return resp, err
+}
+
+// CloseIdleConnections closes the idle connections of the underlying transport.
+func (t instrumentedTransport) CloseIdleConnections() {
+	if tr, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+// batchSize returns the number of points in the body of a write request.
+// Compressed bodies are not counted.
+func batchSize(req *http.Request) (int, bool) {
+	if req.GetBody == nil || req.Header.Get("Content-Encoding") != "" {
+		return 0, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return 0, false
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return 0, false
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return 0, true
+	}
+	return bytes.Count(data, []byte("\n")) + 1, true
+}
@@ -0,0 +1,99 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/metrics"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	ctx := context.Background()
+	var fail atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, `{"code":"unauthorized","message":"unauthorized access"}`, http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	cfg := Config{
+		Address:      srv.URL,
+		Bucket:       "test",
+		Organization: "test",
+	}
+	client := cfg.NewClient(ctx)
+	defer client.Close(ctx)
+
+	failed := testutil.ToFloat64(metrics.DatabaseWriteErrors.WithLabelValues(databaseLabel))
+	e := entry.Entry{
+		Measurement: "test",
+		Tags:        map[string]string{"id": "test"},
+		Fields:      map[string]any{"value": 1},
+	}
+	if err := client.Record(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(metrics.DatabaseWriteDuration); n != 1 {
+		t.Fatalf("expected write duration to be observed, got %d series", n)
+	}
+	if n := testutil.ToFloat64(metrics.DatabaseWriteErrors.WithLabelValues(databaseLabel)); n != failed {
+		t.Fatalf("expected %v write errors, got %v", failed, n)
+	}
+
+	fail.Store(true)
+	if err := client.Record(ctx, e); err == nil {
+		t.Fatal("expected error")
+	}
+	if n := testutil.ToFloat64(metrics.DatabaseWriteErrors.WithLabelValues(databaseLabel)); n != failed+1 {
+		t.Fatalf("expected %v write errors, got %v", failed+1, n)
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	for _, tc := range []struct {
+		Name     string
+		Body     string
+		Expected int
+	}{
+		{Name: "Empty", Body: "", Expected: 0},
+		{Name: "Single", Body: "test,id=test value=1i\n", Expected: 1},
+		{Name: "Batch", Body: "test,id=test value=1i\ntest,id=test value=2i\ntest,id=test value=3i\n", Expected: 3},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "http://localhost"+writePath, strings.NewReader(tc.Body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, ok := batchSize(req)
+			if !ok {
+				t.Fatal("expected batch size")
+			}
+			if n != tc.Expected {
+				t.Fatalf("expected batch size %d, got %d", tc.Expected, n)
+			}
+		})
+	}
+}
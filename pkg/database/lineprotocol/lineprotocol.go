@@ -0,0 +1,105 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lineprotocol encodes entries as InfluxDB line protocol.
+package lineprotocol
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+)
+
+// Line protocol can't escape newlines, so newlines in measurements, tags and field keys are written as spaces.
+// Otherwise, a tag value could add lines.
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\ `, "\r", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\ `, "\r", `\ `)
+	stringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// Append appends the line of the entry with a nanosecond timestamp. Tags and fields are sorted by key.
+// Fields with unsupported values are skipped. Entries without supported fields are skipped.
+func Append(buf *bytes.Buffer, e entry.Entry) {
+	var fields []string
+	for _, key := range entry.SortedKeys(e.Fields) {
+		if value, ok := formatField(e.Fields[key]); ok {
+			fields = append(fields, keyEscaper.Replace(key)+"="+value)
+		}
+	}
+	if len(fields) == 0 {
+		return
+	}
+	buf.WriteString(measurementEscaper.Replace(e.Measurement))
+	for _, key := range entry.SortedKeys(e.Tags) {
+		if e.Tags[key] == "" {
+			continue
+		}
+		buf.WriteByte(',')
+		buf.WriteString(keyEscaper.Replace(key))
+		buf.WriteByte('=')
+		buf.WriteString(keyEscaper.Replace(e.Tags[key]))
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(strings.Join(fields, ","))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(e.Time.UnixNano(), 10))
+	buf.WriteByte('\n')
+}
+
+// formatField formats a field value. Unsigned integers are written as signed integers, which both InfluxDB v1 and v2 support.
+// Unsigned integers that don't fit are written as unsigned integers.
+func formatField(value any) (string, bool) {
+	switch v := value.(type) {
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case float32:
+		return formatField(float64(v))
+	case int:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case int8:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case int16:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case int32:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case int64:
+		return strconv.FormatInt(v, 10) + "i", true
+	case uint:
+		return formatField(uint64(v))
+	case uint64:
+		if v > math.MaxInt64 {
+			return strconv.FormatUint(v, 10) + "u", true
+		}
+		return strconv.FormatUint(v, 10) + "i", true
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10) + "i", true
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10) + "i", true
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10) + "i", true
+	case bool:
+		return strconv.FormatBool(v), true
+	case string:
+		return `"` + stringEscaper.Replace(v) + `"`, true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/dry/pkg/logger"
+)
+
+// The data types of the columns, as reported by information_schema.columns.
+const (
+	typeText      = "text"
+	typeBigint    = "bigint"
+	typeDouble    = "double precision"
+	typeBoolean   = "boolean"
+	typeTimestamp = "timestamp with time zone"
+)
+
+// dataType returns the data type of the column of a field value.
+func dataType(value any) (string, error) {
+	switch value.(type) {
+	case string:
+		return typeText, nil
+	case int, int8, int16, int32, int64, uint8, uint16, uint32:
+		return typeBigint, nil
+	case float32, float64:
+		return typeDouble, nil
+	case bool:
+		return typeBoolean, nil
+	default:
+		return "", fmt.Errorf("unsupported type %T", value)
+	}
+}
+
+// columnsOf returns the data types of the columns of the entries.
+// Tags are text. If a field has integer and float values, the column is a float.
+func columnsOf(entries []entry.Entry) map[string]string {
+	columns := make(map[string]string)
+	for _, e := range entries {
+		for key := range e.Tags {
+			columns[key] = typeText
+		}
+		for key, value := range e.Fields {
+			typ, err := dataType(value)
+			if err != nil {
+				continue
+			}
+			if existing, ok := columns[key]; ok && existing != typ {
+				if existing == typeBigint && typ == typeDouble {
+					columns[key] = typeDouble
+				}
+				continue
+			}
+			columns[key] = typ
+		}
+	}
+	return columns
+}
+
+// copyRows returns the column names and the rows to copy.
+// The values are converted to the data type of the column. Entries with values that can't be converted are dropped.
+func copyRows(ctx context.Context, columns map[string]string, entries []entry.Entry) ([]string, [][]any) {
+	names := []string{timeColumn}
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		for key := range e.Tags {
+			seen[key] = true
+		}
+		for key := range e.Fields {
+			seen[key] = true
+		}
+	}
+	keys := entry.SortedKeys(seen)
+	names = append(names, keys...)
+
+	rows := make([][]any, 0, len(entries))
+	for _, e := range entries {
+		row, err := copyRow(columns, keys, e)
+		if err != nil {
+			logger.LoggerFromContext(ctx).WithError(err).WithField("measurement", e.Measurement).Warn("Drop entry")
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return names, rows
+}
+
+// copyRow returns the row of an entry. Columns without a value are null.
+func copyRow(columns map[string]string, keys []string, e entry.Entry) ([]any, error) {
+	row := make([]any, 0, len(keys)+1)
+	row = append(row, e.Time)
+	for _, key := range keys {
+		if tag, ok := e.Tags[key]; ok {
+			if columns[key] != typeText {
+				return nil, fmt.Errorf("invalid tag '%s': the column is %s", key, columns[key])
+			}
+			row = append(row, tag)
+			continue
+		}
+		value, ok := e.Fields[key]
+		if !ok {
+			row = append(row, nil)
+			continue
+		}
+		v, err := convert(value, columns[key])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of field '%s': %w", key, err)
+		}
+		row = append(row, v)
+	}
+	return row, nil
+}
+
+// convert converts a field value to the data type of the column.
+func convert(value any, typ string) (any, error) {
+	switch typ {
+	case typeText:
+		if v, ok := value.(string); ok {
+			return v, nil
+		}
+	case typeBigint:
+		if v, ok := toInt(value); ok {
+			return v, nil
+		}
+		if v, ok := toFloat(value); ok && v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+			return int64(v), nil
+		}
+	case typeDouble:
+		if v, ok := toFloat(value); ok {
+			return v, nil
+		}
+		if v, ok := toInt(value); ok {
+			return float64(v), nil
+		}
+	case typeBoolean:
+		if v, ok := value.(bool); ok {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot convert %T to %s", value, typ)
+}
+
+func toInt(value any) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	default:
+		return 0, false
+	}
+}
+
+func toFloat(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+)
+
+func TestColumnsOf(t *testing.T) {
+	entries := []entry.Entry{
+		{
+			Tags:   map[string]string{"id": "meter-1"},
+			Fields: map[string]any{"tariff": 1, "power": 1, "equipment_id": "E0001", "valve": true},
+		},
+		{
+			Tags:   map[string]string{"id": "meter-2", "location": "home"},
+			Fields: map[string]any{"tariff": 2, "power": 0.5, "invalid": []int{1}},
+		},
+	}
+	expected := map[string]string{
+		"id":           typeText,
+		"location":     typeText,
+		"tariff":       typeBigint,
+		"power":        typeDouble,
+		"equipment_id": typeText,
+		"valve":        typeBoolean,
+	}
+	if columns := columnsOf(entries); !reflect.DeepEqual(columns, expected) {
+		t.Fatalf("expected %v, got %v", expected, columns)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	for _, tc := range []struct {
+		Name     string
+		Value    any
+		Type     string
+		Expected any
+	}{
+		{Name: "Text", Value: "E0001", Type: typeText, Expected: "E0001"},
+		{Name: "Bigint", Value: int32(3), Type: typeBigint, Expected: int64(3)},
+		{Name: "IntegralFloatToBigint", Value: 3.0, Type: typeBigint, Expected: int64(3)},
+		{Name: "FloatToBigint", Value: 3.5, Type: typeBigint},
+		{Name: "Double", Value: float32(0.5), Type: typeDouble, Expected: 0.5},
+		{Name: "IntToDouble", Value: 3, Type: typeDouble, Expected: 3.0},
+		{Name: "Boolean", Value: true, Type: typeBoolean, Expected: true},
+		{Name: "IntToText", Value: 3, Type: typeText},
+		{Name: "TextToBoolean", Value: "true", Type: typeBoolean},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			v, err := convert(tc.Value, tc.Type)
+			if tc.Expected == nil {
+				if err == nil {
+					t.Fatalf("expected error, got %v", v)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != tc.Expected {
+				t.Fatalf("expected %v (%T), got %v (%T)", tc.Expected, tc.Expected, v, v)
+			}
+		})
+	}
+}
+
+func TestCopyRows(t *testing.T) {
+	now := time.Now()
+	columns := map[string]string{
+		"id":     typeText,
+		"tariff": typeBigint,
+		"power":  typeDouble,
+	}
+	entries := []entry.Entry{
+		{Time: now, Tags: map[string]string{"id": "meter-1"}, Fields: map[string]any{"tariff": 1, "power": 1}},
+		{Time: now.Add(time.Second), Fields: map[string]any{"power": 0.5}},
+		{Time: now.Add(2 * time.Second), Fields: map[string]any{"tariff": 1.5}},
+	}
+	names, rows := copyRows(context.Background(), columns, entries)
+	if expected := []string{"time", "id", "power", "tariff"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected columns %v, got %v", expected, names)
+	}
+	expected := [][]any{
+		{now, "meter-1", 1.0, int64(1)},
+		{now.Add(time.Second), nil, 0.5, nil},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("expected rows %v, got %v", expected, rows)
+	}
+}
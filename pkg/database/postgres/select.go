@@ -0,0 +1,147 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+)
+
+// selection is the statement of a query and the tags and fields that it selects after the time.
+type selection struct {
+	stmt   string
+	args   []any
+	tags   []string
+	fields []string
+}
+
+// selectSQL returns the selection of a normalized query from a table with the columns.
+// Text columns are tags, unless they are selected as fields. Other columns are fields.
+// It returns nil if the query can't match any rows, because a field or a tag is not a column.
+func selectSQL(schema string, columns map[string]string, q query.Query) (*selection, error) {
+	s := &selection{}
+	selected := make(map[string]bool)
+	if len(q.Fields) > 0 {
+		for _, field := range q.Fields {
+			if _, ok := columns[field]; ok && field != timeColumn && !selected[field] {
+				selected[field] = true
+				s.fields = append(s.fields, field)
+			}
+		}
+	} else {
+		for name, typ := range columns {
+			if name != timeColumn && typ != typeText {
+				selected[name] = true
+				s.fields = append(s.fields, name)
+			}
+		}
+		sort.Strings(s.fields)
+	}
+	if len(s.fields) == 0 {
+		return nil, nil
+	}
+	for name, typ := range columns {
+		if typ == typeText && !selected[name] {
+			s.tags = append(s.tags, name)
+		}
+	}
+	sort.Strings(s.tags)
+
+	s.args = []any{q.Start, q.Stop}
+	where := []string{
+		fmt.Sprintf("%s >= $1", pgx.Identifier{timeColumn}.Sanitize()),
+		fmt.Sprintf("%s < $2", pgx.Identifier{timeColumn}.Sanitize()),
+	}
+	for _, tag := range entry.SortedKeys(q.Tags) {
+		if columns[tag] != typeText {
+			return nil, nil
+		}
+		s.args = append(s.args, q.Tags[tag])
+		where = append(where, fmt.Sprintf("%s = $%d", pgx.Identifier{tag}.Sanitize(), len(s.args)))
+	}
+
+	var (
+		selects []string
+		groupBy string
+		timeCol = pgx.Identifier{timeColumn}.Sanitize()
+	)
+	if q.Window == 0 {
+		selects = append(selects, timeCol)
+	} else {
+		s.args = append(s.args, q.Window.Seconds())
+		selects = append(selects, fmt.Sprintf("to_timestamp(floor(extract(epoch FROM %[1]s)::double precision / $%[2]d) * $%[2]d) AS %[1]s", timeCol, len(s.args)))
+		groups := make([]string, len(s.tags)+1)
+		for i := range groups {
+			groups[i] = fmt.Sprint(i + 1)
+		}
+		groupBy = " GROUP BY " + strings.Join(groups, ", ")
+	}
+	for _, tag := range s.tags {
+		selects = append(selects, pgx.Identifier{tag}.Sanitize())
+	}
+	for _, field := range s.fields {
+		column := pgx.Identifier{field}.Sanitize()
+		if q.Window == 0 {
+			selects = append(selects, column)
+			continue
+		}
+		expr, err := aggregateSQL(column, columns[field], q.Aggregate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid field '%s': %w", field, err)
+		}
+		selects = append(selects, expr)
+	}
+	s.stmt = fmt.Sprintf("SELECT %s FROM %s WHERE %s%s ORDER BY 1",
+		strings.Join(selects, ", "),
+		pgx.Identifier{schema, q.Measurement}.Sanitize(),
+		strings.Join(where, " AND "),
+		groupBy,
+	)
+	return s, nil
+}
+
+// aggregateSQL returns the aggregate of a column of a data type.
+// The count is an integer and other aggregates of numbers are floats. Booleans are 0 and 1.
+func aggregateSQL(column, typ, fn string) (string, error) {
+	timeCol := pgx.Identifier{timeColumn}.Sanitize()
+	switch fn {
+	case query.AggregateCount:
+		return fmt.Sprintf("count(%s)", column), nil
+	case query.AggregateFirst:
+		return fmt.Sprintf("(array_agg(%[1]s ORDER BY %[2]s) FILTER (WHERE %[1]s IS NOT NULL))[1]", column, timeCol), nil
+	case query.AggregateLast:
+		return fmt.Sprintf("(array_agg(%[1]s ORDER BY %[2]s DESC) FILTER (WHERE %[1]s IS NOT NULL))[1]", column, timeCol), nil
+	}
+	switch typ {
+	case typeBoolean:
+		column += "::integer"
+	case typeBigint, typeDouble:
+	default:
+		return "", fmt.Errorf("cannot aggregate %s with %s", typ, fn)
+	}
+	switch fn {
+	case query.AggregateMean:
+		return fmt.Sprintf("avg(%s)::double precision", column), nil
+	case query.AggregateMin, query.AggregateMax, query.AggregateSum:
+		return fmt.Sprintf("%s(%s)::double precision", fn, column), nil
+	default:
+		return "", fmt.Errorf("unsupported aggregate '%s'", fn)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+)
+
+func TestSelectSQL(t *testing.T) {
+	start := time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC)
+	stop := start.Add(time.Hour)
+	columns := map[string]string{
+		"time":         typeTimestamp,
+		"id":           typeText,
+		"equipment_id": typeText,
+		"power":        typeDouble,
+		"tariff":       typeBigint,
+		"valve":        typeBoolean,
+	}
+	for _, tc := range []struct {
+		Name     string
+		Query    query.Query
+		Expected *selection
+		Error    bool
+	}{
+		{
+			Name:  "Raw",
+			Query: query.Query{Measurement: "smartmeter", Tags: map[string]string{"id": "meter-1"}, Start: start, Stop: stop},
+			Expected: &selection{
+				stmt:   `SELECT "time", "equipment_id", "id", "power", "tariff", "valve" FROM "datasink"."smartmeter" WHERE "time" >= $1 AND "time" < $2 AND "id" = $3 ORDER BY 1`,
+				args:   []any{start, stop, "meter-1"},
+				tags:   []string{"equipment_id", "id"},
+				fields: []string{"power", "tariff", "valve"},
+			},
+		},
+		{
+			Name:  "TextField",
+			Query: query.Query{Measurement: "smartmeter", Fields: []string{"equipment_id", "missing"}, Start: start, Stop: stop},
+			Expected: &selection{
+				stmt:   `SELECT "time", "id", "equipment_id" FROM "datasink"."smartmeter" WHERE "time" >= $1 AND "time" < $2 ORDER BY 1`,
+				args:   []any{start, stop},
+				tags:   []string{"id"},
+				fields: []string{"equipment_id"},
+			},
+		},
+		{
+			Name:  "Aggregate",
+			Query: query.Query{Measurement: "smartmeter", Fields: []string{"power", "valve"}, Start: start, Stop: stop, Window: time.Minute, Aggregate: query.AggregateMean},
+			Expected: &selection{
+				stmt:   `SELECT to_timestamp(floor(extract(epoch FROM "time")::double precision / $3) * $3) AS "time", "equipment_id", "id", avg("power")::double precision, avg("valve"::integer)::double precision FROM "datasink"."smartmeter" WHERE "time" >= $1 AND "time" < $2 GROUP BY 1, 2, 3 ORDER BY 1`,
+				args:   []any{start, stop, 60.0},
+				tags:   []string{"equipment_id", "id"},
+				fields: []string{"power", "valve"},
+			},
+		},
+		{
+			Name:  "Last",
+			Query: query.Query{Measurement: "smartmeter", Fields: []string{"equipment_id"}, Start: start, Stop: stop, Window: time.Minute, Aggregate: query.AggregateLast},
+			Expected: &selection{
+				stmt:   `SELECT to_timestamp(floor(extract(epoch FROM "time")::double precision / $3) * $3) AS "time", "id", (array_agg("equipment_id" ORDER BY "time" DESC) FILTER (WHERE "equipment_id" IS NOT NULL))[1] FROM "datasink"."smartmeter" WHERE "time" >= $1 AND "time" < $2 GROUP BY 1, 2 ORDER BY 1`,
+				args:   []any{start, stop, 60.0},
+				tags:   []string{"id"},
+				fields: []string{"equipment_id"},
+			},
+		},
+		{
+			Name:  "AggregateText",
+			Query: query.Query{Measurement: "smartmeter", Fields: []string{"equipment_id"}, Start: start, Stop: stop, Window: time.Minute, Aggregate: query.AggregateSum},
+			Error: true,
+		},
+		{
+			Name:  "MissingField",
+			Query: query.Query{Measurement: "smartmeter", Fields: []string{"gas"}, Start: start, Stop: stop},
+		},
+		{
+			Name:  "MissingTag",
+			Query: query.Query{Measurement: "smartmeter", Tags: map[string]string{"location": "home"}, Start: start, Stop: stop},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			s, err := selectSQL(DefaultSchema, columns, tc.Query)
+			if tc.Error {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(s, tc.Expected) {
+				t.Fatalf("expected %+v, got %+v", tc.Expected, s)
+			}
+		})
+	}
+}
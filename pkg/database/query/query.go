@@ -0,0 +1,306 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package query defines queries and results that don't depend on the database.
+package query
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+)
+
+// Aggregate functions.
+const (
+	AggregateMean  = "mean"
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+	AggregateSum   = "sum"
+	AggregateCount = "count"
+	AggregateFirst = "first"
+	AggregateLast  = "last"
+)
+
+var aggregates = []string{AggregateMean, AggregateMin, AggregateMax, AggregateSum, AggregateCount, AggregateFirst, AggregateLast}
+
+// Query selects the fields of a measurement in a time range.
+type Query struct {
+	Measurement string
+	// Fields are the fields to select. If empty, all fields are selected.
+	Fields []string
+	// Tags are the tag values that entries must have.
+	Tags map[string]string
+	// Start is the inclusive start of the time range.
+	Start time.Time
+	// Stop is the exclusive end of the time range. If zero, the range ends now.
+	Stop time.Time
+	// Window is the duration of the windows that the values are aggregated in. If zero, the values are not aggregated.
+	// Windows are aligned to the Unix epoch and the rows of aggregated values have the start time of the window.
+	Window time.Duration
+	// Aggregate is the function that aggregates the values of a window (default mean).
+	Aggregate string
+}
+
+// Normalize returns the query with the defaults, or an error if the query is invalid.
+func (q Query) Normalize(now time.Time) (Query, error) {
+	if q.Measurement == "" {
+		return Query{}, errors.New("invalid query: missing measurement")
+	}
+	if q.Start.IsZero() {
+		return Query{}, errors.New("invalid query: missing start")
+	}
+	if q.Stop.IsZero() {
+		q.Stop = now
+	}
+	if !q.Start.Before(q.Stop) {
+		return Query{}, errors.New("invalid query: start must be before stop")
+	}
+	if q.Window < 0 {
+		return Query{}, fmt.Errorf("invalid window '%s'", q.Window)
+	}
+	if q.Window == 0 {
+		if q.Aggregate != "" {
+			return Query{}, fmt.Errorf("invalid query: aggregate '%s' without window", q.Aggregate)
+		}
+		return q, nil
+	}
+	if q.Aggregate == "" {
+		q.Aggregate = AggregateMean
+	}
+	for _, fn := range aggregates {
+		if q.Aggregate == fn {
+			return q, nil
+		}
+	}
+	return Query{}, fmt.Errorf("invalid aggregate '%s'. Supported values are '%s'", q.Aggregate, strings.Join(aggregates, "', '"))
+}
+
+// ParseTime parses an RFC3339 time, 'now' or a duration relative to now, like '-24h'.
+func ParseTime(s string, now time.Time) (time.Time, error) {
+	if s == "now" {
+		return now, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time '%s'", s)
+	}
+	return t, nil
+}
+
+// Row is the value of a field at a time.
+type Row struct {
+	Time  time.Time `json:"time"`
+	Value any       `json:"value"`
+}
+
+// Series are the rows of a field of a measurement with a set of tags, sorted by time.
+type Series struct {
+	Measurement string            `json:"measurement"`
+	Field       string            `json:"field"`
+	Tags        map[string]string `json:"tags"`
+	Rows        []Row             `json:"rows"`
+}
+
+// Collector collects the rows of query results into series.
+type Collector struct {
+	series map[string]*Series
+}
+
+// NewCollector returns a new collector.
+func NewCollector() *Collector {
+	return &Collector{
+		series: make(map[string]*Series),
+	}
+}
+
+// Add adds a row to the series of the field with the tags.
+func (c *Collector) Add(measurement, field string, tags map[string]string, t time.Time, value any) {
+	key := seriesKey(measurement, field, tags)
+	s, ok := c.series[key]
+	if !ok {
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		s = &Series{
+			Measurement: measurement,
+			Field:       field,
+			Tags:        tags,
+		}
+		c.series[key] = s
+	}
+	s.Rows = append(s.Rows, Row{Time: t, Value: value})
+}
+
+// Series returns the series sorted by measurement, field and tags. The rows are sorted by time.
+func (c *Collector) Series() []Series {
+	keys := entry.SortedKeys(c.series)
+	ret := make([]Series, 0, len(keys))
+	for _, key := range keys {
+		s := c.series[key]
+		sort.SliceStable(s.Rows, func(i, j int) bool { return s.Rows[i].Time.Before(s.Rows[j].Time) })
+		ret = append(ret, *s)
+	}
+	return ret
+}
+
+// seriesKey returns the key of a series that sorts by measurement, field and tags.
+func seriesKey(measurement, field string, tags map[string]string) string {
+	var b strings.Builder
+	b.WriteString(measurement)
+	b.WriteByte(0)
+	b.WriteString(field)
+	for _, key := range entry.SortedKeys(tags) {
+		b.WriteByte(0)
+		b.WriteString(key)
+		b.WriteByte(0)
+		b.WriteString(tags[key])
+	}
+	return b.String()
+}
+
+// WindowStart returns the start of the window of the time. Windows are aligned to the Unix epoch.
+func WindowStart(t time.Time, window time.Duration) time.Time {
+	ns := t.UnixNano()
+	offset := ns % int64(window)
+	if offset < 0 {
+		offset += int64(window)
+	}
+	return time.Unix(0, ns-offset).In(t.Location())
+}
+
+// Aggregate aggregates the rows of the series in windows. Windows without values are left out.
+// The count is an integer and other aggregates of numbers are floats. Booleans are 0 and 1.
+// Values that are not numbers are only counted and selected by first and last.
+func Aggregate(series []Series, window time.Duration, fn string) []Series {
+	ret := make([]Series, 0, len(series))
+	for _, s := range series {
+		var (
+			rows  []Row
+			start time.Time
+			group []any
+		)
+		flush := func() {
+			if len(group) > 0 {
+				if v, ok := aggregate(group, fn); ok {
+					rows = append(rows, Row{Time: start, Value: v})
+				}
+			}
+			group = group[:0]
+		}
+		for _, row := range s.Rows {
+			if ws := WindowStart(row.Time, window); !ws.Equal(start) {
+				flush()
+				start = ws
+			}
+			group = append(group, row.Value)
+		}
+		flush()
+		if len(rows) == 0 {
+			continue
+		}
+		s.Rows = rows
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+// aggregate returns the aggregate of the values of a window.
+func aggregate(values []any, fn string) (any, bool) {
+	switch fn {
+	case AggregateCount:
+		return int64(len(values)), true
+	case AggregateFirst:
+		return values[0], true
+	case AggregateLast:
+		return values[len(values)-1], true
+	}
+	var (
+		n        int
+		sum      float64
+		min, max float64
+	)
+	for _, value := range values {
+		v, ok := Float(value)
+		if !ok {
+			continue
+		}
+		if n == 0 || v < min {
+			min = v
+		}
+		if n == 0 || v > max {
+			max = v
+		}
+		sum += v
+		n++
+	}
+	if n == 0 {
+		return nil, false
+	}
+	switch fn {
+	case AggregateMean:
+		return sum / float64(n), true
+	case AggregateSum:
+		return sum, true
+	case AggregateMin:
+		return min, true
+	case AggregateMax:
+		return max, true
+	default:
+		return nil, false
+	}
+}
+
+// Float returns the value of numeric and boolean values. Booleans are 0 and 1.
+func Float(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNormalize(t *testing.T) {
+	now := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	start := now.Add(-time.Hour)
+	for _, tc := range []struct {
+		Name     string
+		Query    Query
+		Expected *Query
+	}{
+		{
+			Name:     "Defaults",
+			Query:    Query{Measurement: "smartmeter", Start: start, Window: time.Minute},
+			Expected: &Query{Measurement: "smartmeter", Start: start, Stop: now, Window: time.Minute, Aggregate: AggregateMean},
+		},
+		{
+			Name:     "Raw",
+			Query:    Query{Measurement: "smartmeter", Start: start, Stop: now.Add(-time.Minute)},
+			Expected: &Query{Measurement: "smartmeter", Start: start, Stop: now.Add(-time.Minute)},
+		},
+		{Name: "MissingMeasurement", Query: Query{Start: start}},
+		{Name: "MissingStart", Query: Query{Measurement: "smartmeter"}},
+		{Name: "InvalidRange", Query: Query{Measurement: "smartmeter", Start: now, Stop: start}},
+		{Name: "AggregateWithoutWindow", Query: Query{Measurement: "smartmeter", Start: start, Aggregate: AggregateSum}},
+		{Name: "InvalidAggregate", Query: Query{Measurement: "smartmeter", Start: start, Window: time.Minute, Aggregate: "median"}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			q, err := tc.Query.Normalize(now)
+			if tc.Expected == nil {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(q, *tc.Expected) {
+				t.Fatalf("expected %+v, got %+v", *tc.Expected, q)
+			}
+		})
+	}
+}
+
+func TestCollector(t *testing.T) {
+	start := time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC)
+	c := NewCollector()
+	c.Add("smartmeter", "power", map[string]string{"id": "meter-2"}, start, 2.0)
+	c.Add("smartmeter", "power", map[string]string{"id": "meter-1"}, start.Add(time.Minute), 1.5)
+	c.Add("smartmeter", "power", map[string]string{"id": "meter-1"}, start, 1.0)
+	c.Add("smartmeter", "gas", nil, start, int64(10))
+	expected := []Series{
+		{
+			Measurement: "smartmeter",
+			Field:       "gas",
+			Tags:        map[string]string{},
+			Rows:        []Row{{Time: start, Value: int64(10)}},
+		},
+		{
+			Measurement: "smartmeter",
+			Field:       "power",
+			Tags:        map[string]string{"id": "meter-1"},
+			Rows:        []Row{{Time: start, Value: 1.0}, {Time: start.Add(time.Minute), Value: 1.5}},
+		},
+		{
+			Measurement: "smartmeter",
+			Field:       "power",
+			Tags:        map[string]string{"id": "meter-2"},
+			Rows:        []Row{{Time: start, Value: 2.0}},
+		},
+	}
+	if series := c.Series(); !reflect.DeepEqual(series, expected) {
+		t.Fatalf("expected %v, got %v", expected, series)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	start := time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC)
+	series := []Series{
+		{
+			Measurement: "smartmeter",
+			Field:       "power",
+			Rows: []Row{
+				{Time: start, Value: 1.0},
+				{Time: start.Add(20 * time.Second), Value: int64(2)},
+				{Time: start.Add(40 * time.Second), Value: true},
+				{Time: start.Add(2 * time.Minute), Value: 4.0},
+			},
+		},
+		{
+			Measurement: "smartmeter",
+			Field:       "equipment_id",
+			Rows:        []Row{{Time: start, Value: "E0001"}},
+		},
+	}
+	for _, tc := range []struct {
+		Aggregate string
+		Expected  []Row
+	}{
+		{Aggregate: AggregateMean, Expected: []Row{{Time: start, Value: 4.0 / 3}, {Time: start.Add(2 * time.Minute), Value: 4.0}}},
+		{Aggregate: AggregateMin, Expected: []Row{{Time: start, Value: 1.0}, {Time: start.Add(2 * time.Minute), Value: 4.0}}},
+		{Aggregate: AggregateMax, Expected: []Row{{Time: start, Value: 2.0}, {Time: start.Add(2 * time.Minute), Value: 4.0}}},
+		{Aggregate: AggregateSum, Expected: []Row{{Time: start, Value: 4.0}, {Time: start.Add(2 * time.Minute), Value: 4.0}}},
+		{Aggregate: AggregateCount, Expected: []Row{{Time: start, Value: int64(3)}, {Time: start.Add(2 * time.Minute), Value: int64(1)}}},
+		{Aggregate: AggregateFirst, Expected: []Row{{Time: start, Value: 1.0}, {Time: start.Add(2 * time.Minute), Value: 4.0}}},
+		{Aggregate: AggregateLast, Expected: []Row{{Time: start, Value: true}, {Time: start.Add(2 * time.Minute), Value: 4.0}}},
+	} {
+		t.Run(tc.Aggregate, func(t *testing.T) {
+			res := Aggregate(series, time.Minute, tc.Aggregate)
+			if len(res) == 0 || res[0].Field != "power" || !reflect.DeepEqual(res[0].Rows, tc.Expected) {
+				t.Fatalf("expected %v, got %v", tc.Expected, res)
+			}
+			// Strings are only aggregated by count, first and last.
+			switch tc.Aggregate {
+			case AggregateCount, AggregateFirst, AggregateLast:
+				if len(res) != 2 {
+					t.Fatalf("expected 2 series, got %d", len(res))
+				}
+			default:
+				if len(res) != 1 {
+					t.Fatalf("expected 1 series, got %d", len(res))
+				}
+			}
+		})
+	}
+}
+
+func TestWindowStart(t *testing.T) {
+	for _, tc := range []struct {
+		Time     time.Time
+		Window   time.Duration
+		Expected time.Time
+	}{
+		{Time: time.Unix(95, 0), Window: time.Minute, Expected: time.Unix(60, 0)},
+		{Time: time.Unix(-5, 0), Window: time.Minute, Expected: time.Unix(-60, 0)},
+		{Time: time.Unix(7*3600, 0), Window: 7 * time.Hour, Expected: time.Unix(7*3600, 0)},
+	} {
+		if actual := WindowStart(tc.Time, tc.Window); !actual.Equal(tc.Expected) {
+			t.Fatalf("expected window of %s to start at %s, got %s", tc.Time, tc.Expected, actual)
+		}
+	}
+}
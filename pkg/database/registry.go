@@ -0,0 +1,135 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// backend is a registered database backend.
+type backend struct {
+	new   func(ctx context.Context, c Config) (Database, error)
+	setup func(ctx context.Context, c Config) error
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]backend)
+)
+
+// Register registers a database backend of the given type.
+// The section returns the configuration section of the backend, which is passed to new and setup.
+// Setup initializes the database for the init-db command and can be nil if the backend needs no initialization.
+// Register panics if the type is already registered.
+func Register[C any](typ string, section func(Config) C, new func(context.Context, C) (Database, error), setup func(context.Context, C) error) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if _, ok := backends[typ]; ok {
+		panic(fmt.Sprintf("database type '%s' already registered", typ))
+	}
+	b := backend{
+		new: func(ctx context.Context, c Config) (Database, error) {
+			return new(ctx, section(c))
+		},
+	}
+	if setup != nil {
+		b.setup = func(ctx context.Context, c Config) error {
+			return setup(ctx, section(c))
+		}
+	}
+	backends[typ] = b
+}
+
+// Types returns the registered database types.
+func Types() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	types := make([]string, 0, len(backends))
+	for typ := range backends {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// backend returns the backend of the configured type.
+func (c Config) backend() (backend, error) {
+	backendsMu.RLock()
+	b, ok := backends[c.Type]
+	backendsMu.RUnlock()
+	if !ok {
+		return backend{}, fmt.Errorf("invalid database type '%s'. Supported values are '%s'", c.Type, strings.Join(Types(), "', '"))
+	}
+	return b, nil
+}
+
+// New creates the database of the configured type.
+// If the write-ahead buffer is configured, the database is wrapped in the buffer.
+// If sinks are configured, the database writes to all sinks instead.
+// Use Close() to close the database after done.
+func (c Config) New(ctx context.Context) (Database, error) {
+	if len(c.Sinks) > 0 {
+		if c.Buffer.Dir != "" {
+			return nil, fmt.Errorf("invalid buffer directory '%s': configure the buffer per sink", c.Buffer.Dir)
+		}
+		fanout, err := c.newFanout(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return fanout, nil
+	}
+	b, err := c.backend()
+	if err != nil {
+		return nil, err
+	}
+	db, err := b.new(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Buffer.Dir == "" {
+		return db, nil
+	}
+	buffer, err := c.Buffer.New(ctx, db)
+	if err != nil {
+		db.Close(ctx)
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// Setup initializes the database of the configured type, or the database of each sink if sinks are configured.
+// Backends that need no initialization are not set up.
+func (c Config) Setup(ctx context.Context) error {
+	if len(c.Sinks) > 0 {
+		for _, sc := range c.Sinks {
+			if err := sc.Database.Setup(ctx); err != nil {
+				return fmt.Errorf("sink '%s': %w", sc.Name, err)
+			}
+		}
+		return nil
+	}
+	b, err := c.backend()
+	if err != nil {
+		return err
+	}
+	if b.setup == nil {
+		return nil
+	}
+	return b.setup(ctx, c)
+}
@@ -0,0 +1,99 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+)
+
+type mockDatabase struct {
+	address string
+}
+
+func (db *mockDatabase) Record(ctx context.Context, entry entry.Entry) error { return nil }
+
+func (db *mockDatabase) Query(ctx context.Context, query string) (map[time.Time]any, error) {
+	return nil, nil
+}
+
+func (db *mockDatabase) Select(ctx context.Context, q query.Query) ([]query.Series, error) {
+	return nil, nil
+}
+
+func (db *mockDatabase) Measurements(ctx context.Context) ([]string, error) {
+	return nil, nil
+}
+
+func (db *mockDatabase) Ping(ctx context.Context) error { return nil }
+
+func (db *mockDatabase) Close(ctx context.Context) {}
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	var setup string
+	// Unregister the type, so that the test can run again in the same process.
+	t.Cleanup(func() {
+		backendsMu.Lock()
+		delete(backends, "mock")
+		backendsMu.Unlock()
+	})
+	Register("mock",
+		func(c Config) string { return c.InfluxDB.Address },
+		func(ctx context.Context, address string) (Database, error) {
+			return &mockDatabase{address: address}, nil
+		},
+		func(ctx context.Context, address string) error {
+			setup = address
+			return nil
+		},
+	)
+
+	c := Config{Type: "mock"}
+	c.InfluxDB.Address = "localhost"
+	db, err := c.New(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mock, ok := db.(*mockDatabase); !ok || mock.address != "localhost" {
+		t.Fatalf("expected mock database with the configuration section, got %+v", db)
+	}
+	if err := c.Setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if setup != "localhost" {
+		t.Fatalf("expected setup with the configuration section, got %q", setup)
+	}
+
+	_, err = Config{Type: "unknown"}.New(ctx)
+	if err == nil || !strings.Contains(err.Error(), "'influxdb', 'mock'") {
+		t.Fatalf("expected error listing the supported types, got %v", err)
+	}
+	if err := (Config{}).Setup(ctx); err == nil {
+		t.Fatal("expected error for missing type")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic when registering a type twice")
+		}
+	}()
+	Register("mock", func(c Config) Config { return c }, nil, nil)
+}
@@ -0,0 +1,61 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/lineprotocol"
+)
+
+// lineProtocol encodes entries as InfluxDB line protocol with nanosecond timestamps.
+type lineProtocol struct {
+	gzip bool
+}
+
+// encode implements encoder.
+// Fields with unsupported values are skipped. It returns nil if no entry has fields.
+func (lp lineProtocol) encode(entries []entry.Entry) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		lineprotocol.Append(&buf, e)
+	}
+	if buf.Len() == 0 {
+		return nil, nil
+	}
+	if !lp.gzip {
+		return buf.Bytes(), nil
+	}
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// headers implements encoder.
+func (lp lineProtocol) headers(h http.Header) {
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	if lp.gzip {
+		h.Set("Content-Encoding", "gzip")
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package remote writes entries to HTTP endpoints that accept InfluxDB line protocol or Prometheus remote write.
+// Line protocol is accepted by InfluxDB v1 (/write) and v2 (/api/v2/write), VictoriaMetrics, QuestDB and Telegraf.
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+	"krishnaiyer.dev/golang/datasink/pkg/metrics"
+	"krishnaiyer.dev/golang/dry/pkg/logger"
+)
+
+const (
+	// ProtocolLineProtocol is InfluxDB line protocol.
+	ProtocolLineProtocol = "line-protocol"
+	// ProtocolRemoteWrite is Prometheus remote write.
+	ProtocolRemoteWrite = "remote-write"
+
+	// DefaultBatchSize is the default number of entries that are written at once.
+	DefaultBatchSize = 1000
+	// DefaultFlushInterval is the default maximum time before queued entries are written.
+	DefaultFlushInterval = time.Second
+	// DefaultTimeout is the default timeout of a request.
+	DefaultTimeout = 10 * time.Second
+	// DefaultMaxRetries is the default number of retries of a failed batch.
+	DefaultMaxRetries = 5
+	// DefaultInitialBackoff is the default backoff after the first failed request of a batch.
+	DefaultInitialBackoff = time.Second
+	// DefaultMaxBackoff is the default maximum backoff between retries.
+	DefaultMaxBackoff = 30 * time.Second
+
+	// maxPendingBatches is the number of batches that are queued while requests fail.
+	maxPendingBatches = 10
+
+	databaseLabel = "http"
+)
+
+// Config configures the HTTP client.
+type Config struct {
+	URL            string            `name:"url" description:"endpoint to write to, like 'http://localhost:8086/api/v2/write?org=test&bucket=test' or 'http://localhost:9090/api/v1/write'"`
+	Protocol       string            `name:"protocol" description:"protocol of the endpoint. Supported values are 'line-protocol' (default) and 'remote-write'"`
+	Headers        map[string]string `name:"headers" description:"headers of the requests, like 'Authorization: Token <token>' for InfluxDB v2"`
+	Username       string            `name:"username" description:"username for basic authentication"`
+	Password       string            `name:"password" description:"password for basic authentication"`
+	Gzip           bool              `name:"gzip" description:"compress line protocol with gzip. Remote write is always compressed with snappy"`
+	BatchSize      int               `name:"batch-size" description:"number of entries that are written at once (default 1000)"`
+	FlushInterval  time.Duration     `name:"flush-interval" description:"maximum time before queued entries are written (default 1s)"`
+	Timeout        time.Duration     `name:"timeout" description:"timeout of a request (default 10s)"`
+	MaxRetries     int               `name:"max-retries" description:"number of retries of a failed batch before it is dropped (default 5)"`
+	InitialBackoff time.Duration     `name:"initial-backoff" description:"backoff after the first failed request of a batch (default 1s)"`
+	MaxBackoff     time.Duration     `name:"max-backoff" description:"maximum backoff between retries (default 30s)"`
+}
+
+// encoder encodes a batch of entries as the body of a request.
+type encoder interface {
+	encode(entries []entry.Entry) ([]byte, error)
+	headers(h http.Header)
+}
+
+// Client writes entries to an HTTP endpoint in batches.
+type Client struct {
+	cfg     Config
+	enc     encoder
+	http    *http.Client
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	flushCh chan struct{}
+
+	mu      sync.Mutex
+	pending []entry.Entry
+	lastErr error
+}
+
+// NewClient returns a new client and starts writing batches.
+// Use Close() to close the client after done.
+func (c Config) NewClient(ctx context.Context) (*Client, error) {
+	if c.Protocol == "" {
+		c.Protocol = ProtocolLineProtocol
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = DefaultBatchSize
+	}
+	if c.FlushInterval == 0 {
+		c.FlushInterval = DefaultFlushInterval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultTimeout
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = DefaultMaxRetries
+	}
+	if c.InitialBackoff == 0 {
+		c.InitialBackoff = DefaultInitialBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = DefaultMaxBackoff
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid url '%s'", c.URL)
+	}
+	if c.BatchSize < 0 {
+		return nil, fmt.Errorf("invalid batch size '%d'", c.BatchSize)
+	}
+	var enc encoder
+	switch c.Protocol {
+	case ProtocolLineProtocol:
+		enc = lineProtocol{gzip: c.Gzip}
+	case ProtocolRemoteWrite:
+		enc = remoteWrite{}
+	default:
+		return nil, fmt.Errorf("invalid protocol '%s'. Supported values are '%s' and '%s'", c.Protocol, ProtocolLineProtocol, ProtocolRemoteWrite)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	cl := &Client{
+		cfg:     c,
+		enc:     enc,
+		http:    &http.Client{Timeout: c.Timeout},
+		cancel:  cancel,
+		flushCh: make(chan struct{}, 1),
+	}
+	cl.wg.Add(1)
+	go func() {
+		defer cl.wg.Done()
+		cl.run(ctx)
+	}()
+	return cl, nil
+}
+
+// Close writes the queued entries without retries and closes the client.
+func (c *Client) Close(ctx context.Context) {
+	c.cancel()
+	c.wg.Wait()
+	c.flush(ctx, 0)
+}
+
+// Ping implements Database.
+// The endpoints don't have a common health check, so this returns the error of the last batch.
+func (c *Client) Ping(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastErr
+}
+
+// Query implements Database.
+// Queries are not supported. Query the database behind the endpoint instead.
+func (c *Client) Query(ctx context.Context, query string) (map[time.Time]any, error) {
+	return nil, errors.New("queries are not supported by the http database")
+}
+
+// Select implements Database.
+// Queries are not supported. Query the database behind the endpoint instead.
+func (c *Client) Select(ctx context.Context, q query.Query) ([]query.Series, error) {
+	return nil, errors.New("queries are not supported by the http database")
+}
+
+// Measurements implements Database.
+// Queries are not supported.
+func (c *Client) Measurements(ctx context.Context) ([]string, error) {
+	return nil, errors.New("queries are not supported by the http database")
+}
+
+// Record implements Database.
+// The entry is queued and written in a batch.
+// Entries without time are recorded at the current time.
+// It returns an error if too many entries are queued because requests fail.
+func (c *Client) Record(ctx context.Context, e entry.Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) >= maxPendingBatches*c.cfg.BatchSize {
+		return fmt.Errorf("too many queued entries (%d)", len(c.pending))
+	}
+	c.pending = append(c.pending, e)
+	if len(c.pending) >= c.cfg.BatchSize {
+		select {
+		case c.flushCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// run writes the queued entries every flush interval, or when a batch is full, until the context is done.
+func (c *Client) run(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.flushCh:
+		}
+		c.flush(ctx, c.cfg.MaxRetries)
+	}
+}
+
+// flush writes the queued entries in batches. Batches that fail after the retries are dropped.
+func (c *Client) flush(ctx context.Context, retries int) {
+	logger := logger.LoggerFromContext(ctx).WithField("url", c.cfg.URL)
+	for {
+		c.mu.Lock()
+		n := len(c.pending)
+		if n > c.cfg.BatchSize {
+			n = c.cfg.BatchSize
+		}
+		batch := c.pending[:n:n]
+		c.pending = c.pending[n:]
+		c.mu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		err := c.send(ctx, batch, retries)
+		if err != nil && ctx.Err() != nil {
+			// Keep the batch to write it on Close.
+			c.mu.Lock()
+			c.pending = append(batch, c.pending...)
+			c.mu.Unlock()
+			return
+		}
+		if err != nil {
+			logger.WithError(err).WithField("count", len(batch)).Error("Failed to write entries, drop batch")
+		}
+		c.mu.Lock()
+		c.lastErr = err
+		c.mu.Unlock()
+	}
+}
+
+// send sends a batch and retries with exponential backoff if the request fails.
+// Requests are not retried if the endpoint rejects the batch.
+func (c *Client) send(ctx context.Context, batch []entry.Entry, retries int) error {
+	body, err := c.enc.encode(batch)
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		return nil
+	}
+	backoff := c.cfg.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.post(ctx, body, len(batch))
+		var statusErr *statusError
+		if err == nil || (errors.As(err, &statusErr) && !statusErr.retryable()) || attempt >= retries {
+			return err
+		}
+		logger.LoggerFromContext(ctx).WithError(err).WithField("backoff", backoff).Warn("Failed to write entries, retry")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > c.cfg.MaxBackoff {
+			backoff = c.cfg.MaxBackoff
+		}
+	}
+}
+
+// post posts the body to the endpoint.
+func (c *Client) post(ctx context.Context, body []byte, count int) (err error) {
+	start := time.Now()
+	defer func() {
+		metrics.DatabaseWriteDuration.WithLabelValues(databaseLabel).Observe(time.Since(start).Seconds())
+		metrics.DatabaseWriteBatchSize.WithLabelValues(databaseLabel).Observe(float64(count))
+		if err != nil {
+			metrics.DatabaseWriteErrors.WithLabelValues(databaseLabel).Inc()
+		}
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	c.enc.headers(req.Header)
+	for key, value := range c.cfg.Headers {
+		req.Header.Set(key, value)
+	}
+	if c.cfg.Username != "" {
+		req.SetBasicAuth(c.cfg.Username, c.cfg.Password)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+	return &statusError{
+		code:    res.StatusCode,
+		message: string(bytes.TrimSpace(msg)),
+	}
+}
+
+// statusError is an error response of the endpoint.
+type statusError struct {
+	code    int
+	message string
+}
+
+// Error implements error.
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.code, e.message)
+}
+
+// retryable returns true if the request can succeed later.
+func (e *statusError) retryable() bool {
+	return e.code >= 500 || e.code == http.StatusTooManyRequests
+}
@@ -0,0 +1,326 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+)
+
+var testTime = time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC)
+
+func TestLineProtocol(t *testing.T) {
+	body, err := lineProtocol{}.encode([]entry.Entry{
+		{
+			Measurement: "smart meter",
+			Tags:        map[string]string{"id": "meter-1\nclimate temperature=100 0", "location": "home, attic", "empty": ""},
+			Fields: map[string]any{
+				"electricity_delivered_1":  1234.5,
+				"electricity_tariff":       2,
+				"electricity_equipment_id": `E"0001\`,
+				"valve":                    true,
+				"invalid":                  math.NaN(),
+				"power_failures":           uint64(3),
+				"energy":                   uint64(math.MaxUint64),
+			},
+			Time: testTime,
+		},
+		{
+			Measurement: "climate",
+			Fields:      map[string]any{"unsupported": []int{1}},
+			Time:        testTime,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `smart\ meter,id=meter-1\ climate\ temperature\=100\ 0,location=home\,\ attic electricity_delivered_1=1234.5,electricity_equipment_id="E\"0001\\",electricity_tariff=2i,energy=18446744073709551615u,power_failures=3i,valve=true 1669852800000000000` + "\n"
+	if string(body) != expected {
+		t.Fatalf("expected %q, got %q", expected, body)
+	}
+}
+
+// request is a request received by the test server.
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// testServer responds with the status codes in order and with 204 after.
+type testServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	codes    []int
+	requests []request
+}
+
+func newTestServer(codes ...int) *testServer {
+	s := &testServer{codes: codes}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, request{header: r.Header, body: body})
+		code := http.StatusNoContent
+		if len(s.codes) > 0 {
+			code, s.codes = s.codes[0], s.codes[1:]
+		}
+		w.WriteHeader(code)
+	}))
+	return s
+}
+
+func (s *testServer) received() []request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]request(nil), s.requests...)
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		Name     string
+		Codes    []int
+		Requests int
+		Err      bool
+	}{
+		{Name: "Success", Requests: 1},
+		{Name: "Retry", Codes: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, Requests: 3},
+		{Name: "RetriesExceeded", Codes: []int{500, 500, 500, 500}, Requests: 3, Err: true},
+		{Name: "Rejected", Codes: []int{http.StatusBadRequest}, Requests: 1, Err: true},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			srv := newTestServer(tc.Codes...)
+			defer srv.Close()
+			cl, err := Config{
+				URL:            srv.URL + "/api/v2/write?org=test&bucket=test",
+				Headers:        map[string]string{"Authorization": "Token secret"},
+				Gzip:           true,
+				BatchSize:      2,
+				FlushInterval:  time.Hour,
+				MaxRetries:     2,
+				InitialBackoff: time.Millisecond,
+			}.NewClient(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cl.Close(ctx)
+
+			for i := 0; i < 2; i++ {
+				if err := cl.Record(ctx, entry.Entry{
+					Measurement: "smartmeter",
+					Fields:      map[string]any{"electricity_tariff": i},
+					Time:        testTime.Add(time.Duration(i) * time.Second),
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The full batch is written without waiting for the flush interval.
+			deadline := time.Now().Add(5 * time.Second)
+			for len(srv.received()) < tc.Requests || (tc.Err && cl.Ping(ctx) == nil) {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected %d requests, got %d", tc.Requests, len(srv.received()))
+				}
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(10 * time.Millisecond)
+			requests := srv.received()
+			if len(requests) != tc.Requests {
+				t.Fatalf("expected %d requests, got %d", tc.Requests, len(requests))
+			}
+			if err := cl.Ping(ctx); (err != nil) != tc.Err {
+				t.Fatalf("expected error %v, got %v", tc.Err, err)
+			}
+
+			req := requests[len(requests)-1]
+			if h := req.header.Get("Authorization"); h != "Token secret" {
+				t.Fatalf("unexpected authorization header %q", h)
+			}
+			if h := req.header.Get("Content-Encoding"); h != "gzip" {
+				t.Fatalf("unexpected content encoding %q", h)
+			}
+			r, err := gzip.NewReader(bytes.NewReader(req.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := "smartmeter electricity_tariff=0i 1669852800000000000\nsmartmeter electricity_tariff=1i 1669852801000000000\n"
+			if string(body) != expected {
+				t.Fatalf("expected %q, got %q", expected, body)
+			}
+		})
+	}
+}
+
+func TestRemoteWrite(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer()
+	defer srv.Close()
+	cl, err := Config{
+		URL:           srv.URL + "/api/v1/write",
+		Protocol:      ProtocolRemoteWrite,
+		Username:      "user",
+		Password:      "secret",
+		FlushInterval: time.Hour,
+	}.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := cl.Record(ctx, entry.Entry{
+			Measurement: "smartmeter",
+			Tags:        map[string]string{"id": "meter-1"},
+			Fields: map[string]any{
+				"electricity_delivered_1":  1234.5 + float64(i),
+				"electricity_equipment_id": "E0001",
+			},
+			Time: testTime.Add(time.Duration(i) * time.Second),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Close writes the queued entries.
+	cl.Close(ctx)
+
+	requests := srv.received()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(requests))
+	}
+	req := requests[0]
+	if user, password, ok := (&http.Request{Header: req.header}).BasicAuth(); !ok || user != "user" || password != "secret" {
+		t.Fatal("expected basic authentication")
+	}
+	if h := req.header.Get("Content-Encoding"); h != "snappy" {
+		t.Fatalf("unexpected content encoding %q", h)
+	}
+	body, err := snappy.Decode(nil, req.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	series, err := unmarshalWriteRequest(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []timeSeries{
+		{
+			labels: []label{{"__name__", "smartmeter_electricity_delivered_1"}, {"id", "meter-1"}},
+			samples: []sample{
+				{1234.5, testTime.UnixMilli()},
+				{1235.5, testTime.Add(time.Second).UnixMilli()},
+			},
+		},
+	}
+	if !reflect.DeepEqual(series, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, series)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	ctx := context.Background()
+	for _, c := range []Config{
+		{URL: "localhost:8086"},
+		{URL: "http://localhost:8086/write", Protocol: "graphite"},
+		{URL: "http://localhost:8086/write", BatchSize: -1},
+	} {
+		if _, err := c.NewClient(ctx); err == nil {
+			t.Fatalf("expected error for %+v", c)
+		}
+	}
+}
+
+// unmarshalWriteRequest decodes the series of a remote write request.
+func unmarshalWriteRequest(b []byte) ([]timeSeries, error) {
+	var series []timeSeries
+	err := consumeMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		v, n := protowire.ConsumeBytes(b)
+		var ts timeSeries
+		err := consumeMessage(v, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+			v, n := protowire.ConsumeBytes(b)
+			var (
+				l label
+				s sample
+			)
+			err := consumeMessage(v, func(fieldNum protowire.Number, typ protowire.Type, b []byte) (int, error) {
+				switch {
+				case num == timeSeriesLabels && fieldNum == labelName:
+					v, n := protowire.ConsumeString(b)
+					l.name = v
+					return n, nil
+				case num == timeSeriesLabels && fieldNum == labelValue:
+					v, n := protowire.ConsumeString(b)
+					l.value = v
+					return n, nil
+				case num == timeSeriesSamples && fieldNum == sampleValue:
+					v, n := protowire.ConsumeFixed64(b)
+					s.value = math.Float64frombits(v)
+					return n, nil
+				case num == timeSeriesSamples && fieldNum == sampleTimestamp:
+					v, n := protowire.ConsumeVarint(b)
+					s.timestamp = int64(v)
+					return n, nil
+				}
+				return protowire.ConsumeFieldValue(fieldNum, typ, b), nil
+			})
+			if num == timeSeriesLabels {
+				ts.labels = append(ts.labels, l)
+			} else {
+				ts.samples = append(ts.samples, s)
+			}
+			return n, err
+		})
+		series = append(series, ts)
+		return n, err
+	})
+	sort.Slice(series, func(i, j int) bool { return series[i].labels[0].value < series[j].labels[0].value })
+	return series, err
+}
+
+// consumeMessage calls f with the fields of the message. f returns the length of the value.
+func consumeMessage(b []byte, f func(protowire.Number, protowire.Type, []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, err := f(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/exporter"
+)
+
+// Field numbers of the remote write protobuf messages.
+const (
+	writeRequestTimeseries = 1
+	timeSeriesLabels       = 1
+	timeSeriesSamples      = 2
+	labelName              = 1
+	labelValue             = 2
+	sampleValue            = 1
+	sampleTimestamp        = 2
+)
+
+type label struct {
+	name, value string
+}
+
+type sample struct {
+	value     float64
+	timestamp int64
+}
+
+type timeSeries struct {
+	labels  []label
+	samples []sample
+}
+
+// remoteWrite encodes entries as a snappy compressed Prometheus remote write request.
+// Every numeric field is a series named <measurement>_<field> with the tags as labels.
+type remoteWrite struct{}
+
+// encode implements encoder.
+// Fields that are not numeric or boolean are skipped. It returns nil if no entry has such fields.
+func (remoteWrite) encode(entries []entry.Entry) ([]byte, error) {
+	series := make(map[string]*timeSeries)
+	var keys []string
+	for _, e := range entries {
+		tags := make([]label, 0, len(e.Tags))
+		for key, value := range e.Tags {
+			if value != "" {
+				tags = append(tags, label{exporter.LabelName(key), value})
+			}
+		}
+		for field, value := range e.Fields {
+			v, ok := exporter.Value(value)
+			if !ok {
+				continue
+			}
+			labels := append([]label{{"__name__", exporter.MetricName("", e.Measurement, field)}}, tags...)
+			sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+			key := seriesKey(labels)
+			ts, ok := series[key]
+			if !ok {
+				ts = &timeSeries{labels: labels}
+				series[key] = ts
+				keys = append(keys, key)
+			}
+			ts.samples = append(ts.samples, sample{v, e.Time.UnixMilli()})
+		}
+	}
+	if len(series) == 0 {
+		return nil, nil
+	}
+	var b []byte
+	for _, key := range keys {
+		ts := series[key]
+		sort.SliceStable(ts.samples, func(i, j int) bool { return ts.samples[i].timestamp < ts.samples[j].timestamp })
+		b = protowire.AppendTag(b, writeRequestTimeseries, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts.marshal())
+	}
+	return snappy.Encode(nil, b), nil
+}
+
+// headers implements encoder.
+func (remoteWrite) headers(h http.Header) {
+	h.Set("Content-Type", "application/x-protobuf")
+	h.Set("Content-Encoding", "snappy")
+	h.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+}
+
+// marshal returns the protobuf encoding of the series.
+func (ts *timeSeries) marshal() []byte {
+	var b []byte
+	for _, l := range ts.labels {
+		var lb []byte
+		lb = protowire.AppendTag(lb, labelName, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.name)
+		lb = protowire.AppendTag(lb, labelValue, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.value)
+		b = protowire.AppendTag(b, timeSeriesLabels, protowire.BytesType)
+		b = protowire.AppendBytes(b, lb)
+	}
+	for _, s := range ts.samples {
+		var sb []byte
+		sb = protowire.AppendTag(sb, sampleValue, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.value))
+		sb = protowire.AppendTag(sb, sampleTimestamp, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.timestamp))
+		b = protowire.AppendTag(b, timeSeriesSamples, protowire.BytesType)
+		b = protowire.AppendBytes(b, sb)
+	}
+	return b
+}
+
+// seriesKey returns the key of a series with the sorted labels.
+func seriesKey(labels []label) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l.name)
+		b.WriteByte(0)
+		b.WriteString(l.value)
+		b.WriteByte(0)
+	}
+	return b.String()
+}
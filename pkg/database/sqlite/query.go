@@ -0,0 +1,139 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+)
+
+// Query selects entries of a measurement in a time range.
+type Query struct {
+	Measurement string
+	// Field is the field to select. If empty, all fields are selected.
+	Field string
+	// Start is the inclusive start of the time range. If zero, the range has no start.
+	Start time.Time
+	// Stop is the exclusive end of the time range. If zero, the range has no end.
+	Stop time.Time
+	// Tags are the tag values that entries must have.
+	Tags map[string]string
+}
+
+// ParseQuery parses a query of space separated key=value terms:
+//
+//	measurement=<name>   the measurement (required)
+//	field=<name>         the field to select
+//	start=<time>         the inclusive start of the time range
+//	stop=<time>          the exclusive end of the time range
+//	tag.<key>=<value>    the value of a tag
+//
+// Times are RFC3339, 'now' or a duration relative to now, like '-24h'.
+// For example: measurement=smartmeter field=electricity_delivered_1 start=-24h tag.id=meter-1
+func ParseQuery(s string) (*Query, error) {
+	now := time.Now()
+	q := &Query{
+		Tags: make(map[string]string),
+	}
+	for _, term := range strings.Fields(s) {
+		key, value, ok := strings.Cut(term, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid query term '%s'", term)
+		}
+		var err error
+		switch key {
+		case "measurement":
+			q.Measurement = value
+		case "field":
+			q.Field = value
+		case "start":
+			q.Start, err = query.ParseTime(value, now)
+		case "stop":
+			q.Stop, err = query.ParseTime(value, now)
+		default:
+			tag := strings.TrimPrefix(key, "tag.")
+			if tag == key || tag == "" {
+				return nil, fmt.Errorf("invalid query key '%s'. Supported keys are 'measurement', 'field', 'start', 'stop' and 'tag.<key>'", key)
+			}
+			q.Tags[tag] = value
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if q.Measurement == "" {
+		return nil, fmt.Errorf("invalid query '%s': missing measurement", s)
+	}
+	if !q.Start.IsZero() && !q.Stop.IsZero() && !q.Start.Before(q.Stop) {
+		return nil, fmt.Errorf("invalid query '%s': start must be before stop", s)
+	}
+	return q, nil
+}
+
+// sql returns the statement and the arguments that select the id, the time, the key and the value of the fields.
+func (q *Query) sql() (string, []any) {
+	var (
+		b    strings.Builder
+		args = []any{q.Measurement}
+	)
+	b.WriteString(`SELECT e.id, e.time, f.key, f.value FROM entries e JOIN fields f ON f.entry_id = e.id WHERE e.measurement = ?`)
+	if q.Field != "" {
+		b.WriteString(` AND f.key = ?`)
+		args = append(args, q.Field)
+	}
+	if !q.Start.IsZero() {
+		b.WriteString(` AND e.time >= ?`)
+		args = append(args, q.Start.UnixNano())
+	}
+	if !q.Stop.IsZero() {
+		b.WriteString(` AND e.time < ?`)
+		args = append(args, q.Stop.UnixNano())
+	}
+	args = writeTagFilter(&b, args, q.Tags)
+	b.WriteString(` ORDER BY e.time, e.id`)
+	return b.String(), args
+}
+
+// selectSQL returns the statement and the arguments that select the time, the key and the value of the fields and the tags as JSON object of a normalized query.
+func selectSQL(q query.Query) (string, []any) {
+	var (
+		b    strings.Builder
+		args = []any{q.Measurement, q.Start.UnixNano(), q.Stop.UnixNano()}
+	)
+	b.WriteString(`SELECT e.time, f.key, f.value, (SELECT json_group_object(t.key, t.value) FROM tags t WHERE t.entry_id = e.id) FROM entries e JOIN fields f ON f.entry_id = e.id WHERE e.measurement = ? AND e.time >= ? AND e.time < ?`)
+	if len(q.Fields) > 0 {
+		b.WriteString(` AND f.key IN (?` + strings.Repeat(`, ?`, len(q.Fields)-1) + `)`)
+		for _, field := range q.Fields {
+			args = append(args, field)
+		}
+	}
+	args = writeTagFilter(&b, args, q.Tags)
+	b.WriteString(` ORDER BY e.time, e.id`)
+	return b.String(), args
+}
+
+// writeTagFilter writes the conditions that entries have the tag values and returns the arguments.
+func writeTagFilter(b *strings.Builder, args []any, tags map[string]string) []any {
+	// Sort the tags for a stable statement.
+	for _, tag := range entry.SortedKeys(tags) {
+		b.WriteString(` AND EXISTS (SELECT 1 FROM tags t WHERE t.entry_id = e.id AND t.key = ? AND t.value = ?)`)
+		args = append(args, tag, tags[tag])
+	}
+	return args
+}
@@ -0,0 +1,364 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sqlite stores entries in a SQLite database file.
+// This is meant for small installations that don't need a database server.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+	"krishnaiyer.dev/golang/datasink/pkg/metrics"
+	"krishnaiyer.dev/golang/dry/pkg/logger"
+	_ "modernc.org/sqlite" // Register the sqlite driver.
+)
+
+const (
+	// DefaultPath is the default path of the database file.
+	DefaultPath = "datasink.db"
+	// DefaultPruneInterval is the default interval between removing entries older than the retention period.
+	DefaultPruneInterval = time.Hour
+	// DefaultBusyTimeout is the default time to wait for a lock on the database file.
+	DefaultBusyTimeout = 5 * time.Second
+
+	databaseLabel = "sqlite"
+)
+
+// schema is the normalized schema of the entries. Times are in Unix nanoseconds.
+// The values of fields have no type affinity so that integers, floats and strings are returned as they are recorded.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS entries (
+		id INTEGER PRIMARY KEY,
+		measurement TEXT NOT NULL,
+		time INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS entries_measurement_time ON entries (measurement, time)`,
+	`CREATE INDEX IF NOT EXISTS entries_time ON entries (time)`,
+	`CREATE TABLE IF NOT EXISTS tags (
+		entry_id INTEGER NOT NULL REFERENCES entries (id) ON DELETE CASCADE,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (entry_id, key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS fields (
+		entry_id INTEGER NOT NULL REFERENCES entries (id) ON DELETE CASCADE,
+		key TEXT NOT NULL,
+		value,
+		PRIMARY KEY (entry_id, key)
+	)`,
+}
+
+// Config configures the SQLite database.
+type Config struct {
+	Path          string        `name:"path" description:"path of the database file (default 'datasink.db')"`
+	Retention     time.Duration `name:"retention" description:"entries older than this are removed. Leave empty to keep all entries"`
+	PruneInterval time.Duration `name:"prune-interval" description:"interval between removing entries older than the retention period (default 1h)"`
+	BusyTimeout   time.Duration `name:"busy-timeout" description:"time to wait for a lock on the database file (default 5s)"`
+}
+
+// Client is a SQLite client.
+type Client struct {
+	cfg    Config
+	db     *sql.DB
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// open opens the database file.
+func (c *Config) open() (*sql.DB, error) {
+	if c.Path == "" {
+		c.Path = DefaultPath
+	}
+	if c.BusyTimeout == 0 {
+		c.BusyTimeout = DefaultBusyTimeout
+	}
+	params := url.Values{
+		"_pragma": []string{
+			"foreign_keys(1)",
+			"journal_mode(WAL)",
+			fmt.Sprintf("busy_timeout(%d)", c.BusyTimeout.Milliseconds()),
+		},
+	}
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?%s", c.Path, params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer. A single connection avoids busy errors between writes.
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// Setup creates the database file and the schema.
+// Setting up an existing database doesn't change the entries.
+func (c Config) Setup(ctx context.Context) error {
+	db, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, stmt := range schema {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("create schema: %w", err)
+		}
+	}
+	return nil
+}
+
+// NewClient opens the database and starts removing entries older than the retention period.
+// The database must be set up.
+// Use Close() to close the client after done.
+func (c Config) NewClient(ctx context.Context) (*Client, error) {
+	if c.Retention < 0 {
+		return nil, fmt.Errorf("invalid retention '%s'", c.Retention)
+	}
+	if c.PruneInterval == 0 {
+		c.PruneInterval = DefaultPruneInterval
+	}
+	db, err := c.open()
+	if err != nil {
+		return nil, err
+	}
+	cl := &Client{
+		cfg: c,
+		db:  db,
+	}
+	if err := cl.Ping(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if c.Retention > 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		cl.cancel = cancel
+		cl.wg.Add(1)
+		go func() {
+			defer cl.wg.Done()
+			cl.prune(ctx)
+		}()
+	}
+	return cl, nil
+}
+
+// Close closes the client.
+func (c *Client) Close(ctx context.Context) {
+	if c.cancel != nil {
+		c.cancel()
+		c.wg.Wait()
+	}
+	c.db.Close()
+}
+
+// Ping implements Database.
+// It returns an error if the schema doesn't exist.
+func (c *Client) Ping(ctx context.Context) error {
+	var name string
+	err := c.db.QueryRowContext(ctx, `SELECT name FROM sqlite_master WHERE type = 'table' AND name = 'entries'`).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("database '%s' is not set up. Run the init-db command first", c.cfg.Path)
+	}
+	return err
+}
+
+// Record implements Database.
+// The entry, its tags and its fields are written in a single transaction.
+// Entries without time are recorded at the current time.
+func (c *Client) Record(ctx context.Context, e entry.Entry) (err error) {
+	start := time.Now()
+	defer func() {
+		metrics.DatabaseWriteDuration.WithLabelValues(databaseLabel).Observe(time.Since(start).Seconds())
+		metrics.DatabaseWriteBatchSize.WithLabelValues(databaseLabel).Observe(1)
+		if err != nil {
+			metrics.DatabaseWriteErrors.WithLabelValues(databaseLabel).Inc()
+		}
+	}()
+	if e.Time.IsZero() {
+		e.Time = start
+	}
+	for key, value := range e.Fields {
+		if _, err := driver.DefaultParameterConverter.ConvertValue(value); err != nil {
+			return entry.Reject(fmt.Errorf("invalid value of field '%s': %w", key, err))
+		}
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `INSERT INTO entries (measurement, time) VALUES (?, ?)`, e.Measurement, e.Time.UnixNano())
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for key, value := range e.Tags {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO tags (entry_id, key, value) VALUES (?, ?, ?)`, id, key, value); err != nil {
+			return err
+		}
+	}
+	for key, value := range e.Fields {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO fields (entry_id, key, value) VALUES (?, ?, ?)`, id, key, value); err != nil {
+			return fmt.Errorf("invalid value of field '%s': %w", key, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Query implements Database.
+// See ParseQuery for the syntax of the query.
+// If a field is selected, the values are the values of the field. Otherwise, the values are the fields by name.
+// Booleans are returned as 0 and 1. If multiple entries have the same time, the last one is returned.
+func (c *Client) Query(ctx context.Context, query string) (map[time.Time]any, error) {
+	q, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	logger.LoggerFromContext(ctx).WithField("query", query).Debug("Run query")
+
+	stmt, args := q.sql()
+	rows, err := c.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make(map[time.Time]any)
+	entries := make(map[int64]map[string]any)
+	for rows.Next() {
+		var (
+			id    int64
+			ts    int64
+			key   string
+			value any
+		)
+		if err := rows.Scan(&id, &ts, &key, &value); err != nil {
+			return nil, err
+		}
+		t := time.Unix(0, ts).UTC()
+		if q.Field != "" {
+			ret[t] = value
+			continue
+		}
+		fields, ok := entries[id]
+		if !ok {
+			fields = make(map[string]any)
+			entries[id] = fields
+			ret[t] = fields
+		}
+		fields[key] = value
+	}
+	return ret, rows.Err()
+}
+
+// Select implements Database.
+// The entries are selected with SQL. Values are aggregated after they are selected.
+// Booleans are returned as 0 and 1.
+func (c *Client) Select(ctx context.Context, q query.Query) ([]query.Series, error) {
+	q, err := q.Normalize(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	stmt, args := selectSQL(q)
+	logger.LoggerFromContext(ctx).WithField("query", stmt).Debug("Run query")
+	rows, err := c.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collector := query.NewCollector()
+	for rows.Next() {
+		var (
+			ts    int64
+			key   string
+			value any
+			tags  sql.NullString
+		)
+		if err := rows.Scan(&ts, &key, &value, &tags); err != nil {
+			return nil, err
+		}
+		var tagValues map[string]string
+		if tags.Valid {
+			if err := json.Unmarshal([]byte(tags.String), &tagValues); err != nil {
+				return nil, err
+			}
+		}
+		collector.Add(q.Measurement, key, tagValues, time.Unix(0, ts).UTC(), value)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	series := collector.Series()
+	if q.Window > 0 {
+		series = query.Aggregate(series, q.Window, q.Aggregate)
+	}
+	return series, nil
+}
+
+// Measurements implements Database.
+func (c *Client) Measurements(ctx context.Context) ([]string, error) {
+	rows, err := c.db.QueryContext(ctx, `SELECT DISTINCT measurement FROM entries ORDER BY measurement`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	measurements := []string{}
+	for rows.Next() {
+		var measurement string
+		if err := rows.Scan(&measurement); err != nil {
+			return nil, err
+		}
+		measurements = append(measurements, measurement)
+	}
+	return measurements, rows.Err()
+}
+
+// prune removes entries older than the retention period until the context is done.
+func (c *Client) prune(ctx context.Context) {
+	logger := logger.LoggerFromContext(ctx).WithField("retention", c.cfg.Retention)
+	ticker := time.NewTicker(c.cfg.PruneInterval)
+	defer ticker.Stop()
+	for {
+		n, err := c.Prune(ctx, time.Now().Add(-c.cfg.Retention))
+		if err != nil && ctx.Err() == nil {
+			logger.WithError(err).Warn("Failed to remove old entries")
+		} else if n > 0 {
+			logger.WithField("count", n).Debug("Removed old entries")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Prune removes the entries before the given time and returns the number of removed entries.
+func (c *Client) Prune(ctx context.Context, before time.Time) (int64, error) {
+	res, err := c.db.ExecContext(ctx, `DELETE FROM entries WHERE time < ?`, before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
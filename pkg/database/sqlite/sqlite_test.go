@@ -0,0 +1,302 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+)
+
+func TestParseQuery(t *testing.T) {
+	for _, tc := range []struct {
+		Name     string
+		Query    string
+		Expected *Query
+	}{
+		{
+			Name:  "Measurement",
+			Query: "measurement=smartmeter",
+			Expected: &Query{
+				Measurement: "smartmeter",
+				Tags:        map[string]string{},
+			},
+		},
+		{
+			Name:  "All",
+			Query: "measurement=smartmeter field=gas_delivered start=2022-12-01T00:00:00Z stop=2022-12-02T00:00:00Z tag.id=meter-1",
+			Expected: &Query{
+				Measurement: "smartmeter",
+				Field:       "gas_delivered",
+				Start:       time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC),
+				Stop:        time.Date(2022, 12, 2, 0, 0, 0, 0, time.UTC),
+				Tags:        map[string]string{"id": "meter-1"},
+			},
+		},
+		{Name: "MissingMeasurement", Query: "field=gas_delivered"},
+		{Name: "InvalidTerm", Query: "measurement=smartmeter field"},
+		{Name: "InvalidKey", Query: "measurement=smartmeter bucket=test"},
+		{Name: "InvalidTime", Query: "measurement=smartmeter start=yesterday"},
+		{Name: "InvalidRange", Query: "measurement=smartmeter start=-1h stop=-2h"},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			q, err := ParseQuery(tc.Query)
+			if tc.Expected == nil {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(q, tc.Expected) {
+				t.Fatalf("expected %+v, got %+v", tc.Expected, q)
+			}
+		})
+	}
+
+	q, err := ParseQuery("measurement=smartmeter start=-1h stop=now")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := q.Stop.Sub(q.Start); d != time.Hour {
+		t.Fatalf("expected range of 1h, got %s", d)
+	}
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{
+		Path: filepath.Join(t.TempDir(), "datasink.db"),
+	}
+	if _, err := cfg.NewClient(ctx); err == nil {
+		t.Fatal("expected error for a database that is not set up")
+	}
+	if err := cfg.Setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Setting up again keeps the schema.
+	if err := cfg.Setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cl, err := cfg.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close(ctx)
+
+	start := time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		id := "meter-1"
+		if i%2 == 1 {
+			id = "meter-2"
+		}
+		if err := cl.Record(ctx, entry.Entry{
+			Measurement: "smartmeter",
+			Tags:        map[string]string{"id": id},
+			Fields: map[string]any{
+				"electricity_delivered_1":  float64(i) + 0.5,
+				"electricity_tariff":       i,
+				"electricity_equipment_id": "E0001",
+			},
+			Time: start.Add(time.Duration(i) * time.Hour),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cl.Record(ctx, entry.Entry{
+		Measurement: "climate",
+		Fields:      map[string]any{"temperature": 21.5},
+		Time:        start,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Record(ctx, entry.Entry{
+		Measurement: "climate",
+		Fields:      map[string]any{"counter": uint64(math.MaxUint64)},
+		Time:        start,
+	}); !errors.Is(err, entry.ErrRejected) {
+		t.Fatalf("expected rejected entry, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		Name     string
+		Query    string
+		Expected map[time.Time]any
+	}{
+		{
+			Name:  "Field",
+			Query: "measurement=smartmeter field=electricity_delivered_1",
+			Expected: map[time.Time]any{
+				start:                    0.5,
+				start.Add(time.Hour):     1.5,
+				start.Add(2 * time.Hour): 2.5,
+				start.Add(3 * time.Hour): 3.5,
+			},
+		},
+		{
+			Name:  "Range",
+			Query: "measurement=smartmeter field=electricity_tariff start=2022-12-01T01:00:00Z stop=2022-12-01T03:00:00Z",
+			Expected: map[time.Time]any{
+				start.Add(time.Hour):     int64(1),
+				start.Add(2 * time.Hour): int64(2),
+			},
+		},
+		{
+			Name:  "Tag",
+			Query: "measurement=smartmeter field=electricity_tariff tag.id=meter-2",
+			Expected: map[time.Time]any{
+				start.Add(time.Hour):     int64(1),
+				start.Add(3 * time.Hour): int64(3),
+			},
+		},
+		{
+			Name:  "Fields",
+			Query: "measurement=smartmeter stop=2022-12-01T01:00:00Z",
+			Expected: map[time.Time]any{
+				start: map[string]any{
+					"electricity_delivered_1":  0.5,
+					"electricity_tariff":       int64(0),
+					"electricity_equipment_id": "E0001",
+				},
+			},
+		},
+		{
+			Name:  "Measurement",
+			Query: "measurement=climate",
+			Expected: map[time.Time]any{
+				start: map[string]any{"temperature": 21.5},
+			},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			res, err := cl.Query(ctx, tc.Query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(res, tc.Expected) {
+				t.Fatalf("expected %v, got %v", tc.Expected, res)
+			}
+		})
+	}
+
+	measurements, err := cl.Measurements(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"climate", "smartmeter"}; !reflect.DeepEqual(measurements, expected) {
+		t.Fatalf("expected measurements %v, got %v", expected, measurements)
+	}
+
+	for _, tc := range []struct {
+		Name     string
+		Query    query.Query
+		Expected []query.Series
+	}{
+		{
+			Name: "Series",
+			Query: query.Query{
+				Measurement: "smartmeter",
+				Fields:      []string{"electricity_tariff"},
+				Start:       start,
+				Stop:        start.Add(3 * time.Hour),
+			},
+			Expected: []query.Series{
+				{
+					Measurement: "smartmeter",
+					Field:       "electricity_tariff",
+					Tags:        map[string]string{"id": "meter-1"},
+					Rows:        []query.Row{{Time: start, Value: int64(0)}, {Time: start.Add(2 * time.Hour), Value: int64(2)}},
+				},
+				{
+					Measurement: "smartmeter",
+					Field:       "electricity_tariff",
+					Tags:        map[string]string{"id": "meter-2"},
+					Rows:        []query.Row{{Time: start.Add(time.Hour), Value: int64(1)}},
+				},
+			},
+		},
+		{
+			Name: "Aggregate",
+			Query: query.Query{
+				Measurement: "smartmeter",
+				Fields:      []string{"electricity_delivered_1", "electricity_equipment_id"},
+				Tags:        map[string]string{"id": "meter-2"},
+				Start:       start,
+				Stop:        start.Add(24 * time.Hour),
+				Window:      24 * time.Hour,
+				Aggregate:   query.AggregateSum,
+			},
+			Expected: []query.Series{
+				{
+					Measurement: "smartmeter",
+					Field:       "electricity_delivered_1",
+					Tags:        map[string]string{"id": "meter-2"},
+					Rows:        []query.Row{{Time: start, Value: 5.0}},
+				},
+			},
+		},
+		{
+			Name: "Empty",
+			Query: query.Query{
+				Measurement: "climate",
+				Tags:        map[string]string{"room": "kitchen"},
+				Start:       start,
+			},
+			Expected: []query.Series{},
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			res, err := cl.Select(ctx, tc.Query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(res, tc.Expected) {
+				t.Fatalf("expected %v, got %v", tc.Expected, res)
+			}
+		})
+	}
+
+	n, err := cl.Prune(ctx, start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 removed entries, got %d", n)
+	}
+	res, err := cl.Query(ctx, "measurement=smartmeter field=electricity_tariff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("expected 2 entries after pruning, got %d", len(res))
+	}
+	// The tags and fields of removed entries are removed too.
+	var count int
+	if err := cl.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM fields`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 6 {
+		t.Fatalf("expected 6 fields after pruning, got %d", count)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+)
+
+// Field types.
+// The type is stored with the value since JSON doesn't distinguish between integers and floats.
+const (
+	typeFloat  = "f"
+	typeInt    = "i"
+	typeUint   = "u"
+	typeBool   = "b"
+	typeString = "s"
+)
+
+type field struct {
+	Type  string          `json:"t"`
+	Value json.RawMessage `json:"v"`
+}
+
+type record struct {
+	Measurement string            `json:"m"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Fields      map[string]field  `json:"fields"`
+	Time        time.Time         `json:"time"`
+}
+
+// encode encodes the entry as a single line.
+func encode(e entry.Entry) ([]byte, error) {
+	r := record{
+		Measurement: e.Measurement,
+		Tags:        e.Tags,
+		Fields:      make(map[string]field, len(e.Fields)),
+		Time:        e.Time,
+	}
+	for k, v := range e.Fields {
+		var typ string
+		switch v := v.(type) {
+		case float32, float64:
+			typ = typeFloat
+		case int, int8, int16, int32, int64:
+			typ = typeInt
+		case uint, uint8, uint16, uint32, uint64:
+			typ = typeUint
+		case bool:
+			typ = typeBool
+		case string:
+			typ = typeString
+		default:
+			return nil, fmt.Errorf("unsupported type %T of field %s", v, k)
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		r.Fields[k] = field{Type: typ, Value: b}
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// decode decodes an entry.
+func decode(line []byte) (*entry.Entry, error) {
+	var r record
+	if err := json.Unmarshal(line, &r); err != nil {
+		return nil, err
+	}
+	e := &entry.Entry{
+		Measurement: r.Measurement,
+		Tags:        r.Tags,
+		Fields:      make(map[string]any, len(r.Fields)),
+		Time:        r.Time,
+	}
+	for k, f := range r.Fields {
+		var (
+			v   any
+			err error
+		)
+		switch f.Type {
+		case typeFloat:
+			var x float64
+			err = json.Unmarshal(f.Value, &x)
+			v = x
+		case typeInt:
+			var x int64
+			err = json.Unmarshal(f.Value, &x)
+			v = x
+		case typeUint:
+			var x uint64
+			err = json.Unmarshal(f.Value, &x)
+			v = x
+		case typeBool:
+			var x bool
+			err = json.Unmarshal(f.Value, &x)
+			v = x
+		case typeString:
+			var x string
+			err = json.Unmarshal(f.Value, &x)
+			v = x
+		default:
+			err = fmt.Errorf("unknown type %s", f.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode field %s: %w", k, err)
+		}
+		e.Fields[k] = v
+	}
+	return e, nil
+}
@@ -0,0 +1,501 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wal provides a durable on-disk write-ahead buffer in front of a database.
+// Entries are appended to segment files and replayed to the database in order.
+// If the database is unavailable, the replay is retried with exponential backoff.
+// The position of the replay is stored on disk so that pending entries survive restarts.
+package wal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+	"krishnaiyer.dev/golang/dry/pkg/logger"
+)
+
+const (
+	// DefaultMaxSize is the default maximum size of the buffer.
+	DefaultMaxSize = 64 << 20
+	// DefaultInitialBackoff is the default initial backoff after a failed write.
+	DefaultInitialBackoff = time.Second
+	// DefaultMaxBackoff is the default maximum backoff after failed writes.
+	DefaultMaxBackoff = time.Minute
+
+	maxSegmentSize = 4 << 20
+	segmentPrefix  = "segment-"
+	segmentSuffix  = ".wal"
+	cursorFile     = "cursor"
+	// cursorInterval is the interval at which the cursor is written while replaying.
+	cursorInterval = time.Second
+)
+
+// DropPolicy defines which entries are dropped when the buffer is full.
+type DropPolicy string
+
+const (
+	// DropOldest drops the oldest segment of entries.
+	DropOldest DropPolicy = "oldest"
+	// DropNewest rejects new entries.
+	DropNewest DropPolicy = "newest"
+)
+
+// ErrFull is returned when the buffer is full and new entries are rejected.
+var ErrFull = errors.New("buffer full")
+
+// Config configures the write-ahead buffer.
+type Config struct {
+	Dir            string        `name:"dir" description:"directory of the buffer. Leave empty to write directly to the database"`
+	MaxSize        int64         `name:"max-size" description:"maximum size of the buffer in bytes (default 64MiB)"`
+	DropPolicy     string        `name:"drop-policy" description:"entries to drop when the buffer is full. Supported values are 'oldest' (default) and 'newest'"`
+	Sync           bool          `name:"sync" description:"sync every entry to disk. This survives power loss but is slower"`
+	InitialBackoff time.Duration `name:"initial-backoff" description:"initial backoff after a failed write (default 1s)"`
+	MaxBackoff     time.Duration `name:"max-backoff" description:"maximum backoff after failed writes (default 1m)"`
+}
+
+// Database is the database that the entries are replayed to.
+type Database interface {
+	Record(ctx context.Context, entry entry.Entry) error
+	Query(ctx context.Context, query string) (map[time.Time]any, error)
+	Select(ctx context.Context, q query.Query) ([]query.Series, error)
+	Measurements(ctx context.Context) ([]string, error)
+	Ping(ctx context.Context) error
+	Close(ctx context.Context)
+}
+
+type segment struct {
+	id   uint64
+	size int64
+}
+
+// Buffer is a write-ahead buffer in front of a database.
+// Record returns once the entry is written to disk.
+type Buffer struct {
+	cfg    Config
+	policy DropPolicy
+	db     Database
+
+	mu       sync.Mutex
+	segments []segment // Sorted by ID. The last segment is being written to.
+	size     int64
+	w        *os.File
+	readID   uint64
+	readOff  int64
+	// savedID and savedOff are the cursor that is written to disk.
+	savedID  uint64
+	savedOff int64
+
+	// The reader is only used by the replay loop.
+	r      *bufio.Reader
+	rFile  *os.File
+	rID    uint64
+	rOff   int64
+	notify chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// New opens the buffer in the configured directory and starts replaying entries to the database.
+// Use Close() to stop the replay and close the database.
+func (c Config) New(ctx context.Context, db Database) (*Buffer, error) {
+	if c.MaxSize == 0 {
+		c.MaxSize = DefaultMaxSize
+	}
+	if c.InitialBackoff == 0 {
+		c.InitialBackoff = DefaultInitialBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = DefaultMaxBackoff
+	}
+	b := &Buffer{
+		cfg:    c,
+		policy: DropPolicy(c.DropPolicy),
+		db:     db,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	switch b.policy {
+	case "":
+		b.policy = DropOldest
+	case DropOldest, DropNewest:
+	default:
+		return nil, fmt.Errorf("invalid drop policy '%s'", c.DropPolicy)
+	}
+	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	// Always write to a new segment so that a partially written entry from a crash is not continued.
+	if err := b.rotate(); err != nil {
+		return nil, err
+	}
+
+	ctx, b.cancel = context.WithCancel(ctx)
+	go b.replay(ctx)
+	return b, nil
+}
+
+func segmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%020d%s", segmentPrefix, id, segmentSuffix))
+}
+
+// load reads the existing segments and the cursor.
+func (b *Buffer) load() error {
+	files, err := os.ReadDir(b.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			return err
+		}
+		b.segments = append(b.segments, segment{id: id, size: info.Size()})
+		b.size += info.Size()
+	}
+	sort.Slice(b.segments, func(i, j int) bool { return b.segments[i].id < b.segments[j].id })
+
+	data, err := os.ReadFile(filepath.Join(b.cfg.Dir, cursorFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if _, err := fmt.Sscanf(string(data), "%d %d", &b.readID, &b.readOff); err != nil {
+			return fmt.Errorf("invalid cursor: %w", err)
+		}
+		b.savedID, b.savedOff = b.readID, b.readOff
+	}
+	// Skip to the first existing segment if the cursor points to a deleted one.
+	if len(b.segments) > 0 && b.readID < b.segments[0].id {
+		b.readID, b.readOff = b.segments[0].id, 0
+	}
+	return nil
+}
+
+// rotate starts a new segment. The caller must hold the lock.
+func (b *Buffer) rotate() error {
+	var id uint64 = 1
+	if n := len(b.segments); n > 0 {
+		id = b.segments[n-1].id + 1
+	}
+	f, err := os.OpenFile(segmentPath(b.cfg.Dir, id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if b.w != nil {
+		b.w.Close()
+	}
+	b.w = f
+	b.segments = append(b.segments, segment{id: id})
+	if len(b.segments) == 1 {
+		b.readID, b.readOff = id, 0
+	}
+	return nil
+}
+
+// dropOldest removes the oldest segment. The caller must hold the lock.
+func (b *Buffer) dropOldest() error {
+	if len(b.segments) == 1 {
+		// Only the active segment is left. Start a new one so the old one can be dropped.
+		if err := b.rotate(); err != nil {
+			return err
+		}
+	}
+	oldest := b.segments[0]
+	if err := os.Remove(segmentPath(b.cfg.Dir, oldest.id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	b.segments = b.segments[1:]
+	b.size -= oldest.size
+	if b.readID <= oldest.id {
+		b.readID, b.readOff = b.segments[0].id, 0
+	}
+	return nil
+}
+
+// Record implements database.Database.
+// The entry is written to disk and replayed to the database in the background.
+// Entries without a time are recorded at the current time so that replayed entries are not recorded at the replay time.
+func (b *Buffer) Record(ctx context.Context, e entry.Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := encode(e)
+	if err != nil {
+		return err
+	}
+	n := int64(len(line))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.cfg.MaxSize {
+		return ErrFull
+	}
+	for b.size+n > b.cfg.MaxSize {
+		if b.policy == DropNewest {
+			return ErrFull
+		}
+		logger.LoggerFromContext(ctx).WithField("segment", b.segments[0].id).Warn("Buffer full, drop oldest entries")
+		if err := b.dropOldest(); err != nil {
+			return err
+		}
+	}
+	active := &b.segments[len(b.segments)-1]
+	if active.size > 0 && active.size+n > b.segmentSize() {
+		if err := b.rotate(); err != nil {
+			return err
+		}
+		active = &b.segments[len(b.segments)-1]
+	}
+	if _, err := b.w.Write(line); err != nil {
+		return err
+	}
+	if b.cfg.Sync {
+		if err := b.w.Sync(); err != nil {
+			return err
+		}
+	}
+	active.size += n
+	b.size += n
+
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (b *Buffer) segmentSize() int64 {
+	if size := b.cfg.MaxSize / 4; size < maxSegmentSize {
+		return size
+	}
+	return maxSegmentSize
+}
+
+// Query implements database.Database.
+func (b *Buffer) Query(ctx context.Context, query string) (map[time.Time]any, error) {
+	return b.db.Query(ctx, query)
+}
+
+// Select implements database.Database.
+// Entries that are still buffered are not selected.
+func (b *Buffer) Select(ctx context.Context, q query.Query) ([]query.Series, error) {
+	return b.db.Select(ctx, q)
+}
+
+// Measurements implements database.Database.
+func (b *Buffer) Measurements(ctx context.Context) ([]string, error) {
+	return b.db.Measurements(ctx)
+}
+
+// Ping implements database.Database.
+// The database is pinged directly since entries are replayed to it eventually.
+func (b *Buffer) Ping(ctx context.Context) error {
+	return b.db.Ping(ctx)
+}
+
+// Close stops the replay and closes the database.
+// Entries that are not replayed yet are replayed when the buffer is opened again.
+func (b *Buffer) Close(ctx context.Context) {
+	b.cancel()
+	<-b.done
+	b.mu.Lock()
+	b.w.Close()
+	b.mu.Unlock()
+	if b.rFile != nil {
+		b.rFile.Close()
+	}
+	b.db.Close(ctx)
+}
+
+// Len returns the size of the entries in the buffer in bytes, including the entries that are replayed already but not cleaned up.
+func (b *Buffer) Len() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// next returns the next entry and its end offset.
+// It returns io.EOF if there are no entries to replay.
+func (b *Buffer) next() (*entry.Entry, uint64, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		if b.rFile == nil || b.rID != b.readID || b.rOff != b.readOff {
+			if b.rFile != nil {
+				b.rFile.Close()
+				b.rFile = nil
+			}
+			f, err := os.Open(segmentPath(b.cfg.Dir, b.readID))
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			if _, err := f.Seek(b.readOff, io.SeekStart); err != nil {
+				f.Close()
+				return nil, 0, 0, err
+			}
+			b.rFile, b.r, b.rID, b.rOff = f, bufio.NewReader(f), b.readID, b.readOff
+		}
+		line, err := b.r.ReadBytes('\n')
+		if err == nil {
+			b.rOff += int64(len(line))
+			e, err := decode(line)
+			if err != nil {
+				// Skip corrupt entries.
+				b.readOff = b.rOff
+				continue
+			}
+			return e, b.rID, b.rOff, nil
+		}
+		if !errors.Is(err, io.EOF) {
+			return nil, 0, 0, err
+		}
+		// Entries may still be appended to the active segment.
+		// Incomplete entries in older segments are left by a crash and are skipped.
+		if b.readID == b.segments[len(b.segments)-1].id {
+			b.rFile.Close()
+			b.rFile = nil
+			return nil, 0, 0, io.EOF
+		}
+		b.rFile.Close()
+		b.rFile = nil
+		if err := b.dropOldest(); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+}
+
+// advance moves the cursor after a replayed entry.
+// The cursor is written to disk by saveCursor.
+func (b *Buffer) advance(id uint64, off int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.readID != id {
+		// The segment was dropped while replaying.
+		return
+	}
+	b.readOff = off
+}
+
+// saveCursor writes the cursor to disk if it moved since it was last written.
+func (b *Buffer) saveCursor() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.readID == b.savedID && b.readOff == b.savedOff {
+		return nil
+	}
+	tmp := filepath.Join(b.cfg.Dir, cursorFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", b.readID, b.readOff)), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(b.cfg.Dir, cursorFile)); err != nil {
+		return err
+	}
+	b.savedID, b.savedOff = b.readID, b.readOff
+	return nil
+}
+
+// replay writes the entries to the database in order until the context is done.
+// Entries that the database rejects for good are logged and skipped. Other errors are retried with backoff.
+// The cursor is written when the replay catches up, at most every second while replaying and when the replay stops.
+func (b *Buffer) replay(ctx context.Context) {
+	defer close(b.done)
+	logger := logger.LoggerFromContext(ctx)
+	var saved time.Time
+	saveCursor := func() {
+		if err := b.saveCursor(); err != nil {
+			logger.WithError(err).Error("Write buffer cursor")
+		}
+		saved = time.Now()
+	}
+	defer saveCursor()
+	backoff := b.cfg.InitialBackoff
+	wait := func(d time.Duration) bool {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		}
+	}
+	for {
+		e, id, off, err := b.next()
+		if errors.Is(err, io.EOF) {
+			saveCursor()
+			select {
+			case <-ctx.Done():
+				return
+			case <-b.notify:
+			}
+			continue
+		}
+		if err != nil {
+			logger.WithError(err).Error("Read buffer")
+			if !wait(backoff) {
+				return
+			}
+			continue
+		}
+		if err := b.db.Record(ctx, *e); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, entry.ErrRejected) {
+				// Retrying a rejected entry would block the entries after it.
+				logger.WithError(err).WithField("measurement", e.Measurement).Error("Database rejected entry, skip")
+				backoff = b.cfg.InitialBackoff
+				b.advance(id, off)
+				continue
+			}
+			logger.WithError(err).WithField("backoff", backoff).Error("Error writing to database, retry")
+			if !wait(backoff) {
+				return
+			}
+			if backoff *= 2; backoff > b.cfg.MaxBackoff {
+				backoff = b.cfg.MaxBackoff
+			}
+			// The cursor is not advanced so the same entry is read again.
+			continue
+		}
+		backoff = b.cfg.InitialBackoff
+		b.advance(id, off)
+		if time.Since(saved) >= cursorInterval {
+			saveCursor()
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+)
+
+type mockDatabase struct {
+	mu      sync.Mutex
+	down    bool
+	reject  func(entry.Entry) bool
+	entries []entry.Entry
+}
+
+func (db *mockDatabase) Record(ctx context.Context, e entry.Entry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.down {
+		return errors.New("connection refused")
+	}
+	if db.reject != nil && db.reject(e) {
+		return entry.Reject(errors.New("field type conflict"))
+	}
+	db.entries = append(db.entries, e)
+	return nil
+}
+
+func (db *mockDatabase) Query(ctx context.Context, query string) (map[time.Time]any, error) {
+	return nil, nil
+}
+
+func (db *mockDatabase) Select(ctx context.Context, q query.Query) ([]query.Series, error) {
+	return nil, nil
+}
+
+func (db *mockDatabase) Measurements(ctx context.Context) ([]string, error) {
+	return nil, nil
+}
+
+func (db *mockDatabase) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (db *mockDatabase) Close(ctx context.Context) {}
+
+func (db *mockDatabase) setDown(down bool) {
+	db.mu.Lock()
+	db.down = down
+	db.mu.Unlock()
+}
+
+func (db *mockDatabase) recorded() []entry.Entry {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]entry.Entry(nil), db.entries...)
+}
+
+func waitForEntries(t *testing.T, db *mockDatabase, n int) []entry.Entry {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if entries := db.recorded(); len(entries) >= n {
+			return entries
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d entries, got %d", n, len(db.recorded()))
+	return nil
+}
+
+func newEntry(i int) entry.Entry {
+	return entry.Entry{
+		Measurement: "test",
+		Tags:        map[string]string{"id": "test"},
+		Fields: map[string]any{
+			"int":    int64(i),
+			"float":  float64(i),
+			"bool":   true,
+			"string": "value",
+		},
+		Time: time.Unix(int64(i), 0).UTC(),
+	}
+}
+
+func TestBufferReplay(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c := Config{
+		Dir:            dir,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     20 * time.Millisecond,
+	}
+	db := &mockDatabase{down: true}
+
+	b, err := c.New(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := b.Record(ctx, newEntry(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(db.recorded()); n != 0 {
+		t.Fatalf("expected no entries while the database is down, got %d", n)
+	}
+
+	// Pending entries survive a restart.
+	b.Close(ctx)
+	b, err = c.New(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close(ctx)
+	for i := 5; i < 10; i++ {
+		if err := b.Record(ctx, newEntry(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db.setDown(false)
+	entries := waitForEntries(t, db, 10)
+	for i, e := range entries {
+		if expected := newEntry(i); !reflect.DeepEqual(e, expected) {
+			t.Fatalf("expected entry %d to be %+v, got %+v", i, expected, e)
+		}
+	}
+}
+
+func TestBufferDropPolicy(t *testing.T) {
+	ctx := context.Background()
+	line, err := encode(newEntry(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(line))
+
+	t.Run("Newest", func(t *testing.T) {
+		db := &mockDatabase{down: true}
+		b, err := Config{
+			Dir:        t.TempDir(),
+			MaxSize:    3 * size,
+			DropPolicy: string(DropNewest),
+		}.New(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close(ctx)
+		for i := 0; i < 3; i++ {
+			if err := b.Record(ctx, newEntry(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Record(ctx, newEntry(3)); !errors.Is(err, ErrFull) {
+			t.Fatalf("expected %v, got %v", ErrFull, err)
+		}
+	})
+
+	t.Run("Oldest", func(t *testing.T) {
+		db := &mockDatabase{down: true}
+		b, err := Config{
+			Dir:            t.TempDir(),
+			MaxSize:        8 * size,
+			InitialBackoff: 10 * time.Millisecond,
+		}.New(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close(ctx)
+		for i := 0; i < 10; i++ {
+			if err := b.Record(ctx, newEntry(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if b.Len() > 8*size {
+			t.Fatalf("expected buffer size at most %d, got %d", 8*size, b.Len())
+		}
+		db.setDown(false)
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			entries := db.recorded()
+			if n := len(entries); n > 0 && entries[n-1].Fields["int"] == int64(9) {
+				if entries[0].Fields["int"] == int64(0) {
+					t.Fatal("expected oldest entries to be dropped")
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("timeout waiting for newest entry")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+}
+
+func TestBufferCursor(t *testing.T) {
+	ctx := context.Background()
+	c := Config{Dir: t.TempDir()}
+	db := &mockDatabase{}
+
+	b, err := c.New(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := b.Record(ctx, newEntry(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForEntries(t, db, 3)
+	b.Close(ctx)
+
+	// Replayed entries are not replayed again after a restart.
+	b, err = c.New(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	b.Close(ctx)
+	if n := len(db.recorded()); n != 3 {
+		t.Fatalf("expected 3 entries, got %d", n)
+	}
+}
+
+func TestBufferRejected(t *testing.T) {
+	ctx := context.Background()
+	db := &mockDatabase{
+		reject: func(e entry.Entry) bool { return e.Fields["int"] == int64(1) },
+	}
+	b, err := Config{Dir: t.TempDir(), InitialBackoff: time.Hour}.New(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close(ctx)
+	for i := 0; i < 3; i++ {
+		if err := b.Record(ctx, newEntry(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The rejected entry is skipped instead of blocking the entries after it.
+	entries := waitForEntries(t, db, 2)
+	if entries[0].Fields["int"] != int64(0) || entries[1].Fields["int"] != int64(2) {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+}
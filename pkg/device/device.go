@@ -20,21 +20,165 @@ import (
 	"fmt"
 
 	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/device/jsondevice"
 	"krishnaiyer.dev/golang/datasink/pkg/device/smartmeter"
+	"krishnaiyer.dev/golang/datasink/pkg/topic"
+)
+
+const (
+	// TypeSmartMeter is the device type of the Smart Gateways smart meter.
+	TypeSmartMeter = "smartmeter"
+	// TypeJSON is the device type of generic JSON devices.
+	TypeJSON = "json"
 )
 
 // Config is the configuration for devices.
+// SmartMeter and JSON are the default settings of each device type.
 type Config struct {
+	SmartMeter smartmeter.Config         `name:"smart-meter" description:"smartmeter configuration"`
+	JSON       jsondevice.Config         `name:"json" description:"generic JSON device configuration"`
+	Instances  map[string]InstanceConfig `name:"instances" description:"named device instances with their own settings"`
+	Routes     []Route                   `name:"routes" description:"ordered topic routes. If empty, devices are selected by their topic prefix"`
+}
+
+// InstanceConfig contains the settings of a device instance.
+// Only the settings of the device type of the route are used.
+type InstanceConfig struct {
 	SmartMeter smartmeter.Config `name:"smart-meter" description:"smartmeter configuration"`
+	JSON       jsondevice.Config `name:"json" description:"generic JSON device configuration"`
+}
+
+// Route routes messages on matching topics to a device.
+type Route struct {
+	Match    string            `name:"match" description:"topic filter"`
+	Device   string            `name:"device" description:"device type. Supported values are 'smartmeter' and 'json'"`
+	Instance string            `name:"instance" description:"device instance. Leave empty to use the default settings of the device type"`
+	Tags     map[string]string `name:"tags" description:"tags to add to the entries. Tags set by the device take precedence"`
+}
+
+// device returns the device of the type with the settings of the instance.
+func (c Config) device(typ, instance string) (Device, error) {
+	settings := InstanceConfig{
+		SmartMeter: c.SmartMeter,
+		JSON:       c.JSON,
+	}
+	if instance != "" {
+		var ok bool
+		settings, ok = c.Instances[instance]
+		if !ok {
+			return nil, fmt.Errorf("unknown device instance '%s'", instance)
+		}
+	}
+	switch typ {
+	case TypeSmartMeter:
+		return settings.SmartMeter.NewMeter(), nil
+	case TypeJSON:
+		return settings.JSON.NewDevice()
+	default:
+		return nil, fmt.Errorf("invalid device type '%s'. Supported values are '%s' and '%s'", typ, TypeSmartMeter, TypeJSON)
+	}
+}
+
+// Router selects the device for a topic.
+type Router struct {
+	routes []route
+	// defaults are used if there are no routes.
+	defaults []Device
+}
+
+type route struct {
+	filter []string
+	device Device
 }
 
-func (c Config) GetParser(ctx context.Context, key string) (Device, error) {
-	if c.SmartMeter.SupportsKey(key) {
-		return c.SmartMeter, nil
+// NewRouter validates the routes and returns a new Router.
+func (c Config) NewRouter() (*Router, error) {
+	r := &Router{}
+	if len(c.Routes) == 0 {
+		for _, typ := range []string{TypeSmartMeter, TypeJSON} {
+			dev, err := c.device(typ, "")
+			if err != nil {
+				return nil, err
+			}
+			r.defaults = append(r.defaults, dev)
+		}
+	}
+	for i, rt := range c.Routes {
+		if err := topic.ValidateFilter(rt.Match); err != nil {
+			return nil, fmt.Errorf("invalid match '%s' in route %d: %w", rt.Match, i, err)
+		}
+		dev, err := c.device(rt.Device, rt.Instance)
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %w", i, err)
+		}
+		if len(rt.Tags) > 0 {
+			dev = taggedDevice{
+				Device: dev,
+				tags:   rt.Tags,
+			}
+		}
+		r.routes = append(r.routes, route{
+			filter: topic.Split(rt.Match),
+			device: dev,
+		})
+	}
+	return r, nil
+}
+
+// GetParser returns the device of the first route that matches the key.
+// Without routes, the first device that supports the key is used.
+func (r *Router) GetParser(ctx context.Context, key string) (Device, error) {
+	for _, dev := range r.defaults {
+		if dev.SupportsKey(key) {
+			return dev, nil
+		}
+	}
+	parts := topic.Split(key)
+	for _, rt := range r.routes {
+		if topic.MatchPath(rt.filter, parts) {
+			return rt.device, nil
+		}
 	}
 	return nil, fmt.Errorf("no device found for key %s", key)
 }
 
+// taggedDevice adds the tags of a route to the entries of the device.
+type taggedDevice struct {
+	Device
+	tags map[string]string
+}
+
+// Parse implements Device.
+func (d taggedDevice) Parse(ctx context.Context, id, key string, value []byte) (*entry.Entry, error) {
+	res, err := d.Device.Parse(ctx, id, key, value)
+	if err != nil || res == nil {
+		return res, err
+	}
+	if res.Tags == nil {
+		res.Tags = make(map[string]string, len(d.tags))
+	}
+	for k, v := range d.tags {
+		if _, ok := res.Tags[k]; !ok {
+			res.Tags[k] = v
+		}
+	}
+	return res, nil
+}
+
+// TypeOf returns the type of the device.
+func TypeOf(dev Device) string {
+	switch dev := dev.(type) {
+	case taggedDevice:
+		return TypeOf(dev.Device)
+	case *smartmeter.Meter, smartmeter.Config:
+		return TypeSmartMeter
+	case *jsondevice.Device:
+		return TypeJSON
+	default:
+		return "unknown"
+	}
+}
+
 // Device is an IoT device.
 type Device interface {
 	// Parse parses device data on a particular topic.
@@ -0,0 +1,135 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"krishnaiyer.dev/golang/datasink/pkg/device/jsondevice"
+	"krishnaiyer.dev/golang/datasink/pkg/device/smartmeter"
+)
+
+func TestRouter(t *testing.T) {
+	ctx := context.Background()
+	c := Config{
+		SmartMeter: smartmeter.Config{
+			Values: map[string]string{"gas_delivered": "float"},
+		},
+		Instances: map[string]InstanceConfig{
+			"meter-1": {
+				SmartMeter: smartmeter.Config{
+					Values: map[string]string{"electricity_delivered_1": "float"},
+				},
+			},
+		},
+		Routes: []Route{
+			{Match: "home/+/dsmr/#", Device: TypeSmartMeter, Instance: "meter-1", Tags: map[string]string{"location": "home", "id": "ignored"}},
+			{Match: "dsmr/#", Device: TypeSmartMeter},
+		},
+	}
+	r, err := c.NewRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Name   string
+		Key    string
+		Value  string
+		Fields map[string]any
+		Tags   map[string]string
+		Error  bool
+	}{
+		{
+			Name:   "Instance",
+			Key:    "home/attic/dsmr/reading/electricity_delivered_1",
+			Value:  "1234.5",
+			Fields: map[string]any{"electricity_delivered_1": 1234.5},
+			Tags:   map[string]string{"id": "test", "location": "home"},
+		},
+		{
+			Name:  "InstanceSettings",
+			Key:   "home/attic/dsmr/reading/gas_delivered",
+			Value: "12.5",
+		},
+		{
+			Name:   "Default",
+			Key:    "dsmr/reading/gas_delivered",
+			Value:  "12.5",
+			Fields: map[string]any{"gas_delivered": 12.5},
+			Tags:   map[string]string{"id": "test"},
+		},
+		{
+			Name:  "NoRoute",
+			Key:   "home/attic/temperature",
+			Error: true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			parser, err := r.GetParser(ctx, tc.Key)
+			if tc.Error {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := parser.Parse(ctx, "test", tc.Key, []byte(tc.Value))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.Fields == nil {
+				if res != nil {
+					t.Fatalf("expected no entry, got %+v", res)
+				}
+				return
+			}
+			if !reflect.DeepEqual(res.Fields, tc.Fields) {
+				t.Fatalf("expected fields %v, got %v", tc.Fields, res.Fields)
+			}
+			if !reflect.DeepEqual(res.Tags, tc.Tags) {
+				t.Fatalf("expected tags %v, got %v", tc.Tags, res.Tags)
+			}
+		})
+	}
+}
+
+func TestRouterValidation(t *testing.T) {
+	for _, tc := range []struct {
+		Name  string
+		Route Route
+	}{
+		{Name: "InvalidMatch", Route: Route{Match: "dsmr/#/reading", Device: TypeSmartMeter}},
+		{Name: "InvalidDevice", Route: Route{Match: "dsmr/#", Device: "thermostat"}},
+		{Name: "InvalidJSONMapping", Route: Route{Match: "sensors/#", Device: TypeJSON, Instance: "invalid"}},
+		{Name: "UnknownInstance", Route: Route{Match: "dsmr/#", Device: TypeSmartMeter, Instance: "meter-2"}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			c := Config{
+				Instances: map[string]InstanceConfig{
+					"invalid": {JSON: jsondevice.Config{Mappings: []jsondevice.Mapping{{Topic: "sensors/#", Measurement: "{{ .Topic"}}}},
+				},
+				Routes: []Route{tc.Route},
+			}
+			if _, err := c.NewRouter(); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jsondevice parses JSON payloads from generic devices using configurable field mappings.
+//
+// Values are selected with paths of object keys and array indices separated by dots, for example `sensors.0.temperature` or `sensors[0].temperature`.
+// The measurement name is a text/template that has access to `.Username`, `.Topic` (the topic levels) and `.Payload`.
+package jsondevice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/topic"
+	"krishnaiyer.dev/golang/dry/pkg/logger"
+)
+
+// Field selects a value from the payload.
+type Field struct {
+	Path string `name:"path" description:"path of the value in the payload"`
+	Type string `name:"type" description:"data type of the value. Supported values are 'float', 'int', 'bool' and 'string'"`
+}
+
+// Timestamp selects the time of the measurement from the payload.
+type Timestamp struct {
+	Path   string `name:"path" description:"path of the timestamp in the payload. Leave empty to use the time the message is received"`
+	Format string `name:"format" description:"format of the timestamp. Supported values are 'rfc3339' (default), 'unix', 'unix_ms' or a Go time layout"`
+}
+
+// Mapping maps the payloads on matching topics to an entry.
+type Mapping struct {
+	Topic       string            `name:"topic" description:"topic filter"`
+	Measurement string            `name:"measurement" description:"measurement name template"`
+	Fields      map[string]Field  `name:"fields" description:"fields to record"`
+	Tags        map[string]string `name:"tags" description:"tags and the path of their value in the payload"`
+	Timestamp   Timestamp         `name:"timestamp" description:"timestamp extraction"`
+}
+
+// Config is the configuration for generic JSON devices.
+// The first mapping with a matching topic is used.
+type Config struct {
+	Mappings []Mapping `name:"mappings" description:"topic mappings"`
+}
+
+// templateData is passed to the measurement name template.
+type templateData struct {
+	Username string
+	Topic    []string
+	Payload  any
+}
+
+// Types of the field values.
+const (
+	TypeFloat  = "float"
+	TypeInt    = "int"
+	TypeBool   = "bool"
+	TypeString = "string"
+)
+
+// Device parses JSON payloads with the configured mappings.
+type Device struct {
+	mappings []mapping
+}
+
+// mapping is a validated mapping with the parsed topic filter and measurement name template.
+type mapping struct {
+	Mapping
+	filter      []string
+	measurement *template.Template
+}
+
+// NewDevice validates the mappings and returns a new Device.
+func (c Config) NewDevice() (*Device, error) {
+	d := &Device{}
+	for i, m := range c.Mappings {
+		if err := topic.ValidateFilter(m.Topic); err != nil {
+			return nil, fmt.Errorf("invalid topic filter '%s' in mapping %d: %w", m.Topic, i, err)
+		}
+		if m.Measurement == "" {
+			return nil, fmt.Errorf("invalid mapping %d: missing measurement", i)
+		}
+		tmpl, err := template.New("measurement").Option("missingkey=error").Parse(m.Measurement)
+		if err != nil {
+			return nil, fmt.Errorf("invalid measurement template '%s' in mapping %d: %w", m.Measurement, i, err)
+		}
+		for name, field := range m.Fields {
+			if field.Path == "" {
+				return nil, fmt.Errorf("invalid field '%s' in mapping %d: missing path", name, i)
+			}
+			switch field.Type {
+			case TypeFloat, TypeInt, TypeBool, TypeString:
+			default:
+				return nil, fmt.Errorf("invalid type '%s' of field '%s' in mapping %d. Supported values are '%s', '%s', '%s' and '%s'", field.Type, name, i, TypeFloat, TypeInt, TypeBool, TypeString)
+			}
+		}
+		for name, path := range m.Tags {
+			if name == entry.IDTag {
+				return nil, fmt.Errorf("invalid tag '%s' in mapping %d: the tag identifies the device", name, i)
+			}
+			if path == "" {
+				return nil, fmt.Errorf("invalid tag '%s' in mapping %d: missing path", name, i)
+			}
+		}
+		if err := validateTimeFormat(m.Timestamp.Format); err != nil {
+			return nil, fmt.Errorf("mapping %d: %w", i, err)
+		}
+		d.mappings = append(d.mappings, mapping{
+			Mapping:     m,
+			filter:      topic.Split(m.Topic),
+			measurement: tmpl,
+		})
+	}
+	return d, nil
+}
+
+// SupportsKey implements device.Device.
+func (d *Device) SupportsKey(key string) bool {
+	_, ok := d.mapping(key)
+	return ok
+}
+
+func (d *Device) mapping(key string) (mapping, bool) {
+	parts := topic.Split(key)
+	for _, m := range d.mappings {
+		if topic.MatchPath(m.filter, parts) {
+			return m, true
+		}
+	}
+	return mapping{}, false
+}
+
+// Parse implements device.Device.
+// The value returned could be nil without error if none of the configured fields are in the payload. Callers must skip these.
+// Fields that can't be converted to the configured type are skipped.
+func (d *Device) Parse(ctx context.Context, id, key string, value []byte) (*entry.Entry, error) {
+	logger := logger.LoggerFromContext(ctx).WithField("id", id).WithField("key", key)
+
+	m, ok := d.mapping(key)
+	if !ok {
+		return nil, fmt.Errorf("no mapping found for key %s", key)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	var payload any
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, fmt.Errorf("invalid JSON payload: %w", err)
+	}
+
+	measurement, err := m.executeMeasurement(templateData{
+		Username: id,
+		Topic:    topic.Split(key),
+		Payload:  payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]any)
+	for name, field := range m.Fields {
+		v, ok := lookup(payload, field.Path)
+		if !ok {
+			continue
+		}
+		converted, err := convert(v, field.Type)
+		if err != nil {
+			logger.WithError(err).WithField("field", name).Warn("Invalid value, skip field")
+			continue
+		}
+		fields[name] = converted
+	}
+	if len(fields) == 0 {
+		logger.Info("No configured fields in payload, skip")
+		return nil, nil
+	}
+
+	tags := map[string]string{
+		entry.IDTag: id,
+	}
+	for name, path := range m.Tags {
+		v, ok := lookup(payload, path)
+		if !ok {
+			continue
+		}
+		tags[name] = fmt.Sprint(v)
+	}
+
+	var t time.Time
+	if m.Timestamp.Path != "" {
+		v, ok := lookup(payload, m.Timestamp.Path)
+		if !ok {
+			logger.Warn("Timestamp not found in payload")
+		} else if t, err = parseTime(v, m.Timestamp.Format); err != nil {
+			logger.WithError(err).Warn("Invalid timestamp")
+		}
+	}
+
+	return &entry.Entry{
+		Measurement: measurement,
+		Tags:        tags,
+		Fields:      fields,
+		Time:        t,
+	}, nil
+}
+
+// executeMeasurement executes the measurement name template.
+func (m mapping) executeMeasurement(data templateData) (string, error) {
+	var buf strings.Builder
+	if err := m.measurement.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("execute measurement template: %w", err)
+	}
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("empty measurement name")
+	}
+	return buf.String(), nil
+}
+
+// splitPath splits a path into object keys and array indices.
+func splitPath(path string) []string {
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+	return strings.Split(path, ".")
+}
+
+// lookup returns the value at the path.
+func lookup(v any, path string) (any, bool) {
+	for _, part := range splitPath(path) {
+		switch node := v.(type) {
+		case map[string]any:
+			next, ok := node[part]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case []any:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, v != nil
+}
+
+// convert converts a JSON value to the type.
+// Numbers and booleans encoded as strings are converted as well.
+func convert(v any, typ string) (any, error) {
+	s := fmt.Sprint(v)
+	switch typ {
+	case TypeFloat:
+		return strconv.ParseFloat(s, 64)
+	case TypeInt:
+		return strconv.Atoi(s)
+	case TypeBool:
+		return strconv.ParseBool(s)
+	case TypeString:
+		if _, ok := v.(string); !ok {
+			if _, ok := v.(json.Number); !ok {
+				return nil, fmt.Errorf("value of type %T is not a string", v)
+			}
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown type %s", typ)
+	}
+}
+
+// validateTimeFormat returns an error if the timestamp format is not supported.
+// A Go time layout must contain layout elements, so that it can't be confused with a misspelled format.
+func validateTimeFormat(format string) error {
+	switch format {
+	case "", "rfc3339", "unix", "unix_ms":
+		return nil
+	}
+	ref := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	formatted := ref.Format(format)
+	if formatted == format {
+		return fmt.Errorf("invalid timestamp format '%s'. Supported values are 'rfc3339', 'unix', 'unix_ms' or a Go time layout", format)
+	}
+	if _, err := time.Parse(format, formatted); err != nil {
+		return fmt.Errorf("invalid timestamp format '%s': %w", format, err)
+	}
+	return nil
+}
+
+// parseTime parses a timestamp with the format.
+func parseTime(v any, format string) (time.Time, error) {
+	s := fmt.Sprint(v)
+	switch format {
+	case "", "rfc3339":
+		return time.Parse(time.RFC3339Nano, s)
+	case "unix", "unix_ms":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if format == "unix_ms" {
+			return time.UnixMilli(int64(f)), nil
+		}
+		return time.Unix(0, int64(f*float64(time.Second))), nil
+	default:
+		return time.Parse(format, s)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsondevice
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+)
+
+func TestJSONDevice(t *testing.T) {
+	ctx := context.Background()
+	c, err := Config{
+		Mappings: []Mapping{
+			{
+				Topic:       "home/+/climate",
+				Measurement: "climate_{{ index .Topic 1 }}",
+				Fields: map[string]Field{
+					"temperature": {Path: "sensors[0].temperature", Type: "float"},
+					"humidity":    {Path: "sensors.0.humidity", Type: "int"},
+					"battery_low": {Path: "battery.low", Type: "bool"},
+					"firmware":    {Path: "firmware", Type: "string"},
+				},
+				Tags: map[string]string{
+					"model": "device.model",
+				},
+				Timestamp: Timestamp{
+					Path:   "ts",
+					Format: "unix_ms",
+				},
+			},
+			{
+				Topic:       "sensors/#",
+				Measurement: "{{ .Payload.type }}",
+				Fields: map[string]Field{
+					"value": {Path: "value", Type: "float"},
+				},
+			},
+		},
+	}.NewDevice()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Name     string
+		Key      string
+		Payload  string
+		Expected *entry.Entry
+		Error    bool
+	}{
+		{
+			Name:    "NestedPaths",
+			Key:     "home/kitchen/climate",
+			Payload: `{"ts":1670000000000,"device":{"model":"esp32"},"sensors":[{"temperature":21.5,"humidity":"40"}],"battery":{"low":false},"firmware":"1.2.0"}`,
+			Expected: &entry.Entry{
+				Measurement: "climate_kitchen",
+				Tags:        map[string]string{"id": "test", "model": "esp32"},
+				Fields:      map[string]any{"temperature": 21.5, "humidity": 40, "battery_low": false, "firmware": "1.2.0"},
+				Time:        time.UnixMilli(1670000000000),
+			},
+		},
+		{
+			Name:    "MissingAndInvalidFields",
+			Key:     "home/kitchen/climate",
+			Payload: `{"sensors":[{"temperature":"warm","humidity":40}],"firmware":12}`,
+			Expected: &entry.Entry{
+				Measurement: "climate_kitchen",
+				Tags:        map[string]string{"id": "test"},
+				Fields:      map[string]any{"humidity": 40, "firmware": "12"},
+			},
+		},
+		{
+			Name:    "NoFields",
+			Key:     "home/kitchen/climate",
+			Payload: `{"sensors":[]}`,
+		},
+		{
+			Name:    "PayloadTemplate",
+			Key:     "sensors/1/value",
+			Payload: `{"type":"pressure","value":1013.2}`,
+			Expected: &entry.Entry{
+				Measurement: "pressure",
+				Tags:        map[string]string{"id": "test"},
+				Fields:      map[string]any{"value": 1013.2},
+			},
+		},
+		{
+			Name:    "MissingTemplateKey",
+			Key:     "sensors/1/value",
+			Payload: `{"value":1013.2}`,
+			Error:   true,
+		},
+		{
+			Name:    "InvalidJSON",
+			Key:     "sensors/1/value",
+			Payload: `{"value":`,
+			Error:   true,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			if !c.SupportsKey(tc.Key) {
+				t.Fatalf("expected key %s to be supported", tc.Key)
+			}
+			res, err := c.Parse(ctx, "test", tc.Key, []byte(tc.Payload))
+			if tc.Error {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(res, tc.Expected) {
+				t.Fatalf("expected %+v, got %+v", tc.Expected, res)
+			}
+		})
+	}
+
+	if c.SupportsKey("dsmr/reading/gas") {
+		t.Fatal("expected key to be unsupported")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	valid := Mapping{
+		Topic:       "sensors/#",
+		Measurement: "climate",
+		Fields:      map[string]Field{"temperature": {Path: "temperature", Type: TypeFloat}},
+		Timestamp:   Timestamp{Path: "time", Format: "2006-01-02 15:04:05"},
+	}
+	if _, err := (Config{Mappings: []Mapping{valid}}).NewDevice(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		Name   string
+		Modify func(m *Mapping)
+	}{
+		{Name: "InvalidTopic", Modify: func(m *Mapping) { m.Topic = "sensors/#/climate" }},
+		{Name: "MissingMeasurement", Modify: func(m *Mapping) { m.Measurement = "" }},
+		{Name: "InvalidTemplate", Modify: func(m *Mapping) { m.Measurement = "{{ .Topic" }},
+		{Name: "InvalidType", Modify: func(m *Mapping) {
+			m.Fields = map[string]Field{"temperature": {Path: "temperature", Type: "integer"}}
+		}},
+		{Name: "MissingPath", Modify: func(m *Mapping) { m.Fields = map[string]Field{"temperature": {Type: TypeFloat}} }},
+		{Name: "InvalidTimestampFormat", Modify: func(m *Mapping) { m.Timestamp.Format = "unix_s" }},
+		{Name: "IDTag", Modify: func(m *Mapping) { m.Tags = map[string]string{"id": "device.id"} }},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			m := valid
+			tc.Modify(&m)
+			if _, err := (Config{Mappings: []Mapping{m}}).NewDevice(); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
@@ -18,21 +18,30 @@ package smartmeter
 
 import (
 	"context"
+	"fmt"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
 	"krishnaiyer.dev/golang/dry/pkg/logger"
 )
 
 const (
-	rootPrefix  = "dsmr"
-	measurement = "smartmeter"
+	rootPrefix   = "dsmr"
+	measurement  = "smartmeter"
+	timestampKey = "timestamp"
+
+	// DefaultTimestampWindow is the default duration for which the meter timestamp is used.
+	DefaultTimestampWindow = 10 * time.Second
 )
 
 // Config is the configuration for the smart meter.
 type Config struct {
-	Values map[string]string `name:"values" description:"Values to record and the corresponding data type"`
+	Values          map[string]string `name:"values" description:"Values to record and the corresponding data type"`
+	TimestampWindow time.Duration     `name:"timestamp-window" description:"readings received within this duration after the meter timestamp are recorded at that time (default 10s)"`
+	TelegramKey     string            `name:"telegram-key" description:"key on which raw DSMR P1 telegrams are published (default 'telegram')"`
 }
 
 // SupportsKey implements device.Device.
@@ -44,7 +53,16 @@ func (c Config) SupportsKey(key string) bool {
 	return false
 }
 
+// telegramKey returns the key on which raw telegrams are published.
+func (c Config) telegramKey() string {
+	if c.TelegramKey == "" {
+		return DefaultTelegramKey
+	}
+	return c.TelegramKey
+}
+
 // Parse implements device.Device.
+// Raw DSMR P1 telegrams are parsed into a single entry.
 // The value returned could be nil without error. Callers must skip these.
 // This function does not error on unknown message types to prevent a rogue device from crashing the server.
 func (c Config) Parse(ctx context.Context, id, key string, value []byte) (*entry.Entry, error) {
@@ -57,6 +75,9 @@ func (c Config) Parse(ctx context.Context, id, key string, value []byte) (*entry
 		return nil, nil
 	}
 	dbKey := k[len(k)-1]
+	if dbKey == c.telegramKey() {
+		return c.parseTelegram(id, value)
+	}
 	typ, ok := c.Values[dbKey]
 	if !ok {
 		logger.WithField("key", key).Info("Key not configured for logging, skip")
@@ -81,8 +102,91 @@ func (c Config) Parse(ctx context.Context, id, key string, value []byte) (*entry
 	return &entry.Entry{
 		Measurement: measurement,
 		Tags: map[string]string{
-			"id": id,
+			entry.IDTag: id,
 		},
 		Fields: fields,
 	}, nil
 }
+
+// meterTime is the last timestamp reported by a meter.
+type meterTime struct {
+	time     time.Time
+	received time.Time
+}
+
+// Meter is a smart meter that records readings at the time reported by the meter.
+// The gateway publishes the meter timestamp together with the readings of a telegram.
+// Readings received shortly after the timestamp use that timestamp instead of the time they are recorded.
+type Meter struct {
+	Config
+
+	mu    sync.Mutex
+	times map[string]meterTime
+	now   func() time.Time
+}
+
+// NewMeter returns a new Meter.
+func (c Config) NewMeter() *Meter {
+	if c.TimestampWindow == 0 {
+		c.TimestampWindow = DefaultTimestampWindow
+	}
+	return &Meter{
+		Config: c,
+		times:  make(map[string]meterTime),
+		now:    time.Now,
+	}
+}
+
+// Parse implements device.Device.
+func (m *Meter) Parse(ctx context.Context, id, key string, value []byte) (*entry.Entry, error) {
+	now := m.now()
+	k := strings.Split(key, "/")
+	if k[len(k)-1] == timestampKey {
+		t, err := parseTimestamp(string(value))
+		if err != nil {
+			logger.LoggerFromContext(ctx).WithField("id", id).WithError(err).Warn("Invalid meter timestamp")
+		} else {
+			m.mu.Lock()
+			m.times[id] = meterTime{
+				time:     t,
+				received: now,
+			}
+			m.mu.Unlock()
+		}
+	}
+	res, err := m.Config.Parse(ctx, id, key, value)
+	if err != nil || res == nil {
+		return res, err
+	}
+	if !res.Time.IsZero() {
+		return res, nil
+	}
+	m.mu.Lock()
+	mt, ok := m.times[id]
+	m.mu.Unlock()
+	if ok && now.Sub(mt.received) <= m.TimestampWindow {
+		res.Time = mt.time
+	}
+	return res, nil
+}
+
+// parseTimestamp parses the meter timestamp.
+// The DSMR format is YYMMDDhhmmssX where X is 'S' for summer time (CEST) and 'W' for winter time (CET).
+// Unix timestamps in seconds and RFC3339 are supported as well.
+func parseTimestamp(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 13 && (s[12] == 'S' || s[12] == 'W') {
+		offset := 1
+		if s[12] == 'S' {
+			offset = 2
+		}
+		return time.ParseInLocation("060102150405", s[:12], time.FixedZone("", offset*60*60))
+	}
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp format '%s'", s)
+}
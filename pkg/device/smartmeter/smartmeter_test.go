@@ -15,32 +15,116 @@
 package smartmeter
 
 import (
+	"context"
+	"reflect"
 	"testing"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
 )
 
 func TestSmartMeter(t *testing.T) {
-	// a := assertions.New(t)
-	// ctx := context.Background()
-
-	// m := Meter{}
-
-	// for _, tc := range []struct {
-	// 	Name             string
-	// 	TopicParts       []string
-	// 	Data             []byte
-	// 	ExpectedResponse *entry.Entry
-	// 	ErrorAssertion   func(error) bool
-	// }{} {
-	// 	t.Run(tc.Name, func(t *testing.T) {
-	// 		resp, err := m.Parse(ctx, tc.TopicParts, tc.Data)
-	// 		a.So(err, should.HaveSameTypeAs, tc.ErrorAssertion)
-	// 		if tc.ErrorAssertion != nil {
-	// 			if !a.So(tc.ErrorAssertion(err), should.BeTrue) {
-	// 				t.Failnow()
-	// 			}
-	// 		}
-	// 		a.So(resp, should.Resemble, tc.ExpectedResponse)
-	// 	})
-	// }
+	ctx := context.Background()
+
+	m := Config{
+		Values: map[string]string{
+			"electricity_delivered_1":  "float",
+			"wifi_rssi":                "int",
+			"electricity_equipment_id": "string",
+		},
+	}
+
+	for _, tc := range []struct {
+		Name             string
+		Key              string
+		Data             []byte
+		ExpectedResponse *entry.Entry
+	}{
+		{
+			Name: "Float",
+			Key:  "dsmr/reading/electricity_delivered_1",
+			Data: []byte("1234.567"),
+			ExpectedResponse: &entry.Entry{
+				Measurement: measurement,
+				Tags:        map[string]string{"id": "test"},
+				Fields:      map[string]any{"electricity_delivered_1": 1234.567},
+			},
+		},
+		{
+			Name: "Int",
+			Key:  "dsmr/meta/wifi_rssi",
+			Data: []byte("-67"),
+			ExpectedResponse: &entry.Entry{
+				Measurement: measurement,
+				Tags:        map[string]string{"id": "test"},
+				Fields:      map[string]any{"wifi_rssi": -67},
+			},
+		},
+		{
+			Name: "String",
+			Key:  "dsmr/meta/electricity_equipment_id",
+			Data: []byte("E0043007012345678"),
+			ExpectedResponse: &entry.Entry{
+				Measurement: measurement,
+				Tags:        map[string]string{"id": "test"},
+				Fields:      map[string]any{"electricity_equipment_id": "E0043007012345678"},
+			},
+		},
+		{
+			Name: "NotConfigured",
+			Key:  "dsmr/reading/gas_delivered",
+			Data: []byte("12.3"),
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			resp, err := m.Parse(ctx, "test", tc.Key, tc.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resp, tc.ExpectedResponse) {
+				t.Fatalf("expected %+v, got %+v", tc.ExpectedResponse, resp)
+			}
+		})
+	}
+}
+
+func TestMeterTimestamp(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 12, 4, 14, 0, 0, 0, time.UTC)
+
+	m := Config{
+		Values: map[string]string{
+			"electricity_delivered_1": "float",
+		},
+	}.NewMeter()
+	m.now = func() time.Time { return now }
+
+	if _, err := m.Parse(ctx, "test", "dsmr/reading/timestamp", []byte("221204123456W")); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := m.Parse(ctx, "test", "dsmr/reading/electricity_delivered_1", []byte("1234.567"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := time.Date(2022, 12, 4, 11, 34, 56, 0, time.UTC); !resp.Time.Equal(expected) {
+		t.Fatalf("expected time %s, got %s", expected, resp.Time)
+	}
+
+	resp, err = m.Parse(ctx, "other", "dsmr/reading/electricity_delivered_1", []byte("1234.567"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Time.IsZero() {
+		t.Fatalf("expected no time for other meter, got %s", resp.Time)
+	}
 
+	now = now.Add(time.Minute)
+	resp, err = m.Parse(ctx, "test", "dsmr/reading/electricity_delivered_1", []byte("1234.567"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Time.IsZero() {
+		t.Fatalf("expected no time after the window, got %s", resp.Time)
+	}
 }
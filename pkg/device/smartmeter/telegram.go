@@ -0,0 +1,311 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smartmeter
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+)
+
+// DefaultTelegramKey is the default key on which raw DSMR P1 telegrams are published.
+const DefaultTelegramKey = "telegram"
+
+const (
+	obisVersion   = "1-3:0.2.8"
+	obisTimestamp = "0-0:1.0.0"
+	// obisGas is the hourly M-Bus reading in DSMR 4.x and 5.0. The channel is replaced by 'n'.
+	obisGas = "0-n:24.2.1"
+	// obisGasLegacy is the M-Bus reading in DSMR 2.2 and 3.0. The value is on the next line.
+	obisGasLegacy = "0-n:24.3.0"
+	// obisDeviceType is the device type of an M-Bus channel.
+	obisDeviceType = "0-n:24.1.0"
+	// mbusGas is the M-Bus device type of gas meters. Other devices are, for example, water meters (7).
+	mbusGas = 3
+)
+
+// obisObject is a known OBIS object.
+type obisObject struct {
+	name string
+	typ  string
+	unit string
+}
+
+// obisObjects are the known OBIS codes of DSMR telegrams.
+// M-Bus channels are replaced by 'n'.
+var obisObjects = map[string]obisObject{
+	obisVersion:   {name: "dsmr_version", typ: "string"},
+	"0-0:96.1.1":  {name: "electricity_equipment_id", typ: "string"},
+	"1-0:1.8.1":   {name: "electricity_delivered_1", typ: "float", unit: "kWh"},
+	"1-0:1.8.2":   {name: "electricity_delivered_2", typ: "float", unit: "kWh"},
+	"1-0:2.8.1":   {name: "electricity_returned_1", typ: "float", unit: "kWh"},
+	"1-0:2.8.2":   {name: "electricity_returned_2", typ: "float", unit: "kWh"},
+	"0-0:96.14.0": {name: "electricity_tariff", typ: "int"},
+	"1-0:1.7.0":   {name: "electricity_currently_delivered", typ: "float", unit: "kW"},
+	"1-0:2.7.0":   {name: "electricity_currently_returned", typ: "float", unit: "kW"},
+	"0-0:96.7.21": {name: "power_failures", typ: "int"},
+	"0-0:96.7.9":  {name: "long_power_failures", typ: "int"},
+	"1-0:32.32.0": {name: "voltage_sags_l1", typ: "int"},
+	"1-0:52.32.0": {name: "voltage_sags_l2", typ: "int"},
+	"1-0:72.32.0": {name: "voltage_sags_l3", typ: "int"},
+	"1-0:32.36.0": {name: "voltage_swells_l1", typ: "int"},
+	"1-0:52.36.0": {name: "voltage_swells_l2", typ: "int"},
+	"1-0:72.36.0": {name: "voltage_swells_l3", typ: "int"},
+	"1-0:32.7.0":  {name: "voltage_l1", typ: "float", unit: "V"},
+	"1-0:52.7.0":  {name: "voltage_l2", typ: "float", unit: "V"},
+	"1-0:72.7.0":  {name: "voltage_l3", typ: "float", unit: "V"},
+	"1-0:31.7.0":  {name: "current_l1", typ: "float", unit: "A"},
+	"1-0:51.7.0":  {name: "current_l2", typ: "float", unit: "A"},
+	"1-0:71.7.0":  {name: "current_l3", typ: "float", unit: "A"},
+	"1-0:21.7.0":  {name: "power_delivered_l1", typ: "float", unit: "kW"},
+	"1-0:41.7.0":  {name: "power_delivered_l2", typ: "float", unit: "kW"},
+	"1-0:61.7.0":  {name: "power_delivered_l3", typ: "float", unit: "kW"},
+	"1-0:22.7.0":  {name: "power_returned_l1", typ: "float", unit: "kW"},
+	"1-0:42.7.0":  {name: "power_returned_l2", typ: "float", unit: "kW"},
+	"1-0:62.7.0":  {name: "power_returned_l3", typ: "float", unit: "kW"},
+	"0-n:96.1.0":  {name: "gas_equipment_id", typ: "string"},
+	obisGas:       {name: "gas_delivered", typ: "float", unit: "m3"},
+	obisGasLegacy: {name: "gas_delivered", typ: "float", unit: "m3"},
+}
+
+// unitConversions are the factors to convert units to the units of the known OBIS objects.
+var unitConversions = map[[2]string]float64{
+	{"W", "kW"}:   0.001,
+	{"Wh", "kWh"}: 0.001,
+}
+
+// Telegram is a parsed DSMR P1 telegram.
+type Telegram struct {
+	// Header is the identification of the meter, without the leading '/'.
+	Header string
+	// Time is the meter time. It is zero for telegrams without a timestamp (DSMR 2.2).
+	Time time.Time
+	// Fields are the values of the known OBIS objects by field name.
+	// The time of the gas reading is in the gas_timestamp field in Unix seconds.
+	Fields map[string]any
+}
+
+// ParseTelegram parses a DSMR 2.2, 4.x or 5.0 P1 telegram.
+// The telegram starts with '/' and ends with '!', followed by a CRC16 for DSMR 4.x and 5.0.
+// If there is a CRC, it must be valid. Unknown OBIS codes are ignored.
+func ParseTelegram(data []byte) (*Telegram, error) {
+	start := bytes.IndexByte(data, '/')
+	if start < 0 {
+		return nil, fmt.Errorf("invalid telegram: missing header")
+	}
+	data = data[start:]
+	end := bytes.IndexByte(data, '!')
+	if end < 0 {
+		return nil, fmt.Errorf("invalid telegram: missing end")
+	}
+	if crc := strings.TrimSpace(string(data[end+1:])); crc != "" {
+		expected, err := strconv.ParseUint(crc, 16, 16)
+		if err != nil || len(crc) != 4 {
+			return nil, fmt.Errorf("invalid telegram CRC '%s'", crc)
+		}
+		if actual := crc16(data[:end+1]); actual != uint16(expected) {
+			return nil, fmt.Errorf("telegram CRC mismatch: expected %04X, got %04X", expected, actual)
+		}
+	}
+
+	lines := strings.Split(strings.ReplaceAll(string(data[:end]), "\r\n", "\n"), "\n")
+	t := &Telegram{
+		Header: strings.TrimSpace(strings.TrimPrefix(lines[0], "/")),
+		Fields: make(map[string]any),
+	}
+	// Join values that continue on the next line, like the gas reading in DSMR 2.2.
+	var objects []string
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "(") && len(objects) > 0:
+			objects[len(objects)-1] += line
+		default:
+			objects = append(objects, line)
+		}
+	}
+	channels := mbusDeviceTypes(objects)
+	for _, object := range objects {
+		if err := t.parseObject(object, channels); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// mbusDeviceTypes returns the device types of the M-Bus channels by channel.
+func mbusDeviceTypes(objects []string) map[string]int {
+	types := make(map[string]int)
+	for _, object := range objects {
+		code, value, ok := strings.Cut(strings.TrimSuffix(object, ")"), "(")
+		channel, rest, isMBus := mbusChannel(code)
+		if !ok || !isMBus || rest != obisDeviceType {
+			continue
+		}
+		if typ, err := strconv.Atoi(value); err == nil {
+			types[channel] = typ
+		}
+	}
+	return types
+}
+
+// mbusChannel returns the channel of an M-Bus object and the code with the channel replaced by 'n'.
+func mbusChannel(code string) (channel, generic string, ok bool) {
+	if !strings.HasPrefix(code, "0-") {
+		return "", code, false
+	}
+	channel, rest, ok := strings.Cut(code[2:], ":")
+	if !ok || channel == "0" {
+		return "", code, false
+	}
+	return channel, "0-n:" + rest, true
+}
+
+// parseObject parses an object line like 1-0:1.8.1(001234.567*kWh).
+// M-Bus objects are only parsed for the gas meter channel. If the telegram has no device types, all channels are parsed.
+func (t *Telegram) parseObject(line string, channels map[string]int) error {
+	i := strings.IndexByte(line, '(')
+	if i < 0 || !strings.HasSuffix(line, ")") {
+		return fmt.Errorf("invalid telegram line '%s'", line)
+	}
+	code := line[:i]
+	values := strings.Split(line[i+1:len(line)-1], ")(")
+	if code == obisTimestamp {
+		ts, err := parseTimestamp(values[0])
+		if err != nil {
+			return err
+		}
+		t.Time = ts
+		return nil
+	}
+	// M-Bus objects are the same on every channel, so other devices like water meters would overwrite the gas fields.
+	if channel, generic, ok := mbusChannel(code); ok {
+		if typ, known := channels[channel]; len(channels) > 0 && (!known || typ != mbusGas) {
+			return nil
+		}
+		code = generic
+	}
+	obj, ok := obisObjects[code]
+	if !ok {
+		return nil
+	}
+	value := values[len(values)-1]
+	switch code {
+	case obisGas:
+		// The gas reading has its own timestamp.
+		if len(values) != 2 {
+			return fmt.Errorf("invalid gas reading '%s'", line)
+		}
+		ts, err := parseTimestamp(values[0])
+		if err != nil {
+			return err
+		}
+		t.Fields["gas_timestamp"] = ts.Unix()
+	case obisGasLegacy:
+		// (timestamp)(status)(interval)(values)(code)(unit)(value)
+		if len(values) != 7 {
+			return fmt.Errorf("invalid gas reading '%s'", line)
+		}
+		ts, err := parseLocalTimestamp(values[0])
+		if err != nil {
+			return err
+		}
+		t.Fields["gas_timestamp"] = ts.Unix()
+		value = values[6] + "*" + values[5]
+	}
+	v, err := obj.parse(value)
+	if err != nil {
+		return fmt.Errorf("invalid value of %s: %w", code, err)
+	}
+	t.Fields[obj.name] = v
+	return nil
+}
+
+// parse parses the value of the object and converts it to the unit of the object.
+func (obj obisObject) parse(value string) (any, error) {
+	value, unit, _ := strings.Cut(value, "*")
+	switch obj.typ {
+	case "float":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, err
+		}
+		if unit != "" && !strings.EqualFold(unit, obj.unit) {
+			factor, ok := unitConversions[[2]string{unit, obj.unit}]
+			if !ok {
+				return nil, fmt.Errorf("invalid unit '%s', expected '%s'", unit, obj.unit)
+			}
+			v *= factor
+		}
+		return v, nil
+	case "int":
+		return strconv.Atoi(value)
+	default:
+		return value, nil
+	}
+}
+
+// parseTelegram parses a telegram into a single entry with all known fields.
+func (c Config) parseTelegram(id string, value []byte) (*entry.Entry, error) {
+	t, err := ParseTelegram(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.Fields) == 0 {
+		return nil, nil
+	}
+	return &entry.Entry{
+		Measurement: measurement,
+		Tags: map[string]string{
+			entry.IDTag: id,
+		},
+		Fields: t.Fields,
+		Time:   t.Time,
+	}, nil
+}
+
+// parseLocalTimestamp parses a timestamp without daylight saving time indicator in the Dutch time zone.
+func parseLocalTimestamp(s string) (time.Time, error) {
+	loc, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		loc = time.FixedZone("CET", 60*60)
+	}
+	t, err := time.ParseInLocation("060102150405", s, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp format '%s'", s)
+	}
+	return t, nil
+}
+
+// crc16 returns the CRC16/ARC checksum of the data.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
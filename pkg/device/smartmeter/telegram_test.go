@@ -0,0 +1,215 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smartmeter
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+var telegramV5 = strings.Join([]string{
+	"/ISk5\\2MT382-1000",
+	"",
+	"1-3:0.2.8(50)",
+	"0-0:1.0.0(101209113020W)",
+	"0-0:96.1.1(4B384547303034303436333935353037)",
+	"1-0:1.8.1(123456.789*kWh)",
+	"1-0:1.8.2(123456.789*kWh)",
+	"1-0:2.8.1(123456.789*kWh)",
+	"1-0:2.8.2(123456.789*kWh)",
+	"0-0:96.14.0(0002)",
+	"1-0:1.7.0(01.193*kW)",
+	"1-0:2.7.0(00.000*kW)",
+	"0-0:96.7.21(00004)",
+	"0-0:96.7.9(00002)",
+	"1-0:99.97.0(2)(0-0:96.7.19)(101208152415W)(0000000240*s)(101208151004W)(0000000301*s)",
+	"1-0:32.32.0(00002)",
+	"1-0:52.32.0(00001)",
+	"1-0:72.32.0(00000)",
+	"1-0:32.36.0(00000)",
+	"1-0:52.36.0(00003)",
+	"1-0:72.36.0(00000)",
+	"0-0:96.13.0(303132333435363738393A3B3C3D3E3F303132333435363738393A3B3C3D3E3F303132333435363738393A3B3C3D3E3F303132333435363738393A3B3C3D3E3F303132333435363738393A3B3C3D3E3F)",
+	"1-0:32.7.0(220.1*V)",
+	"1-0:52.7.0(220.2*V)",
+	"1-0:72.7.0(220.3*V)",
+	"1-0:31.7.0(001*A)",
+	"1-0:51.7.0(002*A)",
+	"1-0:71.7.0(003*A)",
+	"1-0:21.7.0(01.111*kW)",
+	"1-0:41.7.0(02.222*kW)",
+	"1-0:61.7.0(03.333*kW)",
+	"1-0:22.7.0(04.444*kW)",
+	"1-0:42.7.0(05.555*kW)",
+	"1-0:62.7.0(06.666*kW)",
+	"0-1:24.1.0(003)",
+	"0-1:96.1.0(3232323241424344313233343536373839)",
+	"0-1:24.2.1(101209112500W)(12785.123*m3)",
+	"!E47C",
+}, "\r\n") + "\r\n"
+
+var telegramV22 = strings.Join([]string{
+	"/ISk5\\2MT382-1004",
+	"",
+	"0-0:96.1.1(00000000000000)",
+	"1-0:1.8.1(00001.001*kWh)",
+	"1-0:1.8.2(00001.001*kWh)",
+	"1-0:2.8.1(00001.001*kWh)",
+	"1-0:2.8.2(00001.001*kWh)",
+	"0-0:96.14.0(0001)",
+	"1-0:1.7.0(0001.01*kW)",
+	"1-0:2.7.0(0000.00*kW)",
+	"0-0:17.0.0(0999.00*kW)",
+	"0-0:96.3.10(1)",
+	"0-0:96.13.1()",
+	"0-0:96.13.0()",
+	"0-1:24.1.0(3)",
+	"0-1:96.1.0(3238313031453631373038389930337131)",
+	"0-1:24.3.0(120517020000)(08)(60)(1)(0-1:24.2.1)(m3)",
+	"(00124.477)",
+	"0-1:24.4.0(1)",
+	"!",
+}, "\r\n") + "\r\n"
+
+func TestCRC16(t *testing.T) {
+	if crc := crc16([]byte("123456789")); crc != 0xBB3D {
+		t.Fatalf("expected CRC BB3D, got %04X", crc)
+	}
+}
+
+func TestParseTelegram(t *testing.T) {
+	t.Run("DSMR5", func(t *testing.T) {
+		tg, err := ParseTelegram([]byte(telegramV5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tg.Header != "ISk5\\2MT382-1000" {
+			t.Fatalf("unexpected header %s", tg.Header)
+		}
+		if expected := time.Date(2010, 12, 9, 10, 30, 20, 0, time.UTC); !tg.Time.Equal(expected) {
+			t.Fatalf("expected time %s, got %s", expected, tg.Time)
+		}
+		for name, expected := range map[string]any{
+			"dsmr_version":                    "50",
+			"electricity_delivered_1":         123456.789,
+			"electricity_tariff":              2,
+			"electricity_currently_delivered": 1.193,
+			"power_failures":                  4,
+			"voltage_sags_l1":                 2,
+			"voltage_l2":                      220.2,
+			"current_l3":                      3.0,
+			"power_returned_l3":               6.666,
+			"gas_equipment_id":                "3232323241424344313233343536373839",
+			"gas_delivered":                   12785.123,
+			"gas_timestamp":                   time.Date(2010, 12, 9, 10, 25, 0, 0, time.UTC).Unix(),
+		} {
+			if actual := tg.Fields[name]; actual != expected {
+				t.Fatalf("expected %s to be %v (%T), got %v (%T)", name, expected, expected, actual, actual)
+			}
+		}
+	})
+
+	t.Run("DSMR22", func(t *testing.T) {
+		tg, err := ParseTelegram([]byte(telegramV22))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tg.Time.IsZero() {
+			t.Fatalf("expected no time, got %s", tg.Time)
+		}
+		if v := tg.Fields["electricity_currently_delivered"]; v != 1.01 {
+			t.Fatalf("expected electricity_currently_delivered to be 1.01, got %v", v)
+		}
+		if v := tg.Fields["gas_delivered"]; v != 124.477 {
+			t.Fatalf("expected gas_delivered to be 124.477, got %v", v)
+		}
+		if v := tg.Fields["gas_timestamp"]; v != time.Date(2012, 5, 17, 0, 0, 0, 0, time.UTC).Unix() {
+			t.Fatalf("unexpected gas_timestamp %v", v)
+		}
+	})
+
+	t.Run("Units", func(t *testing.T) {
+		tg, err := ParseTelegram([]byte("/TEST\r\n\r\n1-0:1.7.0(1193*W)\r\n!\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := tg.Fields["electricity_currently_delivered"]; v != 1.193 {
+			t.Fatalf("expected electricity_currently_delivered to be 1.193, got %v", v)
+		}
+		if _, err := ParseTelegram([]byte("/TEST\r\n\r\n1-0:1.7.0(1193*A)\r\n!\r\n")); err == nil {
+			t.Fatal("expected error for invalid unit")
+		}
+	})
+
+	t.Run("MBusChannels", func(t *testing.T) {
+		tg, err := ParseTelegram([]byte(strings.Join([]string{
+			"/TEST",
+			"",
+			"0-1:24.1.0(003)",
+			"0-1:96.1.0(4741530031)",
+			"0-1:24.2.1(101209112500W)(00123.456*m3)",
+			"0-2:24.1.0(007)",
+			"0-2:96.1.0(5741540032)",
+			"0-2:24.2.1(101209112500W)(00042.000*m3)",
+			"!",
+		}, "\r\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The water meter on channel 2 doesn't overwrite the gas fields.
+		if v := tg.Fields["gas_delivered"]; v != 123.456 {
+			t.Fatalf("expected gas_delivered to be 123.456, got %v", v)
+		}
+		if v := tg.Fields["gas_equipment_id"]; v != "4741530031" {
+			t.Fatalf("expected gas_equipment_id to be 4741530031, got %v", v)
+		}
+	})
+
+	t.Run("InvalidCRC", func(t *testing.T) {
+		corrupt := strings.Replace(telegramV5, "123456.789", "123456.788", 1)
+		if _, err := ParseTelegram([]byte(corrupt)); err == nil {
+			t.Fatal("expected CRC error")
+		}
+	})
+
+	t.Run("Incomplete", func(t *testing.T) {
+		if _, err := ParseTelegram([]byte(telegramV5[:200])); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestMeterTelegram(t *testing.T) {
+	ctx := context.Background()
+	m := Config{}.NewMeter()
+	res, err := m.Parse(ctx, "test", "dsmr/telegram", []byte(telegramV5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Measurement != measurement || res.Tags["id"] != "test" {
+		t.Fatalf("unexpected entry %+v", res)
+	}
+	if expected := time.Date(2010, 12, 9, 10, 30, 20, 0, time.UTC); !res.Time.Equal(expected) {
+		t.Fatalf("expected time %s, got %s", expected, res.Time)
+	}
+	if v := res.Fields["electricity_delivered_2"]; v != 123456.789 {
+		t.Fatalf("expected electricity_delivered_2 to be 123456.789, got %v", v)
+	}
+	if _, err := m.Parse(ctx, "test", "dsmr/telegram", []byte("/TEST")); err == nil {
+		t.Fatal("expected error for incomplete telegram")
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package heartbeat detects devices that stopped sending messages and records their status.
+package heartbeat
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/pipeline"
+	"krishnaiyer.dev/golang/dry/pkg/logger"
+)
+
+const (
+	// defaultMeasurement is the default measurement of the status entries.
+	defaultMeasurement = "device_status"
+	// maxCheckInterval is the maximum interval at which devices are checked.
+	maxCheckInterval = 10 * time.Second
+	// statusQueueSize is the number of status entries that are queued for recording.
+	statusQueueSize = 64
+)
+
+// Config configures the heartbeat monitoring.
+type Config struct {
+	Interval    time.Duration     `name:"interval" description:"expected interval between messages of a device. Leave empty to only monitor the devices with an interval in intervals"`
+	Intervals   map[string]string `name:"intervals" description:"expected interval between messages by device ID or username, like '15m'"`
+	Measurement string            `name:"measurement" description:"measurement of the status entries (default 'device_status')"`
+}
+
+// Recorder records entries.
+type Recorder interface {
+	Record(ctx context.Context, e entry.Entry) error
+}
+
+// Status is the status of a device.
+type Status struct {
+	// ID is the tag 'id' of the entries of the device, or the username if the entries have no id.
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Online   bool      `json:"online"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Monitor tracks the last message time of the devices.
+type Monitor struct {
+	c         Config
+	intervals map[string]time.Duration
+	db        Recorder
+	now       func() time.Time
+	statusCh  chan Status
+
+	mu      sync.Mutex
+	devices map[string]*Status
+	// users are the devices by username.
+	users map[string][]*Status
+	// seeded are the devices of intervals that did not send a message since start.
+	seeded map[string]bool
+}
+
+// NewMonitor returns a new Monitor that records status entries in the database.
+func (c Config) NewMonitor(db Recorder) (*Monitor, error) {
+	if c.Interval < 0 {
+		return nil, fmt.Errorf("invalid interval '%s'", c.Interval)
+	}
+	intervals := make(map[string]time.Duration, len(c.Intervals))
+	for id, s := range c.Intervals {
+		interval, err := time.ParseDuration(s)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid interval '%s' of device '%s'", s, id)
+		}
+		intervals[id] = interval
+	}
+	if c.Measurement == "" {
+		c.Measurement = defaultMeasurement
+	}
+	m := &Monitor{
+		c:         c,
+		intervals: intervals,
+		db:        db,
+		now:       time.Now,
+		statusCh:  make(chan Status, statusQueueSize),
+	}
+	m.seed(m.now())
+	return m, nil
+}
+
+// seed monitors the devices of intervals from the start time, so that devices that don't send messages after a
+// restart are recorded offline. The username of a seeded device is assumed to be its ID until it sends a message.
+func (m *Monitor) seed(start time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.devices = make(map[string]*Status, len(m.intervals))
+	m.users = make(map[string][]*Status, len(m.intervals))
+	m.seeded = make(map[string]bool, len(m.intervals))
+	for id := range m.intervals {
+		s := &Status{
+			ID:       id,
+			Username: id,
+			Online:   true,
+			LastSeen: start,
+		}
+		m.devices[id] = s
+		m.users[id] = append(m.users[id], s)
+		m.seeded[id] = true
+	}
+}
+
+// interval returns the expected interval of the device, or zero if the device is not monitored.
+func (m *Monitor) interval(s *Status) time.Duration {
+	if interval, ok := m.intervals[s.ID]; ok {
+		return interval
+	}
+	if interval, ok := m.intervals[s.Username]; ok {
+		return interval
+	}
+	return m.c.Interval
+}
+
+// Listen updates the last message time of the device of a message, including messages that are skipped or could
+// not be parsed. The device is identified by the tag 'id' of the entry, or by the username. Messages without entry
+// count for the only device of the username, or else for the device identified by the username.
+// If the device was offline, it is recorded online.
+func (m *Monitor) Listen(ctx context.Context, e pipeline.Event) {
+	if e.Message == nil {
+		return
+	}
+	username := e.Message.Username
+	id := username
+	if e.Entry != nil && e.Entry.Tags[entry.IDTag] != "" {
+		id = e.Entry.Tags[entry.IDTag]
+	}
+	now := m.now()
+	m.mu.Lock()
+	var s *Status
+	switch devices := m.users[username]; {
+	case e.Entry != nil || len(devices) == 0:
+		s = m.device(id, username)
+	case len(devices) == 1:
+		s = devices[0]
+	default:
+		// The message can't be attributed to one of the devices of the username.
+		if d, ok := m.devices[username]; ok && d.Username == username {
+			s = d
+		}
+	}
+	var recovered *Status
+	if s != nil {
+		s.LastSeen = now
+		if !s.Online {
+			s.Online = true
+			status := *s
+			recovered = &status
+		}
+	}
+	m.mu.Unlock()
+
+	if recovered != nil {
+		logger.LoggerFromContext(ctx).WithField("id", recovered.ID).Info("Device online")
+		m.enqueue(ctx, *recovered)
+	}
+}
+
+// device returns the device with the id, or nil if the device is not monitored.
+// The device is added if it is monitored. This must be called with the lock held.
+func (m *Monitor) device(id, username string) *Status {
+	if id == "" {
+		return nil
+	}
+	if id != username && m.seeded[username] {
+		// The seeded device was a username with devices of its own.
+		delete(m.seeded, username)
+		m.remove(m.devices[username])
+	}
+	if s, ok := m.devices[id]; ok {
+		if m.seeded[id] {
+			// The first message tells the username of a seeded device.
+			delete(m.seeded, id)
+			m.remove(s)
+			s.Username = username
+			m.devices[id] = s
+			m.users[username] = append(m.users[username], s)
+		}
+		return s
+	}
+	s := &Status{
+		ID:       id,
+		Username: username,
+		Online:   true,
+	}
+	if m.interval(s) == 0 {
+		return nil
+	}
+	m.devices[id] = s
+	m.users[username] = append(m.users[username], s)
+	return s
+}
+
+// remove stops monitoring the device. This must be called with the lock held.
+func (m *Monitor) remove(s *Status) {
+	delete(m.devices, s.ID)
+	devices := m.users[s.Username][:0]
+	for _, d := range m.users[s.Username] {
+		if d != s {
+			devices = append(devices, d)
+		}
+	}
+	if len(devices) == 0 {
+		delete(m.users, s.Username)
+	} else {
+		m.users[s.Username] = devices
+	}
+}
+
+// enqueue queues the status entry of the device, so that listening doesn't block on the database.
+func (m *Monitor) enqueue(ctx context.Context, s Status) {
+	select {
+	case m.statusCh <- s:
+	default:
+		logger.LoggerFromContext(ctx).WithField("id", s.ID).Warn("Status queue full, dropping device status")
+	}
+}
+
+// check records the devices offline that exceeded their expected interval.
+func (m *Monitor) check(ctx context.Context) {
+	now := m.now()
+	var offline []Status
+	m.mu.Lock()
+	for _, s := range m.devices {
+		if s.Online && now.Sub(s.LastSeen) > m.interval(s) {
+			s.Online = false
+			offline = append(offline, *s)
+		}
+	}
+	m.mu.Unlock()
+
+	sort.Slice(offline, func(i, j int) bool { return offline[i].ID < offline[j].ID })
+	for _, s := range offline {
+		logger.LoggerFromContext(ctx).WithField("id", s.ID).WithField("last_seen", s.LastSeen).Warn("Device offline")
+		m.record(ctx, s, now)
+	}
+}
+
+// record records the status entry of the device.
+func (m *Monitor) record(ctx context.Context, s Status, now time.Time) {
+	if err := m.db.Record(ctx, entry.Entry{
+		Measurement: m.c.Measurement,
+		Tags: map[string]string{
+			entry.IDTag: s.ID,
+			"username":  s.Username,
+		},
+		Fields: map[string]any{
+			"online":    s.Online,
+			"last_seen": s.LastSeen.Unix(),
+		},
+		Time: now,
+	}); err != nil {
+		logger.LoggerFromContext(ctx).WithError(err).WithField("id", s.ID).Error("Failed to record device status")
+	}
+}
+
+// Devices returns the status of the monitored devices, sorted by ID.
+func (m *Monitor) Devices() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make([]Status, 0, len(m.devices))
+	for _, s := range m.devices {
+		ret = append(ret, *s)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+// Run checks the devices and records the status entries until the context is done.
+// Devices are checked at the smallest expected interval, and at least every 10 seconds.
+func (m *Monitor) Run(ctx context.Context) {
+	interval := maxCheckInterval
+	if m.c.Interval > 0 && m.c.Interval < interval {
+		interval = m.c.Interval
+	}
+	for _, i := range m.intervals {
+		if i < interval {
+			interval = i
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-m.statusCh:
+			// Devices come online when a message is received.
+			m.record(ctx, s, s.LastSeen)
+		case <-ticker.C:
+			m.check(ctx)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package heartbeat
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/mqtt"
+	"krishnaiyer.dev/golang/datasink/pkg/pipeline"
+)
+
+type mockRecorder []entry.Entry
+
+func (r *mockRecorder) Record(ctx context.Context, e entry.Entry) error {
+	*r = append(*r, e)
+	return nil
+}
+
+func TestMonitor(t *testing.T) {
+	ctx := context.Background()
+	db := &mockRecorder{}
+	m, err := Config{
+		Interval:  10 * time.Minute,
+		Intervals: map[string]string{"climate": "1h", "meter-3": "10m"},
+	}.NewMonitor(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	m.now = func() time.Time { return now }
+	// The devices of intervals are monitored from the start, even if they don't send messages.
+	m.seed(start)
+	listen := func(username string, tags map[string]string) {
+		m.Listen(ctx, pipeline.Event{
+			Message: &mqtt.Message{Username: username},
+			Entry:   &entry.Entry{Measurement: "smartmeter", Tags: tags},
+		})
+	}
+
+	listen("meter-1", map[string]string{"id": "meter-1"})
+	// The interval of the username applies to devices without interval of their own.
+	// The seeded username is replaced by its devices.
+	listen("climate", map[string]string{"id": "climate-kitchen"})
+	listen("climate", map[string]string{"id": "climate-bedroom"})
+	// Devices without parsed messages are identified by username.
+	m.Listen(ctx, pipeline.Event{Message: &mqtt.Message{Username: "meter-2"}})
+
+	// Messages that are skipped or could not be parsed count for the only device of the username.
+	now = start.Add(5 * time.Minute)
+	m.Listen(ctx, pipeline.Event{Message: &mqtt.Message{Username: "meter-1"}})
+	// They don't count for any device if the username has multiple devices.
+	m.Listen(ctx, pipeline.Event{Message: &mqtt.Message{Username: "climate"}})
+
+	now = start.Add(11 * time.Minute)
+	m.check(ctx)
+	expected := []Status{
+		{ID: "climate-bedroom", Username: "climate", Online: true, LastSeen: start},
+		{ID: "climate-kitchen", Username: "climate", Online: true, LastSeen: start},
+		{ID: "meter-1", Username: "meter-1", Online: true, LastSeen: start.Add(5 * time.Minute)},
+		{ID: "meter-2", Username: "meter-2", LastSeen: start},
+		{ID: "meter-3", Username: "meter-3", LastSeen: start},
+	}
+	if actual := m.Devices(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, actual)
+	}
+
+	// Offline devices are only recorded once.
+	m.check(ctx)
+	now = start.Add(16 * time.Minute)
+	m.check(ctx)
+	expectedEntries := []entry.Entry{
+		{
+			Measurement: "device_status",
+			Tags:        map[string]string{"id": "meter-2", "username": "meter-2"},
+			Fields:      map[string]any{"online": false, "last_seen": start.Unix()},
+			Time:        start.Add(11 * time.Minute),
+		},
+		{
+			Measurement: "device_status",
+			Tags:        map[string]string{"id": "meter-3", "username": "meter-3"},
+			Fields:      map[string]any{"online": false, "last_seen": start.Unix()},
+			Time:        start.Add(11 * time.Minute),
+		},
+		{
+			Measurement: "device_status",
+			Tags:        map[string]string{"id": "meter-1", "username": "meter-1"},
+			Fields:      map[string]any{"online": false, "last_seen": start.Add(5 * time.Minute).Unix()},
+			Time:        now,
+		},
+	}
+	if !reflect.DeepEqual([]entry.Entry(*db), expectedEntries) {
+		t.Fatalf("expected entries %+v, got %+v", expectedEntries, *db)
+	}
+
+	// Devices that come online are queued, so that listening doesn't block on the database.
+	listen("meter-1", map[string]string{"id": "meter-1"})
+	select {
+	case s := <-m.statusCh:
+		if expected := (Status{ID: "meter-1", Username: "meter-1", Online: true, LastSeen: now}); s != expected {
+			t.Fatalf("expected queued status %+v, got %+v", expected, s)
+		}
+	default:
+		t.Fatal("expected queued status")
+	}
+	if n := len(*db); n != 3 {
+		t.Fatalf("expected 3 entries, got %d", n)
+	}
+
+	// The first message of a seeded device tells its username.
+	m.Listen(ctx, pipeline.Event{
+		Message: &mqtt.Message{Username: "home"},
+		Entry:   &entry.Entry{Measurement: "smartmeter", Tags: map[string]string{"id": "meter-3"}},
+	})
+	select {
+	case s := <-m.statusCh:
+		if expected := (Status{ID: "meter-3", Username: "home", Online: true, LastSeen: now}); s != expected {
+			t.Fatalf("expected queued status %+v, got %+v", expected, s)
+		}
+	default:
+		t.Fatal("expected queued status")
+	}
+}
+
+func TestUnmonitored(t *testing.T) {
+	m, err := Config{Intervals: map[string]string{"meter-1": "1m"}}.NewMonitor(&mockRecorder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"meter-1", "meter-2"} {
+		m.Listen(context.Background(), pipeline.Event{
+			Message: &mqtt.Message{Username: username},
+			Entry:   &entry.Entry{Measurement: "smartmeter"},
+		})
+	}
+	if devices := m.Devices(); len(devices) != 1 || devices[0].ID != "meter-1" {
+		t.Fatalf("expected only meter-1 to be monitored, got %+v", devices)
+	}
+	if _, err := (Config{Intervals: map[string]string{"meter-1": "soon"}}).NewMonitor(&mockRecorder{}); err == nil {
+		t.Fatal("expected error for invalid interval")
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"net/http"
+
+	"krishnaiyer.dev/golang/datasink/pkg/heartbeat"
+)
+
+// DeviceMonitor returns the status of the monitored devices.
+type DeviceMonitor interface {
+	Devices() []heartbeat.Status
+}
+
+// RegisterDeviceMonitor adds the `GET /v1/devices` endpoint that returns the status of the monitored devices.
+// Users get the status of the devices that they may query.
+func (s *Server) RegisterDeviceMonitor(monitor DeviceMonitor) {
+	s.r.Handle("/v1/devices", s.authenticated(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		devices := monitor.Devices()
+		allowed := make([]heartbeat.Status, 0, len(devices))
+		for _, device := range devices {
+			if s.c.Query.canQuery(username, device.ID) {
+				allowed = append(allowed, device)
+			}
+		}
+		writeJSON(w, struct {
+			Devices []heartbeat.Status `json:"devices"`
+		}{allowed})
+	}))).Methods(http.MethodGet)
+}
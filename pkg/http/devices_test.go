@@ -0,0 +1,76 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/heartbeat"
+)
+
+type mockMonitor []heartbeat.Status
+
+func (m mockMonitor) Devices() []heartbeat.Status {
+	return m
+}
+
+func TestDevices(t *testing.T) {
+	lastSeen := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	s, err := New(Config{
+		Query: QueryConfig{
+			IDs:     map[string][]string{"admin": {"*"}},
+			Default: []string{"%u"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.auth = mockStore{"admin": "secret", "meter-1": "secret"}
+	s.RegisterDeviceMonitor(mockMonitor{
+		{ID: "meter-1", Username: "meter-1", Online: true, LastSeen: lastSeen},
+		{ID: "meter-2", Username: "meter-2", LastSeen: lastSeen},
+	})
+
+	for _, tc := range []struct {
+		Username string
+		Body     string
+	}{
+		{
+			Username: "admin",
+			Body: `{"devices":[{"id":"meter-1","username":"meter-1","online":true,"last_seen":"2022-12-01T12:00:00Z"},` +
+				`{"id":"meter-2","username":"meter-2","online":false,"last_seen":"2022-12-01T12:00:00Z"}]}` + "\n",
+		},
+		{
+			Username: "meter-1",
+			Body:     `{"devices":[{"id":"meter-1","username":"meter-1","online":true,"last_seen":"2022-12-01T12:00:00Z"}]}` + "\n",
+		},
+	} {
+		t.Run(tc.Username, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/devices", nil)
+			req.SetBasicAuth(tc.Username, "secret")
+			rec := httptest.NewRecorder()
+			s.r.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+			}
+			if rec.Body.String() != tc.Body {
+				t.Fatalf("expected body %q, got %q", tc.Body, rec.Body.String())
+			}
+		})
+	}
+}
@@ -12,51 +12,98 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// Package http provides a simple HTTP Server for instrumentation.
+// Package http provides a simple HTTP Server for instrumentation and ingestion.
 package http
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/mux"
+	"krishnaiyer.dev/golang/datasink/pkg/auth"
+	"krishnaiyer.dev/golang/datasink/pkg/metrics"
+	authmw "krishnaiyer.dev/golang/datasink/pkg/middleware/auth"
 	"krishnaiyer.dev/golang/dry/pkg/logger"
 )
 
 // Config is the configuration for the HTTP server.
 type Config struct {
-	Addr string `name:"address" description:"server address"`
+	Addr   string       `name:"address" description:"server address"`
+	Auth   auth.Config  `name:"auth" description:"authentication configuration for the ingestion and query endpoints"`
+	Query  QueryConfig  `name:"query" description:"devices that users can query"`
+	Stream StreamConfig `name:"stream" description:"stream endpoint configuration"`
 }
 
 // Server is an HTTP server.
 type Server struct {
-	s *http.Server
-	c Config
+	s      *http.Server
+	c      Config
+	r      *mux.Router
+	auth   auth.Store
+	checks []readinessCheck
 }
 
 // New creates a new Server.
-func New(c Config) *Server {
+// Authenticated endpoints can only be registered if authentication is configured.
+func New(c Config) (*Server, error) {
+	var (
+		store auth.Store
+		err   error
+	)
+	if err := c.Query.validate(); err != nil {
+		return nil, err
+	}
+	if c.Auth.Type != "" {
+		store, err = c.Auth.NewStore()
+		if err != nil {
+			return nil, err
+		}
+	}
 	r := mux.NewRouter()
 	r.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ok"))
 	})
-	return &Server{
-		c: c,
+	r.Handle("/metrics", metrics.Handler())
+	s := &Server{
+		c:    c,
+		r:    r,
+		auth: store,
 		s: &http.Server{
 			Addr:           c.Addr,
 			Handler:        r,
 			ReadTimeout:    10 * time.Second,
 			WriteTimeout:   10 * time.Second,
 			MaxHeaderBytes: 1 << 20,
+			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+				return context.WithValue(ctx, connContextKey{}, c)
+			},
 		},
 	}
+	r.HandleFunc("/readyz", s.handleReady)
+	return s, nil
+}
+
+// authenticated wraps the handler with basic authentication.
+// If authentication is not configured, all requests are rejected.
+func (s *Server) authenticated(next http.Handler) http.Handler {
+	if s.auth == nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Authentication not configured", http.StatusForbidden)
+		})
+	}
+	return authmw.Auth{Store: s.auth}.HTTP(next)
 }
 
 // Start starts the HTTP server.
 func (s *Server) Start(ctx context.Context) error {
 	logger.LoggerFromContext(ctx).WithField("address", s.c.Addr).Info("Start HTTP server")
+	// Handlers use the logger from the server context.
+	s.s.BaseContext = func(net.Listener) context.Context {
+		return ctx
+	}
 	select {
 	case <-ctx.Done():
 		s.s.Shutdown(ctx)
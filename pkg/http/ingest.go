@@ -0,0 +1,97 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/metrics"
+	"krishnaiyer.dev/golang/datasink/pkg/mqtt"
+	"krishnaiyer.dev/golang/datasink/pkg/pipeline"
+	"krishnaiyer.dev/golang/datasink/pkg/topic"
+	"krishnaiyer.dev/golang/dry/pkg/logger"
+)
+
+// maxIngestPayloadSize is the maximum size of a request body on the ingestion endpoint.
+const maxIngestPayloadSize = 256 << 10
+
+// Ingester processes a message.
+type Ingester interface {
+	Process(ctx context.Context, msg *mqtt.Message) (*entry.Entry, error)
+}
+
+// Authorizer checks if a user is allowed to publish to a topic.
+type Authorizer interface {
+	CanPublish(username, clientID, topic string) bool
+}
+
+// RegisterIngester adds the `POST /v1/ingest/{topic}` endpoint.
+// The request body is processed as if it were published by the authenticated user to the topic over MQTT.
+// The messages are counted in the MQTT message metrics.
+func (s *Server) RegisterIngester(ingester Ingester, authorizer Authorizer) {
+	s.r.Handle("/v1/ingest/{topic:.+}", s.authenticated(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		topicName := mux.Vars(r)["topic"]
+		logger := logger.LoggerFromContext(r.Context()).WithField("username", username).WithField("topic", topicName)
+
+		if err := topic.ValidateTopic(topicName); err != nil {
+			logger.WithError(err).Error("Invalid topic")
+			metrics.RejectMessage()
+			http.Error(w, "Invalid topic", http.StatusBadRequest)
+			return
+		}
+		if authorizer != nil && !authorizer.CanPublish(username, "", topicName) {
+			logger.Error("User not allowed to publish to topic")
+			metrics.RejectMessage()
+			http.Error(w, "Not allowed to publish to topic", http.StatusForbidden)
+			return
+		}
+		payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestPayloadSize))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		metrics.MQTTMessages.WithLabelValues(metrics.TopicPrefix(topicName), metrics.ResultAccepted).Inc()
+
+		_, err = ingester.Process(r.Context(), &mqtt.Message{
+			Username: username,
+			Topic:    topicName,
+			Payload:  payload,
+		})
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusAccepted)
+		case errors.Is(err, pipeline.ErrNoDevice):
+			logger.WithError(err).Warn("Skip message")
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, pipeline.ErrParse):
+			logger.WithError(err).Warn("Skip message")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			logger.WithError(err).Error("Error writing to database")
+			http.Error(w, "Error writing to database", http.StatusServiceUnavailable)
+		}
+	}))).Methods(http.MethodPost)
+}
@@ -0,0 +1,116 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/metrics"
+	"krishnaiyer.dev/golang/datasink/pkg/mqtt"
+	"krishnaiyer.dev/golang/datasink/pkg/pipeline"
+)
+
+type mockStore map[string]string
+
+func (s mockStore) Verify(user, pass string) bool {
+	p, ok := s[user]
+	return ok && p == pass
+}
+
+type mockIngester struct {
+	msgs []*mqtt.Message
+}
+
+func (i *mockIngester) Process(ctx context.Context, msg *mqtt.Message) (*entry.Entry, error) {
+	switch string(msg.Payload) {
+	case "invalid":
+		return nil, fmt.Errorf("%w: invalid payload", pipeline.ErrParse)
+	case "unavailable":
+		return nil, fmt.Errorf("%w: connection refused", pipeline.ErrRecord)
+	}
+	if !strings.HasPrefix(msg.Topic, "dsmr/") {
+		return nil, pipeline.ErrNoDevice
+	}
+	i.msgs = append(i.msgs, msg)
+	return &entry.Entry{}, nil
+}
+
+type mockAuthorizer struct{}
+
+func (mockAuthorizer) CanPublish(username, clientID, topic string) bool {
+	return !strings.HasPrefix(topic, "private/")
+}
+
+func TestIngest(t *testing.T) {
+	ingester := &mockIngester{}
+	s, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.auth = mockStore{"test": "secret"}
+	s.RegisterIngester(ingester, mockAuthorizer{})
+	accepted := metrics.MQTTMessages.WithLabelValues("dsmr", metrics.ResultAccepted)
+	rejected := metrics.MQTTMessages.WithLabelValues("", metrics.ResultRejected)
+	acceptedBefore, rejectedBefore := testutil.ToFloat64(accepted), testutil.ToFloat64(rejected)
+
+	for _, tc := range []struct {
+		Name     string
+		Method   string
+		Path     string
+		Password string
+		Body     string
+		Code     int
+	}{
+		{Name: "Accepted", Method: http.MethodPost, Path: "/v1/ingest/dsmr/reading/gas", Password: "secret", Body: "12.3", Code: http.StatusAccepted},
+		{Name: "Unauthenticated", Method: http.MethodPost, Path: "/v1/ingest/dsmr/reading/gas", Password: "wrong", Body: "12.3", Code: http.StatusUnauthorized},
+		{Name: "InvalidTopic", Method: http.MethodPost, Path: "/v1/ingest/dsmr/+/gas", Password: "secret", Body: "12.3", Code: http.StatusBadRequest},
+		{Name: "NotAllowed", Method: http.MethodPost, Path: "/v1/ingest/private/reading", Password: "secret", Body: "12.3", Code: http.StatusForbidden},
+		{Name: "NoDevice", Method: http.MethodPost, Path: "/v1/ingest/home/reading", Password: "secret", Body: "12.3", Code: http.StatusNotFound},
+		{Name: "ParseError", Method: http.MethodPost, Path: "/v1/ingest/dsmr/reading/gas", Password: "secret", Body: "invalid", Code: http.StatusBadRequest},
+		{Name: "DatabaseError", Method: http.MethodPost, Path: "/v1/ingest/dsmr/reading/gas", Password: "secret", Body: "unavailable", Code: http.StatusServiceUnavailable},
+		{Name: "MethodNotAllowed", Method: http.MethodGet, Path: "/v1/ingest/dsmr/reading/gas", Password: "secret", Code: http.StatusMethodNotAllowed},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.Method, tc.Path, strings.NewReader(tc.Body))
+			req.SetBasicAuth("test", tc.Password)
+			rec := httptest.NewRecorder()
+			s.r.ServeHTTP(rec, req)
+			if rec.Code != tc.Code {
+				t.Fatalf("expected status %d, got %d (%s)", tc.Code, rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	// The messages are counted like messages published over MQTT.
+	if n := testutil.ToFloat64(accepted) - acceptedBefore; n != 3 {
+		t.Fatalf("expected 3 accepted messages, got %v", n)
+	}
+	if n := testutil.ToFloat64(rejected) - rejectedBefore; n != 2 {
+		t.Fatalf("expected 2 rejected messages, got %v", n)
+	}
+	if len(ingester.msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(ingester.msgs))
+	}
+	if msg := ingester.msgs[0]; msg.Username != "test" || msg.Topic != "dsmr/reading/gas" || string(msg.Payload) != "12.3" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+}
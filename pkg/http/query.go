@@ -0,0 +1,285 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+	"krishnaiyer.dev/golang/dry/pkg/logger"
+)
+
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+
+	// defaultQueryRange is the time range of queries without start.
+	defaultQueryRange = time.Hour
+	// usernamePlaceholder is replaced with the username in query patterns.
+	usernamePlaceholder = "%u"
+)
+
+// QueryConfig configures which devices users can query.
+// Patterns match the tag 'id' of the series and support '*' wildcards and the '%u' (username) placeholder.
+type QueryConfig struct {
+	IDs     map[string][]string `name:"ids" description:"patterns of the tag 'id' values that users may query"`
+	Default []string            `name:"default" description:"patterns of the tag 'id' values that users without explicit patterns may query. Use '*' to allow all"`
+}
+
+// validate returns an error if a pattern is invalid.
+func (c QueryConfig) validate() error {
+	for username, patterns := range c.IDs {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid query pattern '%s' for user '%s'", pattern, username)
+			}
+		}
+	}
+	for _, pattern := range c.Default {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid default query pattern '%s'", pattern)
+		}
+	}
+	return nil
+}
+
+// canQuery returns true if the user may query the series of the device with the id.
+// Series without id only match the '*' pattern.
+func (c QueryConfig) canQuery(username, id string) bool {
+	patterns, ok := c.IDs[username]
+	if !ok {
+		patterns = c.Default
+	}
+	// Escape the username so that it matches literally.
+	escaped := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`).Replace(username)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ReplaceAll(pattern, usernamePlaceholder, escaped), id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Querier queries the database.
+type Querier interface {
+	Select(ctx context.Context, q query.Query) ([]query.Series, error)
+	Measurements(ctx context.Context) ([]string, error)
+}
+
+// canQueryAll returns true if the user may query the series of all devices, including series without id.
+func (c QueryConfig) canQueryAll(username string) bool {
+	return c.canQuery(username, "")
+}
+
+// RegisterQuerier adds the `GET /v1/measurements` and `GET /v1/series` endpoints.
+// Responses are JSON, or CSV with `format=csv` or `Accept: text/csv`.
+func (s *Server) RegisterQuerier(querier Querier) {
+	s.r.Handle("/v1/measurements", s.authenticated(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format, err := responseFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Measurements are not bound to a device, so only users that may query all series get the measurements.
+		measurements := []string{}
+		if username, _, _ := r.BasicAuth(); s.c.Query.canQueryAll(username) {
+			measurements, err = querier.Measurements(r.Context())
+			if err != nil {
+				logger.LoggerFromContext(r.Context()).WithError(err).Error("Error querying database")
+				http.Error(w, "Error querying database", http.StatusServiceUnavailable)
+				return
+			}
+			if measurements == nil {
+				measurements = []string{}
+			}
+		}
+		if format == formatCSV {
+			records := [][]string{{"measurement"}}
+			for _, measurement := range measurements {
+				records = append(records, []string{measurement})
+			}
+			writeCSV(w, records)
+			return
+		}
+		writeJSON(w, struct {
+			Measurements []string `json:"measurements"`
+		}{measurements})
+	}))).Methods(http.MethodGet)
+
+	s.r.Handle("/v1/series", s.authenticated(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		logger := logger.LoggerFromContext(r.Context()).WithField("username", username)
+		format, err := responseFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q, err := parseSeriesQuery(r, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if id, ok := q.Tags[entry.IDTag]; ok && !s.c.Query.canQuery(username, id) {
+			logger.WithField("id", id).Error("User not allowed to query device")
+			http.Error(w, "Not allowed to query device", http.StatusForbidden)
+			return
+		}
+		res, err := querier.Select(r.Context(), q)
+		if err != nil {
+			logger.WithError(err).Error("Error querying database")
+			http.Error(w, "Error querying database", http.StatusServiceUnavailable)
+			return
+		}
+		// Leave out the series of devices that the user may not query.
+		allowed := make([]query.Series, 0, len(res))
+		for _, series := range res {
+			if s.c.Query.canQuery(username, series.Tags[entry.IDTag]) {
+				allowed = append(allowed, series)
+			}
+		}
+		if format == formatCSV {
+			writeCSV(w, seriesRecords(allowed))
+			return
+		}
+		writeJSON(w, struct {
+			Series []query.Series `json:"series"`
+		}{allowed})
+	}))).Methods(http.MethodGet)
+}
+
+// parseSeriesQuery parses the query parameters of the series endpoint:
+//
+//	measurement=<name>   the measurement (required)
+//	field=<name>         the fields to select, repeated or comma separated
+//	from=<time>          the inclusive start of the time range (default -1h)
+//	to=<time>            the exclusive end of the time range (default now)
+//	every=<duration>     the window to aggregate the values in
+//	fn=<function>        the aggregate function (default mean)
+//	tag.<key>=<value>    the value of a tag
+//
+// Times are RFC3339, 'now' or a duration relative to now, like '-24h'.
+func parseSeriesQuery(r *http.Request, now time.Time) (query.Query, error) {
+	params := r.URL.Query()
+	q := query.Query{
+		Measurement: params.Get("measurement"),
+		Start:       now.Add(-defaultQueryRange),
+		Aggregate:   params.Get("fn"),
+	}
+	for _, fields := range params["field"] {
+		for _, field := range strings.Split(fields, ",") {
+			if field != "" {
+				q.Fields = append(q.Fields, field)
+			}
+		}
+	}
+	var err error
+	if from := params.Get("from"); from != "" {
+		if q.Start, err = query.ParseTime(from, now); err != nil {
+			return query.Query{}, err
+		}
+	}
+	if to := params.Get("to"); to != "" {
+		if q.Stop, err = query.ParseTime(to, now); err != nil {
+			return query.Query{}, err
+		}
+	}
+	if every := params.Get("every"); every != "" {
+		if q.Window, err = time.ParseDuration(every); err != nil || q.Window <= 0 {
+			return query.Query{}, fmt.Errorf("invalid every '%s'", every)
+		}
+	}
+	for key, values := range params {
+		tag := strings.TrimPrefix(key, "tag.")
+		if tag == key {
+			continue
+		}
+		if tag == "" || len(values) != 1 {
+			return query.Query{}, fmt.Errorf("invalid tag parameter '%s'", key)
+		}
+		if q.Tags == nil {
+			q.Tags = make(map[string]string)
+		}
+		q.Tags[tag] = values[0]
+	}
+	return q.Normalize(now)
+}
+
+// responseFormat returns the format of the response from the format parameter or the Accept header.
+func responseFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case formatJSON, formatCSV:
+		return format, nil
+	case "":
+		if strings.Contains(r.Header.Get("Accept"), "text/csv") {
+			return formatCSV, nil
+		}
+		return formatJSON, nil
+	default:
+		return "", fmt.Errorf("invalid format '%s'. Supported values are '%s' and '%s'", format, formatJSON, formatCSV)
+	}
+}
+
+// seriesRecords returns the CSV records of the series, with a row per value.
+// The columns are the measurement, the field, the tags of all series, the time and the value.
+func seriesRecords(series []query.Series) [][]string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, s := range series {
+		for tag := range s.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	header := append(append([]string{"measurement", "field"}, tags...), "time", "value")
+	records := [][]string{header}
+	for _, s := range series {
+		for _, row := range s.Rows {
+			record := make([]string, 0, len(header))
+			record = append(record, s.Measurement, s.Field)
+			for _, tag := range tags {
+				record = append(record, s.Tags[tag])
+			}
+			value := ""
+			if row.Value != nil {
+				value = fmt.Sprint(row.Value)
+			}
+			record = append(record, row.Time.UTC().Format(time.RFC3339Nano), value)
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeCSV(w http.ResponseWriter, records [][]string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	csv.NewWriter(w).WriteAll(records)
+}
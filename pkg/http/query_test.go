@@ -0,0 +1,206 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/query"
+)
+
+type mockQuerier struct {
+	queries []query.Query
+}
+
+func (q *mockQuerier) Select(ctx context.Context, qry query.Query) ([]query.Series, error) {
+	q.queries = append(q.queries, qry)
+	if qry.Measurement == "unavailable" {
+		return nil, errors.New("connection refused")
+	}
+	t := time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC)
+	return []query.Series{
+		{Measurement: qry.Measurement, Field: "power", Tags: map[string]string{"id": "meter-1"}, Rows: []query.Row{{Time: t, Value: 1.5}}},
+		{Measurement: qry.Measurement, Field: "power", Tags: map[string]string{"id": "meter-2", "location": "home"}, Rows: []query.Row{{Time: t, Value: int64(2)}}},
+		{Measurement: qry.Measurement, Field: "power", Tags: map[string]string{}, Rows: []query.Row{{Time: t, Value: "on"}}},
+	}, nil
+}
+
+func (q *mockQuerier) Measurements(ctx context.Context) ([]string, error) {
+	return []string{"climate", "smartmeter"}, nil
+}
+
+func TestQuery(t *testing.T) {
+	querier := &mockQuerier{}
+	s, err := New(Config{
+		Query: QueryConfig{
+			IDs:     map[string][]string{"admin": {"*"}},
+			Default: []string{"%u"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.auth = mockStore{"admin": "secret", "meter-1": "secret", "meter-3": "secret"}
+	s.RegisterQuerier(querier)
+
+	for _, tc := range []struct {
+		Name     string
+		Path     string
+		Username string
+		Accept   string
+		Code     int
+		Body     string
+	}{
+		{
+			Name:     "Measurements",
+			Path:     "/v1/measurements",
+			Username: "admin",
+			Code:     http.StatusOK,
+			Body:     `{"measurements":["climate","smartmeter"]}` + "\n",
+		},
+		{
+			Name:     "MeasurementsCSV",
+			Path:     "/v1/measurements?format=csv",
+			Username: "admin",
+			Code:     http.StatusOK,
+			Body:     "measurement\nclimate\nsmartmeter\n",
+		},
+		{
+			Name:     "MeasurementsRestricted",
+			Path:     "/v1/measurements",
+			Username: "meter-1",
+			Code:     http.StatusOK,
+			Body:     `{"measurements":[]}` + "\n",
+		},
+		{
+			Name:     "SeriesAll",
+			Path:     "/v1/series?measurement=smartmeter",
+			Username: "admin",
+			Accept:   "text/csv",
+			Code:     http.StatusOK,
+			Body: "measurement,field,id,location,time,value\n" +
+				"smartmeter,power,meter-1,,2022-12-01T00:00:00Z,1.5\n" +
+				"smartmeter,power,meter-2,home,2022-12-01T00:00:00Z,2\n" +
+				"smartmeter,power,,,2022-12-01T00:00:00Z,on\n",
+		},
+		{
+			Name:     "SeriesOwned",
+			Path:     "/v1/series?measurement=smartmeter&field=power&from=-24h&every=1h&fn=max",
+			Username: "meter-1",
+			Code:     http.StatusOK,
+			Body:     `{"series":[{"measurement":"smartmeter","field":"power","tags":{"id":"meter-1"},"rows":[{"time":"2022-12-01T00:00:00Z","value":1.5}]}]}` + "\n",
+		},
+		{
+			Name:     "SeriesNone",
+			Path:     "/v1/series?measurement=smartmeter",
+			Username: "meter-3",
+			Code:     http.StatusOK,
+			Body:     `{"series":[]}` + "\n",
+		},
+		{Name: "Forbidden", Path: "/v1/series?measurement=smartmeter&tag.id=meter-2", Username: "meter-1", Code: http.StatusForbidden},
+		{Name: "MissingMeasurement", Path: "/v1/series?field=power", Username: "meter-1", Code: http.StatusBadRequest},
+		{Name: "InvalidTime", Path: "/v1/series?measurement=smartmeter&from=yesterday", Username: "meter-1", Code: http.StatusBadRequest},
+		{Name: "InvalidAggregate", Path: "/v1/series?measurement=smartmeter&every=1h&fn=median", Username: "meter-1", Code: http.StatusBadRequest},
+		{Name: "InvalidFormat", Path: "/v1/series?measurement=smartmeter&format=xml", Username: "meter-1", Code: http.StatusBadRequest},
+		{Name: "DatabaseError", Path: "/v1/series?measurement=unavailable", Username: "meter-1", Code: http.StatusServiceUnavailable},
+		{Name: "Unauthenticated", Path: "/v1/measurements", Username: "unknown", Code: http.StatusUnauthorized},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.Path, nil)
+			req.SetBasicAuth(tc.Username, "secret")
+			if tc.Accept != "" {
+				req.Header.Set("Accept", tc.Accept)
+			}
+			rec := httptest.NewRecorder()
+			s.r.ServeHTTP(rec, req)
+			if rec.Code != tc.Code {
+				t.Fatalf("expected status %d, got %d (%s)", tc.Code, rec.Code, rec.Body.String())
+			}
+			if tc.Body != "" && rec.Body.String() != tc.Body {
+				t.Fatalf("expected body %q, got %q", tc.Body, rec.Body.String())
+			}
+		})
+	}
+
+	var owned *query.Query
+	for i, q := range querier.queries {
+		if q.Window > 0 {
+			owned = &querier.queries[i]
+		}
+	}
+	if owned == nil {
+		t.Fatal("expected an aggregated query")
+	}
+	if owned.Window != time.Hour || owned.Aggregate != query.AggregateMax || !reflect.DeepEqual(owned.Fields, []string{"power"}) {
+		t.Fatalf("unexpected query %+v", owned)
+	}
+	if d := owned.Stop.Sub(owned.Start); d != 24*time.Hour {
+		t.Fatalf("expected range of 24h, got %s", d)
+	}
+}
+
+func TestParseSeriesQuery(t *testing.T) {
+	now := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	req := httptest.NewRequest(http.MethodGet, "/v1/series?measurement=smartmeter&field=power,gas&field=tariff&from=2022-12-01T00:00:00Z&to=-1h&every=15m&tag.id=meter-1", nil)
+	q, err := parseSeriesQuery(req, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := query.Query{
+		Measurement: "smartmeter",
+		Fields:      []string{"power", "gas", "tariff"},
+		Tags:        map[string]string{"id": "meter-1"},
+		Start:       time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC),
+		Stop:        now.Add(-time.Hour),
+		Window:      15 * time.Minute,
+		Aggregate:   query.AggregateMean,
+	}
+	if !reflect.DeepEqual(q, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, q)
+	}
+}
+
+func TestQueryConfig(t *testing.T) {
+	c := QueryConfig{
+		IDs:     map[string][]string{"family": {"meter-*", "climate-kitchen"}},
+		Default: []string{"%u"},
+	}
+	for _, tc := range []struct {
+		Username string
+		ID       string
+		Expected bool
+	}{
+		{Username: "family", ID: "meter-1", Expected: true},
+		{Username: "family", ID: "climate-kitchen", Expected: true},
+		{Username: "family", ID: "climate-garden"},
+		{Username: "family", ID: ""},
+		{Username: "meter-2", ID: "meter-2", Expected: true},
+		{Username: "meter-2", ID: "meter-1"},
+		{Username: "*", ID: "meter-1"},
+	} {
+		if actual := c.canQuery(tc.Username, tc.ID); actual != tc.Expected {
+			t.Fatalf("expected user '%s' to query '%s' to be %t", tc.Username, tc.ID, tc.Expected)
+		}
+	}
+	if err := (QueryConfig{Default: []string{"["}}).validate(); err == nil {
+		t.Fatal("expected error for invalid pattern")
+	}
+}
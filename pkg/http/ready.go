@@ -0,0 +1,110 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	statusOK       = "ok"
+	statusDegraded = "degraded"
+
+	readinessTimeout = 5 * time.Second
+)
+
+// Check checks the status of a component.
+// It returns details to include in the response and an error if the component is degraded.
+type Check func(ctx context.Context) (any, error)
+
+type readinessCheck struct {
+	name     string
+	critical bool
+	check    Check
+}
+
+// ComponentStatus is the status of a component.
+type ComponentStatus struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+	Details  any    `json:"details,omitempty"`
+}
+
+// Readiness is the response of the readiness endpoint.
+type Readiness struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// RegisterCheck registers a check of a component for the readiness endpoint.
+// The server is not ready if a critical component is degraded.
+// Checks must be registered before the server is started.
+func (s *Server) RegisterCheck(name string, critical bool, check Check) {
+	s.checks = append(s.checks, readinessCheck{
+		name:     name,
+		critical: critical,
+		check:    check,
+	})
+}
+
+// handleReady runs the checks and responds with the status of each component.
+// The response code is 503 if a critical component is degraded.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	res := Readiness{
+		Status:     statusOK,
+		Components: make(map[string]ComponentStatus, len(s.checks)),
+	}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, c := range s.checks {
+		wg.Add(1)
+		go func(c readinessCheck) {
+			defer wg.Done()
+			status := ComponentStatus{
+				Status:   statusOK,
+				Critical: c.critical,
+			}
+			details, err := c.check(ctx)
+			status.Details = details
+			if err != nil {
+				status.Status = statusDegraded
+				status.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			res.Components[c.name] = status
+			if err != nil && c.critical {
+				res.Status = statusDegraded
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	if res.Status != statusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,89 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReady(t *testing.T) {
+	ok := func(ctx context.Context) (any, error) {
+		return nil, nil
+	}
+	degraded := func(ctx context.Context) (any, error) {
+		return map[string]int{"length": 64}, errors.New("degraded")
+	}
+
+	for _, tc := range []struct {
+		Name   string
+		Checks map[string]Check
+		Code   int
+		Status string
+	}{
+		{
+			Name:   "Ready",
+			Checks: map[string]Check{"database": ok, "queue": ok},
+			Code:   http.StatusOK,
+			Status: statusOK,
+		},
+		{
+			Name:   "NonCriticalDegraded",
+			Checks: map[string]Check{"database": ok, "queue": degraded},
+			Code:   http.StatusOK,
+			Status: statusOK,
+		},
+		{
+			Name:   "CriticalDegraded",
+			Checks: map[string]Check{"database": degraded, "queue": ok},
+			Code:   http.StatusServiceUnavailable,
+			Status: statusDegraded,
+		},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			s, err := New(Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, check := range tc.Checks {
+				s.RegisterCheck(name, name != "queue", check)
+			}
+			rec := httptest.NewRecorder()
+			s.r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tc.Code {
+				t.Fatalf("expected status code %d, got %d", tc.Code, rec.Code)
+			}
+			var res Readiness
+			if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Status != tc.Status {
+				t.Fatalf("expected status %s, got %s", tc.Status, res.Status)
+			}
+			if len(res.Components) != len(tc.Checks) {
+				t.Fatalf("expected %d components, got %+v", len(tc.Checks), res.Components)
+			}
+			for name, status := range res.Components {
+				if status.Status == statusDegraded && status.Error == "" {
+					t.Fatalf("expected error for degraded component %s", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"krishnaiyer.dev/golang/datasink/pkg/state"
+	"krishnaiyer.dev/golang/dry/pkg/logger"
+)
+
+// StateStore returns the latest values of devices.
+type StateStore interface {
+	Device(id string) []state.Series
+}
+
+// RegisterState adds the `GET /v1/devices/{id}/state` endpoint that returns the latest values of the device.
+// Users can get the state of the devices that they may query.
+func (s *Server) RegisterState(store StateStore) {
+	s.r.Handle("/v1/devices/{id}/state", s.authenticated(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		id := mux.Vars(r)["id"]
+		if !s.c.Query.canQuery(username, id) {
+			logger.LoggerFromContext(r.Context()).WithField("username", username).WithField("id", id).Error("User not allowed to query device")
+			http.Error(w, "Not allowed to query device", http.StatusForbidden)
+			return
+		}
+		series := store.Device(id)
+		if len(series) == 0 {
+			http.Error(w, "No state for device", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, struct {
+			ID     string         `json:"id"`
+			Series []state.Series `json:"series"`
+		}{id, series})
+	}))).Methods(http.MethodGet)
+}
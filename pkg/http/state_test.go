@@ -0,0 +1,82 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/state"
+)
+
+func TestState(t *testing.T) {
+	store, err := state.Config{}.NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Observe(context.Background(), entry.Entry{
+		Measurement: "smartmeter",
+		Tags:        map[string]string{"id": "meter-1"},
+		Fields:      map[string]any{"power": 1.5},
+		Time:        time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC),
+	})
+	s, err := New(Config{
+		Query: QueryConfig{
+			IDs:     map[string][]string{"admin": {"*"}},
+			Default: []string{"%u"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.auth = mockStore{"admin": "secret", "meter-1": "secret"}
+	s.RegisterState(store)
+
+	for _, tc := range []struct {
+		Name     string
+		Path     string
+		Username string
+		Code     int
+		Body     string
+	}{
+		{
+			Name:     "Owned",
+			Path:     "/v1/devices/meter-1/state",
+			Username: "meter-1",
+			Code:     http.StatusOK,
+			Body:     `{"id":"meter-1","series":[{"measurement":"smartmeter","tags":{"id":"meter-1"},"fields":{"power":{"value":1.5,"time":"2022-12-01T00:00:00Z"}}}]}` + "\n",
+		},
+		{Name: "Forbidden", Path: "/v1/devices/meter-2/state", Username: "meter-1", Code: http.StatusForbidden},
+		{Name: "NotFound", Path: "/v1/devices/meter-2/state", Username: "admin", Code: http.StatusNotFound},
+		{Name: "Unauthenticated", Path: "/v1/devices/meter-1/state", Username: "unknown", Code: http.StatusUnauthorized},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.Path, nil)
+			req.SetBasicAuth(tc.Username, "secret")
+			rec := httptest.NewRecorder()
+			s.r.ServeHTTP(rec, req)
+			if rec.Code != tc.Code {
+				t.Fatalf("expected status %d, got %d (%s)", tc.Code, rec.Code, rec.Body.String())
+			}
+			if tc.Body != "" && rec.Body.String() != tc.Body {
+				t.Fatalf("expected body %q, got %q", tc.Body, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/pipeline"
+	"krishnaiyer.dev/golang/datasink/pkg/topic"
+	"krishnaiyer.dev/golang/dry/pkg/logger"
+)
+
+const (
+	// defaultStreamBufferSize is the number of events that are buffered per subscriber by default.
+	defaultStreamBufferSize = 64
+	// streamKeepAliveInterval is the interval of comments that keep idle streams open.
+	streamKeepAliveInterval = 15 * time.Second
+)
+
+// Stream event types.
+const (
+	StreamEventEntry   = "entry"
+	StreamEventMessage = "message"
+	StreamEventError   = "error"
+	// StreamEventDropped reports the number of events that were dropped because the subscriber was too slow.
+	StreamEventDropped = "dropped"
+)
+
+var streamEvents = []string{StreamEventEntry, StreamEventMessage, StreamEventError}
+
+// StreamConfig configures the stream endpoint.
+type StreamConfig struct {
+	BufferSize int `name:"buffer-size" description:"number of events that are buffered per subscriber of the stream endpoint before events are dropped (default 64)"`
+}
+
+// Stream fans out the processed messages to the subscribers of the stream endpoint.
+type Stream struct {
+	bufferSize int
+
+	mu          sync.RWMutex
+	subscribers map[*subscriber]struct{}
+}
+
+// NewStream returns a new Stream.
+func (c StreamConfig) NewStream() (*Stream, error) {
+	if c.BufferSize < 0 {
+		return nil, fmt.Errorf("invalid stream buffer size '%d'", c.BufferSize)
+	}
+	if c.BufferSize == 0 {
+		c.BufferSize = defaultStreamBufferSize
+	}
+	return &Stream{
+		bufferSize:  c.BufferSize,
+		subscribers: make(map[*subscriber]struct{}),
+	}, nil
+}
+
+// Listen sends the event to the subscribers that match it.
+// If the buffer of a subscriber is full, the event is dropped for that subscriber.
+func (s *Stream) Listen(ctx context.Context, e pipeline.Event) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for sub := range s.subscribers {
+		if !sub.match(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+func (s *Stream) subscribe(sub *subscriber) {
+	sub.ch = make(chan pipeline.Event, s.bufferSize)
+	s.mu.Lock()
+	s.subscribers[sub] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *Stream) unsubscribe(sub *subscriber) {
+	s.mu.Lock()
+	delete(s.subscribers, sub)
+	s.mu.Unlock()
+}
+
+// subscriber is a client of the stream endpoint.
+type subscriber struct {
+	// canView returns true if the subscriber may view the event.
+	canView func(e pipeline.Event) bool
+	// events are the event types that the subscriber receives.
+	events      map[string]bool
+	topic       string
+	measurement string
+	username    string
+
+	ch      chan pipeline.Event
+	dropped uint64
+}
+
+// match returns true if the subscriber receives any event of the processed message.
+func (sub *subscriber) match(e pipeline.Event) bool {
+	if sub.topic != "" && !topic.Match(sub.topic, e.Message.Topic) {
+		return false
+	}
+	if sub.username != "" && e.Message.Username != sub.username {
+		return false
+	}
+	if sub.measurement != "" && (e.Entry == nil || e.Entry.Measurement != sub.measurement) {
+		return false
+	}
+	if !sub.events[StreamEventMessage] && !(sub.events[StreamEventEntry] && e.Entry != nil) && !(sub.events[StreamEventError] && e.Err != nil) {
+		return false
+	}
+	return sub.canView(e)
+}
+
+// streamData is the data of a stream event.
+type streamData struct {
+	Username string       `json:"username"`
+	Topic    string       `json:"topic"`
+	Entry    *entry.Entry `json:"entry,omitempty"`
+	Payload  string       `json:"payload,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// connContextKey is the context key of the connection of a request.
+type connContextKey struct{}
+
+// RegisterStream adds the `GET /v1/stream` endpoint that streams the processed messages as Server-Sent Events.
+// Users see the messages that they published and the entries of the devices that they may query.
+func (s *Server) RegisterStream(stream *Stream) {
+	s.r.Handle("/v1/stream", s.authenticated(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _, _ := r.BasicAuth()
+		logger := logger.LoggerFromContext(r.Context()).WithField("username", username)
+		sub, err := parseStreamSubscriber(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sub.canView = func(e pipeline.Event) bool {
+			if e.Message.Username == username {
+				return true
+			}
+			id := ""
+			if e.Entry != nil {
+				id = e.Entry.Tags[entry.IDTag]
+			}
+			return s.c.Query.canQuery(username, id)
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		// Streams outlive the write timeout of the server.
+		if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+			conn.SetWriteDeadline(time.Time{})
+		}
+
+		stream.subscribe(sub)
+		defer stream.unsubscribe(sub)
+		logger.Debug("Subscribe to stream")
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(streamKeepAliveInterval)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			case e := <-sub.ch:
+				if dropped := atomic.SwapUint64(&sub.dropped, 0); dropped > 0 {
+					if err := writeStreamEvent(w, StreamEventDropped, struct {
+						Count uint64 `json:"count"`
+					}{dropped}); err != nil {
+						return
+					}
+				}
+				data := streamData{
+					Username: e.Message.Username,
+					Topic:    e.Message.Topic,
+				}
+				if sub.events[StreamEventMessage] {
+					data := data
+					data.Payload = string(e.Message.Payload)
+					if err := writeStreamEvent(w, StreamEventMessage, data); err != nil {
+						return
+					}
+				}
+				if sub.events[StreamEventEntry] && e.Entry != nil {
+					data := data
+					data.Entry = e.Entry
+					if err := writeStreamEvent(w, StreamEventEntry, data); err != nil {
+						return
+					}
+				}
+				if sub.events[StreamEventError] && e.Err != nil {
+					data := data
+					data.Error = e.Err.Error()
+					if err := writeStreamEvent(w, StreamEventError, data); err != nil {
+						return
+					}
+				}
+			}
+			flusher.Flush()
+		}
+	}))).Methods(http.MethodGet)
+}
+
+// parseStreamSubscriber parses the query parameters of the stream endpoint:
+//
+//	topic=<filter>        the topic filter of the messages
+//	measurement=<name>    the measurement of the entries
+//	username=<name>       the user that published the messages
+//	events=<types>        the event types, comma separated: 'entry' (default), 'message' and 'error'
+func parseStreamSubscriber(r *http.Request) (*subscriber, error) {
+	params := r.URL.Query()
+	sub := &subscriber{
+		events:      make(map[string]bool),
+		topic:       params.Get("topic"),
+		measurement: params.Get("measurement"),
+		username:    params.Get("username"),
+	}
+	if sub.topic != "" {
+		if err := topic.ValidateFilter(sub.topic); err != nil {
+			return nil, fmt.Errorf("invalid topic filter '%s'", sub.topic)
+		}
+	}
+	events := params.Get("events")
+	if events == "" {
+		events = StreamEventEntry
+	}
+	for _, event := range strings.Split(events, ",") {
+		valid := false
+		for _, e := range streamEvents {
+			if event == e {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid event '%s'. Supported values are '%s'", event, strings.Join(streamEvents, "', '"))
+		}
+		sub.events[event] = true
+	}
+	return sub, nil
+}
+
+// writeStreamEvent writes a Server-Sent Event with the JSON encoded data.
+func writeStreamEvent(w http.ResponseWriter, event string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
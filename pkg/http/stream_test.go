@@ -0,0 +1,139 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/mqtt"
+	"krishnaiyer.dev/golang/datasink/pkg/pipeline"
+)
+
+func TestStream(t *testing.T) {
+	ctx := context.Background()
+	stream, err := StreamConfig{}.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Config{
+		Query: QueryConfig{Default: []string{"%u"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.auth = mockStore{"meter-1": "secret"}
+	s.RegisterStream(stream)
+	srv := httptest.NewUnstartedServer(s.s.Handler)
+	srv.Config.ConnContext = s.s.ConnContext
+	srv.Start()
+	defer srv.Close()
+
+	for _, path := range []string{"/v1/stream?events=entry,raw", "/v1/stream?topic=dsmr/%23/reading"} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		req.SetBasicAuth("meter-1", "secret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, path, res.StatusCode)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v1/stream?topic=dsmr/%23&events=entry,message,error", nil)
+	req.SetBasicAuth("meter-1", "secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response %d with content type '%s'", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	for _, e := range []pipeline.Event{
+		// Other topics are filtered.
+		{Message: &mqtt.Message{Username: "meter-1", Topic: "climate/kitchen", Payload: []byte("21")}},
+		// Entries of other devices are not visible.
+		{
+			Message: &mqtt.Message{Username: "meter-2", Topic: "dsmr/reading", Payload: []byte("2")},
+			Entry:   &entry.Entry{Measurement: "smartmeter", Tags: map[string]string{"id": "meter-2"}},
+		},
+		{
+			Message: &mqtt.Message{Username: "meter-1", Topic: "dsmr/reading", Payload: []byte("1.5")},
+			Entry:   &entry.Entry{Measurement: "smartmeter", Tags: map[string]string{"id": "meter-1"}, Fields: map[string]any{"power": 1.5}, Time: time.Date(2022, 12, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			Message: &mqtt.Message{Username: "meter-1", Topic: "dsmr/reading", Payload: []byte("x")},
+			Err:     errors.New("invalid value"),
+		},
+	} {
+		stream.Listen(ctx, e)
+	}
+
+	expected := []string{
+		"event: message",
+		`data: {"username":"meter-1","topic":"dsmr/reading","payload":"1.5"}`,
+		"",
+		"event: entry",
+		`data: {"username":"meter-1","topic":"dsmr/reading","entry":{"measurement":"smartmeter","tags":{"id":"meter-1"},"fields":{"power":1.5},"time":"2022-12-01T00:00:00Z"}}`,
+		"",
+		"event: message",
+		`data: {"username":"meter-1","topic":"dsmr/reading","payload":"x"}`,
+		"",
+		"event: error",
+		`data: {"username":"meter-1","topic":"dsmr/reading","error":"invalid value"}`,
+		"",
+	}
+	scanner := bufio.NewScanner(res.Body)
+	for i, line := range expected {
+		if !scanner.Scan() {
+			t.Fatalf("expected line %d %q, got end of stream", i, line)
+		}
+		if actual := scanner.Text(); actual != line {
+			t.Fatalf("expected line %d %q, got %q", i, line, actual)
+		}
+	}
+}
+
+func TestStreamDrop(t *testing.T) {
+	stream, err := StreamConfig{BufferSize: 1}.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := &subscriber{
+		canView: func(pipeline.Event) bool { return true },
+		events:  map[string]bool{StreamEventMessage: true},
+	}
+	stream.subscribe(sub)
+	for i := 0; i < 3; i++ {
+		stream.Listen(context.Background(), pipeline.Event{Message: &mqtt.Message{Topic: "dsmr/reading"}})
+	}
+	if len(sub.ch) != 1 || sub.dropped != 2 {
+		t.Fatalf("expected 1 buffered and 2 dropped events, got %d and %d", len(sub.ch), sub.dropped)
+	}
+	stream.unsubscribe(sub)
+	if _, err := (StreamConfig{BufferSize: -1}).NewStream(); err == nil {
+		t.Fatal("expected error for negative buffer size")
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics provides the Prometheus metrics of the pipeline.
+package metrics
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"krishnaiyer.dev/golang/datasink/pkg/topic"
+)
+
+const namespace = "datasink"
+
+// Outcomes of parsing a message.
+const (
+	OutcomeParsed     = "parsed"
+	OutcomeSkipped    = "skipped"
+	OutcomeParseError = "parse_error"
+	OutcomeNoDevice   = "no_device"
+)
+
+// Results of a published message.
+const (
+	ResultAccepted = "accepted"
+	ResultRejected = "rejected"
+)
+
+var registry = prometheus.NewRegistry()
+
+var (
+	gatherersMu sync.RWMutex
+	gatherers   = make(map[*prometheus.Gatherer]struct{})
+)
+
+var (
+	// MQTTConnections counts the connections to the MQTT server, including WebSocket connections.
+	MQTTConnections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt",
+		Name:      "connections_total",
+		Help:      "Total number of MQTT connections.",
+	})
+	// MQTTActiveConnections is the number of open connections to the MQTT server.
+	MQTTActiveConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt",
+		Name:      "active_connections",
+		Help:      "Number of open MQTT connections.",
+	})
+	// MQTTAuthFailures counts the connections rejected because of invalid credentials.
+	MQTTAuthFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt",
+		Name:      "auth_failures_total",
+		Help:      "Total number of MQTT connections with invalid credentials.",
+	})
+	// MQTTMessages counts the published messages by the first level of the topic and the result of the access control.
+	MQTTMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt",
+		Name:      "messages_total",
+		Help:      "Total number of published MQTT messages.",
+	}, []string{"prefix", "result"})
+
+	// ParsedMessages counts the parsed messages by device type and outcome.
+	ParsedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "pipeline",
+		Name:      "messages_total",
+		Help:      "Total number of processed messages.",
+	}, []string{"device", "outcome"})
+
+	// DatabaseWriteDuration observes the duration of database writes.
+	DatabaseWriteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "database",
+		Name:      "write_duration_seconds",
+		Help:      "Duration of database writes.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"database"})
+	// DatabaseWriteErrors counts the failed database writes.
+	DatabaseWriteErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "database",
+		Name:      "write_errors_total",
+		Help:      "Total number of failed database writes.",
+	}, []string{"database"})
+	// DatabaseWriteBatchSize observes the number of entries per database write.
+	DatabaseWriteBatchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "database",
+		Name:      "write_batch_size",
+		Help:      "Number of entries per database write.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"database"})
+	// DatabaseSinkDrops counts the entries that are dropped for a sink because its queue is full.
+	DatabaseSinkDrops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "database",
+		Name:      "sink_dropped_total",
+		Help:      "Total number of entries dropped for a sink because its queue is full.",
+	}, []string{"sink"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		MQTTConnections,
+		MQTTActiveConnections,
+		MQTTAuthFailures,
+		MQTTMessages,
+		ParsedMessages,
+		DatabaseWriteDuration,
+		DatabaseWriteErrors,
+		DatabaseWriteBatchSize,
+		DatabaseSinkDrops,
+	)
+}
+
+// TopicPrefix returns the first level of the topic.
+// Only the prefix is used as label to limit the number of time series.
+func TopicPrefix(t string) string {
+	return topic.Split(t)[0]
+}
+
+// RejectMessage counts a rejected message.
+// The topic of a rejected message is chosen by the client, so its prefix is not used as label.
+func RejectMessage() {
+	MQTTMessages.WithLabelValues("", ResultRejected).Inc()
+}
+
+// RegisterMessageQueue registers the length and the capacity of the message queue.
+// This should only be called once.
+func RegisterMessageQueue(length func() int, capacity int) error {
+	if err := registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "pipeline",
+		Name:      "queue_length",
+		Help:      "Number of messages waiting to be processed.",
+	}, func() float64 {
+		return float64(length())
+	})); err != nil {
+		return err
+	}
+	queueCapacity := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "pipeline",
+		Name:      "queue_capacity",
+		Help:      "Capacity of the message queue.",
+	})
+	queueCapacity.Set(float64(capacity))
+	return registry.Register(queueCapacity)
+}
+
+// AddGatherer adds metrics that are served with the metrics of the pipeline, like the values of the Prometheus sink.
+// The returned function removes the gatherer.
+func AddGatherer(g prometheus.Gatherer) func() {
+	key := &g
+	gatherersMu.Lock()
+	gatherers[key] = struct{}{}
+	gatherersMu.Unlock()
+	return func() {
+		gatherersMu.Lock()
+		delete(gatherers, key)
+		gatherersMu.Unlock()
+	}
+}
+
+// gatherAll gathers the metrics of the pipeline and of the added gatherers.
+type gatherAll struct{}
+
+// Gather implements prometheus.Gatherer.
+func (gatherAll) Gather() ([]*dto.MetricFamily, error) {
+	gatherersMu.RLock()
+	gs := make(prometheus.Gatherers, 0, len(gatherers)+1)
+	gs = append(gs, registry)
+	for g := range gatherers {
+		gs = append(gs, *g)
+	}
+	gatherersMu.RUnlock()
+	return gs.Gather()
+}
+
+// Handler returns the HTTP handler that serves the metrics in the Prometheus text format.
+// Metrics that fail to be gathered, like metrics of added gatherers with the same name, are left out.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(gatherAll{}, promhttp.HandlerOpts{
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+}
@@ -0,0 +1,79 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestHandler(t *testing.T) {
+	queue := make(chan struct{}, 4)
+	queue <- struct{}{}
+	if err := RegisterMessageQueue(func() int { return len(queue) }, cap(queue)); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterMessageQueue(func() int { return len(queue) }, cap(queue)); err == nil {
+		t.Fatal("expected error when registering the message queue twice")
+	}
+	MQTTMessages.WithLabelValues(TopicPrefix("dsmr/reading/electricity_delivered_1"), ResultAccepted).Inc()
+	RejectMessage()
+	ParsedMessages.WithLabelValues("smartmeter", OutcomeParsed).Inc()
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`datasink_mqtt_messages_total{prefix="dsmr",result="accepted"} 1`,
+		`datasink_mqtt_messages_total{prefix="",result="rejected"} 1`,
+		`datasink_pipeline_messages_total{device="smartmeter",outcome="parsed"} 1`,
+		`datasink_pipeline_queue_length 1`,
+		`datasink_pipeline_queue_capacity 4`,
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Fatalf("expected %q in metrics:\n%s", line, body)
+		}
+	}
+}
+
+func TestHandlerGatherError(t *testing.T) {
+	remove := AddGatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return nil, errors.New("collision")
+	}))
+	defer remove()
+	ParsedMessages.WithLabelValues("smartmeter", OutcomeParsed).Inc()
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "datasink_pipeline_messages_total") {
+		t.Fatalf("expected the pipeline metrics to be served:\n%s", body)
+	}
+}
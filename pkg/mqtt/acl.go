@@ -0,0 +1,147 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+
+	"krishnaiyer.dev/golang/datasink/pkg/topic"
+)
+
+const (
+	usernamePlaceholder = "%u"
+	clientIDPlaceholder = "%c"
+)
+
+// RejectPolicy defines what happens to a QoS>0 publish that is not allowed by the ACL.
+// QoS 0 publishes are always dropped silently since there's nothing to acknowledge.
+type RejectPolicy string
+
+const (
+	// RejectPolicyDrop acknowledges the publish and drops the message.
+	RejectPolicyDrop RejectPolicy = "drop"
+	// RejectPolicyNack withholds the acknowledgement. MQTT 3.1.1 has no negative acknowledgement
+	// so the client keeps the message in flight and retries it on reconnect.
+	RejectPolicyNack RejectPolicy = "nack"
+	// RejectPolicyDisconnect closes the connection without acknowledging the publish.
+	RejectPolicyDisconnect RejectPolicy = "disconnect"
+)
+
+// ACLConfig configures which topics users are allowed to publish to.
+// Topic filters support the `+` and `#` wildcards and the `%u` (username) and `%c` (client ID) placeholders.
+type ACLConfig struct {
+	Publish      map[string][]string `name:"publish" description:"allowed topic filters per username"`
+	Default      []string            `name:"default" description:"allowed topic filters for users without explicit rules"`
+	RejectPolicy string              `name:"reject-policy" description:"action on rejected QoS>0 publishes. Supported values are 'drop' (default), 'nack' and 'disconnect'"`
+}
+
+// ACL checks publish permissions.
+type ACL struct {
+	publish map[string][][]string
+	def     [][]string
+	policy  RejectPolicy
+}
+
+// NewACL validates the configuration and returns a new ACL.
+// The legacy per-user topic prefixes are merged into the publish rules.
+func (c ACLConfig) NewACL(prefixes map[string]string) (*ACL, error) {
+	acl := &ACL{
+		publish: make(map[string][][]string),
+		policy:  RejectPolicy(c.RejectPolicy),
+	}
+	switch acl.policy {
+	case "":
+		acl.policy = RejectPolicyDrop
+	case RejectPolicyDrop, RejectPolicyNack, RejectPolicyDisconnect:
+	default:
+		return nil, fmt.Errorf("invalid reject policy '%s'", c.RejectPolicy)
+	}
+	for username, filters := range c.Publish {
+		for _, filter := range filters {
+			if err := topic.ValidateFilter(filter); err != nil {
+				return nil, fmt.Errorf("invalid topic filter '%s' for user '%s': %w", filter, username, err)
+			}
+			acl.publish[username] = append(acl.publish[username], topic.Split(filter))
+		}
+	}
+	for username, prefix := range prefixes {
+		filter := prefix + topic.Separator + topic.Wildcard
+		if err := topic.ValidateFilter(filter); err != nil {
+			return nil, fmt.Errorf("invalid topic prefix '%s' for user '%s': %w", prefix, username, err)
+		}
+		acl.publish[username] = append(acl.publish[username], topic.Split(filter))
+	}
+	for _, filter := range c.Default {
+		if err := topic.ValidateFilter(filter); err != nil {
+			return nil, fmt.Errorf("invalid default topic filter '%s': %w", filter, err)
+		}
+		acl.def = append(acl.def, topic.Split(filter))
+	}
+	return acl, nil
+}
+
+// Policy returns the policy for rejected publishes.
+func (acl *ACL) Policy() RejectPolicy {
+	return acl.policy
+}
+
+// CanPublish returns true if the user with the given client ID may publish to the topic.
+func (acl *ACL) CanPublish(username, clientID, t string) bool {
+	filters, ok := acl.publish[username]
+	if !ok {
+		filters = acl.def
+	}
+	topicParts := topic.Split(t)
+	for _, filter := range filters {
+		filter, ok := substitute(filter, username, clientID)
+		if !ok {
+			continue
+		}
+		if topic.MatchPath(filter, topicParts) {
+			return true
+		}
+	}
+	return false
+}
+
+// substitute replaces the placeholders in the filter.
+// Values that would change the structure of the filter are not substituted and the filter is skipped.
+func substitute(filter []string, username, clientID string) ([]string, bool) {
+	var res []string
+	for i, part := range filter {
+		if !strings.Contains(part, "%") {
+			continue
+		}
+		if res == nil {
+			res = make([]string, len(filter))
+			copy(res, filter)
+		}
+		for placeholder, value := range map[string]string{
+			usernamePlaceholder: username,
+			clientIDPlaceholder: clientID,
+		} {
+			if strings.Contains(part, placeholder) && (value == "" || strings.Contains(value, topic.Separator) || topic.IsFilter(value)) {
+				return nil, false
+			}
+		}
+		// Replace in a single pass so that substituted values are not substituted again.
+		res[i] = strings.NewReplacer(usernamePlaceholder, username, clientIDPlaceholder, clientID).Replace(part)
+	}
+	if res == nil {
+		return filter, true
+	}
+	return res, true
+}
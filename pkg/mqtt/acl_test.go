@@ -0,0 +1,84 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	acl, err := ACLConfig{
+		Publish: map[string][]string{
+			"meter":  {"dsmr/#"},
+			"sensor": {"home/+/temperature", "devices/%u/%c/#"},
+		},
+		Default: []string{"public/%u"},
+	}.NewACL(map[string]string{
+		"legacy": "dsmr",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl.Policy() != RejectPolicyDrop {
+		t.Fatalf("expected default policy %s, got %s", RejectPolicyDrop, acl.Policy())
+	}
+
+	for _, tc := range []struct {
+		Name     string
+		Username string
+		ClientID string
+		Topic    string
+		Allowed  bool
+	}{
+		{Name: "MultiLevel", Username: "meter", Topic: "dsmr/reading/electricity_delivered_1", Allowed: true},
+		{Name: "MultiLevelParent", Username: "meter", Topic: "dsmr", Allowed: true},
+		{Name: "MultiLevelOtherTree", Username: "meter", Topic: "home/dsmr", Allowed: false},
+		{Name: "SingleLevel", Username: "sensor", Topic: "home/kitchen/temperature", Allowed: true},
+		{Name: "SingleLevelTooDeep", Username: "sensor", Topic: "home/kitchen/1/temperature", Allowed: false},
+		{Name: "SingleLevelTooShort", Username: "sensor", Topic: "home/temperature", Allowed: false},
+		{Name: "Substitution", Username: "sensor", ClientID: "esp-1", Topic: "devices/sensor/esp-1/up", Allowed: true},
+		{Name: "SubstitutionOtherClient", Username: "sensor", ClientID: "esp-1", Topic: "devices/sensor/esp-2/up", Allowed: false},
+		{Name: "SubstitutionWildcardClient", Username: "sensor", ClientID: "+", Topic: "devices/sensor/esp-2/up", Allowed: false},
+		{Name: "SubstitutionPlaceholderClient", Username: "sensor", ClientID: "%u", Topic: "devices/sensor/%u/up", Allowed: true},
+		{Name: "SubstitutionPlaceholderClientExpanded", Username: "sensor", ClientID: "%u", Topic: "devices/sensor/sensor/up", Allowed: false},
+		{Name: "LegacyPrefix", Username: "legacy", Topic: "dsmr/reading/gas", Allowed: true},
+		{Name: "LegacyPrefixOtherTree", Username: "legacy", Topic: "dsmrx/reading/gas", Allowed: false},
+		{Name: "Default", Username: "guest", Topic: "public/guest", Allowed: true},
+		{Name: "DefaultOtherUser", Username: "guest", Topic: "public/meter", Allowed: false},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			if allowed := acl.CanPublish(tc.Username, tc.ClientID, tc.Topic); allowed != tc.Allowed {
+				t.Fatalf("expected %v, got %v", tc.Allowed, allowed)
+			}
+		})
+	}
+}
+
+func TestACLConfigValidation(t *testing.T) {
+	for _, tc := range []struct {
+		Name   string
+		Config ACLConfig
+	}{
+		{Name: "InvalidPolicy", Config: ACLConfig{RejectPolicy: "ignore"}},
+		{Name: "InvalidFilter", Config: ACLConfig{Publish: map[string][]string{"meter": {"dsmr/#/reading"}}}},
+		{Name: "InvalidDefault", Config: ACLConfig{Default: []string{"dsmr+"}}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			if _, err := tc.Config.NewACL(nil); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
@@ -20,8 +20,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
+	"sync"
 
 	"krishnaiyer.dev/golang/datasink/pkg/auth"
+	"krishnaiyer.dev/golang/datasink/pkg/metrics"
 	"krishnaiyer.dev/golang/dry/pkg/logger"
 
 	"github.com/TheThingsIndustries/mystique/pkg/apex"
@@ -33,10 +37,13 @@ import (
 
 // Config is the configuration for the MQTT server.
 type Config struct {
-	Addr               string            `name:"address" description:"server address"`
-	Debug              bool              `name:"debug" description:"enable debug mode"`
-	Auth               auth.Config       `name:"auth" description:"authentication configuration"`
-	AllowedTopicPrefix map[string]string `name:"allowed-topic-prefix" description:"allowed topic prefix per username"`
+	Addr  string      `name:"address" description:"server address"`
+	Debug bool        `name:"debug" description:"enable debug mode"`
+	Auth  auth.Config `name:"auth" description:"authentication configuration"`
+	TLS   TLSConfig   `name:"tls" description:"TLS listener configuration"`
+	ACL   ACLConfig   `name:"acl" description:"publish access control configuration"`
+	// Deprecated: use ACL.Publish. A prefix `p` is equivalent to the filter `p/#`.
+	AllowedTopicPrefix map[string]string `name:"allowed-topic-prefix" description:"allowed topic prefix per username (deprecated, use acl.publish)"`
 }
 
 // Server is an MQTT server.
@@ -44,7 +51,12 @@ type Server struct {
 	srv   mqtt.Server
 	c     Config
 	auth  auth.Store
+	acl   *ACL
 	msgCh chan *Message
+
+	listenersMu sync.Mutex
+	// listeners are true if bound, by listener name.
+	listeners map[string]bool
 }
 
 // Message is a message received on the MQTT server.
@@ -55,10 +67,16 @@ type Message struct {
 }
 
 type userSession struct {
-	ctx           context.Context
-	username      string
-	allowedPrefix string
-	srv           *Server
+	ctx      context.Context
+	username string
+	clientID string
+	srv      *Server
+	// rejected is set by deliver when a publish is not allowed.
+	// deliver is called synchronously while reading the packet so the reader can act on it.
+	rejected *packet.PublishPacket
+	// rejectedQoS2 are the rejected QoS 2 publishes by packet identifier until they are released.
+	// Retransmissions of a QoS 2 publish are answered without calling deliver, so they are rejected by packet identifier.
+	rejectedQoS2 map[uint16]*packet.PublishPacket
 }
 
 // New creates a new Server.
@@ -70,32 +88,95 @@ func New(ctx context.Context, c Config, messagesCh chan *Message) (*Server, erro
 	if err != nil {
 		return nil, err
 	}
+	acl, err := c.ACL.NewACL(c.AllowedTopicPrefix)
+	if err != nil {
+		return nil, err
+	}
+	listeners := map[string]bool{listenerTCP: false}
+	if c.TLS.Addr != "" {
+		listeners[listenerTLS] = false
+	}
 	return &Server{
-		srv:   mqtt.New(ctx),
-		c:     c,
-		auth:  auth,
-		msgCh: messagesCh,
+		srv:       mqtt.New(ctx),
+		c:         c,
+		auth:      auth,
+		acl:       acl,
+		msgCh:     messagesCh,
+		listeners: listeners,
 	}, nil
 }
 
+// ACL returns the publish access control list of the server.
+func (s *Server) ACL() *ACL {
+	return s.acl
+}
+
+// Listener names.
+const (
+	listenerTCP       = "tcp"
+	listenerTLS       = "tls"
+	listenerWebSocket = "websocket"
+)
+
+// setBound sets whether the listener is bound.
+func (s *Server) setBound(name string, bound bool) {
+	s.listenersMu.Lock()
+	s.listeners[name] = bound
+	s.listenersMu.Unlock()
+}
+
+// CheckListeners returns an error if a configured listener is not bound.
+// The details are the listeners with whether they are bound.
+func (s *Server) CheckListeners(ctx context.Context) (any, error) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	details := make(map[string]bool, len(s.listeners))
+	var unbound []string
+	for name, bound := range s.listeners {
+		details[name] = bound
+		if !bound {
+			unbound = append(unbound, name)
+		}
+	}
+	if len(unbound) > 0 {
+		sort.Strings(unbound)
+		return details, fmt.Errorf("listeners not bound: %s", strings.Join(unbound, ", "))
+	}
+	return details, nil
+}
+
+// CheckAuth returns an error if the auth store is not loaded.
+func (s *Server) CheckAuth(ctx context.Context) (any, error) {
+	if s.auth == nil {
+		return nil, errors.New("auth store not loaded")
+	}
+	return nil, nil
+}
+
 // Start starts the MQTT server.
 func (s *Server) Start(ctx context.Context) error {
-	logger := logger.LoggerFromContext(ctx)
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
 	// Start a TCP listener at the given address.
 	lis, err := mqttnet.Listen("tcp", s.c.Addr)
 	if err != nil {
 		return err
 	}
+	logger.LoggerFromContext(ctx).WithField("address", s.c.Addr).Info("Start MQTT server")
+	s.setBound(listenerTCP, true)
+	defer s.setBound(listenerTCP, false)
+	return s.serve(ctx, lis)
+}
+
+// serve handles incoming connections on the listener until the context is done.
+func (s *Server) serve(ctx context.Context, lis mqttnet.Listener) error {
+	logger := logger.LoggerFromContext(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	defer func() {
 		lis.Close()
-		logger.Info("Stop MQTT server")
+		logger.WithField("address", lis.Addr().String()).Info("Stop MQTT server")
 	}()
 
-	logger.WithField("address", s.c.Addr).Info("Start MQTT server")
-
 	// Loop incoming connections and handle them.
 	for {
 		select {
@@ -116,14 +197,18 @@ func (s *Server) Start(ctx context.Context) error {
 func (s *Server) handleConnection(ctx context.Context, conn mqttnet.Conn) {
 	logger := logger.LoggerFromContext(ctx).WithField("remote_addr", conn.RemoteAddr().String())
 	logger.Info("Connect")
+	metrics.MQTTConnections.Inc()
+	metrics.MQTTActiveConnections.Inc()
 	defer func() {
 		logger.Info("Disconnect")
+		metrics.MQTTActiveConnections.Dec()
 		defer conn.Close()
 	}()
 
 	userSession := &userSession{
-		ctx: ctx,
-		srv: s,
+		ctx:          ctx,
+		srv:          s,
+		rejectedQoS2: make(map[uint16]*packet.PublishPacket),
 	}
 	session := session.New(ctx, conn, userSession.deliver)
 
@@ -135,13 +220,18 @@ func (s *Server) handleConnection(ctx context.Context, conn mqttnet.Conn) {
 	defer session.Close()
 
 	// Check auth and allowed topic access from the incoming connection.
-	if s.auth != nil && !s.auth.Verify(session.AuthInfo().Username, string(session.AuthInfo().Password)) {
+	// Clients with a verified certificate are identified by the common name if configured.
+	username := session.AuthInfo().Username
+	if cn, ok := verifiedCommonName(conn); ok && s.c.TLS.UsernameFromCN {
+		username = cn
+	} else if s.auth != nil && !s.auth.Verify(username, string(session.AuthInfo().Password)) {
 		logger.Error("Invalid credentials for user")
+		metrics.MQTTAuthFailures.Inc()
 		return
 	}
 
-	userSession.allowedPrefix = s.c.AllowedTopicPrefix[session.AuthInfo().Username]
-	userSession.username = session.AuthInfo().Username
+	userSession.username = username
+	userSession.clientID = session.AuthInfo().ClientID
 
 	controlCh := make(chan packet.ControlPacket)
 	errCh := make(chan error, 1)
@@ -154,6 +244,28 @@ func (s *Server) handleConnection(ctx context.Context, conn mqttnet.Conn) {
 				close(errCh)
 				return
 			}
+			pkt := userSession.rejected
+			userSession.rejected = nil
+			switch response := response.(type) {
+			case *packet.PubrecPacket:
+				if pkt != nil {
+					userSession.rejectedQoS2[response.PacketIdentifier] = pkt
+				} else {
+					pkt = userSession.rejectedQoS2[response.PacketIdentifier]
+				}
+			case *packet.PubcompPacket:
+				delete(userSession.rejectedQoS2, response.PacketIdentifier)
+			}
+			if pkt != nil && pkt.QoS > 0 {
+				switch s.acl.Policy() {
+				case RejectPolicyNack:
+					response = nil
+				case RejectPolicyDisconnect:
+					errCh <- fmt.Errorf("user not allowed to publish to topic '%s'", pkt.TopicName)
+					close(errCh)
+					return
+				}
+			}
 			if response != nil {
 				controlCh <- response
 			}
@@ -186,35 +298,30 @@ func (s *Server) handleConnection(ctx context.Context, conn mqttnet.Conn) {
 	}
 }
 
-// TODO: Fix this function to allow wildcards.
-// Currently it doesn't take different sizes of topics into account.
-func isTopicAllowed(requested, allowed []string) bool {
-	for i, part := range requested {
-		if part == allowed[i] || allowed[i] == "#" {
-			continue
-		}
-		return false
-	}
-	return true
-}
-
 // deliver is a callback attached to the initial session to read all submitted packets.
 func (session *userSession) deliver(pkt *packet.PublishPacket) {
 	logger := logger.LoggerFromContext(session.ctx).WithField("username", session.username)
 
 	logger.Info("Message received from client")
 
-	if len(pkt.TopicParts) == 0 || pkt.TopicParts[0] != session.allowedPrefix {
+	if !session.srv.acl.CanPublish(session.username, session.clientID, pkt.TopicName) {
 		logger.WithField("topic", pkt.TopicName).Error("User not allowed to publish to topic")
+		metrics.RejectMessage()
+		session.rejected = pkt
+		return
 	}
+	session.srv.publish(session.ctx, &Message{
+		Username: session.username,
+		Topic:    pkt.TopicName,
+		Payload:  pkt.Message,
+	})
+}
+
+// publish forwards a message to the message channel.
+func (s *Server) publish(ctx context.Context, msg *Message) {
+	metrics.MQTTMessages.WithLabelValues(metrics.TopicPrefix(msg.Topic), metrics.ResultAccepted).Inc()
 	select {
-	case <-session.ctx.Done():
-		return
-	default:
-		session.srv.msgCh <- &Message{
-			Username: session.username,
-			Topic:    pkt.TopicName,
-			Payload:  pkt.Message,
-		}
+	case <-ctx.Done():
+	case s.msgCh <- msg:
 	}
 }
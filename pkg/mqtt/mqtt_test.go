@@ -0,0 +1,176 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+)
+
+func TestCheckListeners(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := &Server{
+		c:         Config{Addr: "127.0.0.1:0"},
+		auth:      mockStore{},
+		listeners: map[string]bool{listenerTCP: false},
+	}
+	if _, err := s.CheckListeners(ctx); err == nil {
+		t.Fatal("expected error before the listener is bound")
+	}
+	if _, err := s.CheckAuth(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Start(ctx)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		details, err := s.CheckListeners(ctx)
+		if err == nil {
+			if bound := details.(map[string]bool)[listenerTCP]; !bound {
+				t.Fatalf("expected listener to be bound, got %v", details)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRejectPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		Policy RejectPolicy
+		// Acked is true if the rejected publish is acknowledged.
+		Acked bool
+		// Disconnected is true if the client is disconnected.
+		Disconnected bool
+	}{
+		{Policy: RejectPolicyDrop, Acked: true},
+		{Policy: RejectPolicyNack},
+		{Policy: RejectPolicyDisconnect, Disconnected: true},
+	} {
+		t.Run(string(tc.Policy), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			acl, err := ACLConfig{
+				Publish:      map[string][]string{"test": {"dsmr/#"}},
+				RejectPolicy: string(tc.Policy),
+			}.NewACL(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgCh := make(chan *Message, 4)
+			s := &Server{
+				auth:  mockStore{"test": "secret"},
+				acl:   acl,
+				msgCh: msgCh,
+			}
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go s.serve(ctx, mqttnet.NewListener(lis, "tcp"))
+
+			inner, err := net.Dial("tcp", lis.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := mqttnet.NewConn(inner, "tcp")
+			defer conn.Close()
+			if err := conn.Send(&packet.ConnectPacket{
+				ProtocolName:  "MQTT",
+				ProtocolLevel: 4,
+				CleanStart:    true,
+				ClientID:      "test",
+				Username:      "test",
+				Password:      []byte("secret"),
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.Receive(); err != nil {
+				t.Fatal(err)
+			}
+			publish := func(id uint16, qos byte, dup bool, topic string) {
+				if err := conn.Send(&packet.PublishPacket{
+					Duplicate:        dup,
+					QoS:              qos,
+					PacketIdentifier: id,
+					TopicName:        topic,
+					Message:          []byte("1234.567"),
+				}); err != nil && !tc.Disconnected {
+					t.Fatal(err)
+				}
+			}
+			receive := func() (packet.ControlPacket, error) {
+				inner.SetReadDeadline(time.Now().Add(time.Second))
+				return conn.Receive()
+			}
+
+			publish(1, 1, false, "home/temperature")
+			if tc.Disconnected {
+				if _, err := receive(); err == nil {
+					t.Fatal("expected the connection to be closed")
+				}
+				return
+			}
+			// A QoS 2 publish that is rejected and retransmitted is handled like the first transmission.
+			publish(2, 2, false, "home/temperature")
+			publish(2, 2, true, "home/temperature")
+			publish(3, 1, false, "dsmr/reading/electricity_delivered_1")
+
+			var expected []packet.ControlPacket
+			if tc.Acked {
+				expected = append(expected,
+					&packet.PubackPacket{PacketIdentifier: 1},
+					&packet.PubrecPacket{PacketIdentifier: 2},
+					&packet.PubrecPacket{PacketIdentifier: 2},
+				)
+			}
+			expected = append(expected, &packet.PubackPacket{PacketIdentifier: 3})
+			for _, e := range expected {
+				pkt, err := receive()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(pkt, e) {
+					t.Fatalf("expected %#v, got %#v", e, pkt)
+				}
+			}
+			select {
+			case msg := <-msgCh:
+				if msg.Topic != "dsmr/reading/electricity_delivered_1" {
+					t.Fatalf("unexpected message on topic '%s'", msg.Topic)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for message")
+			}
+			select {
+			case msg := <-msgCh:
+				t.Fatalf("unexpected message %+v", msg)
+			default:
+			}
+		})
+	}
+}
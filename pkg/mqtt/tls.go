@@ -0,0 +1,99 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
+	"krishnaiyer.dev/golang/dry/pkg/logger"
+)
+
+// TLSConfig is the configuration for the TLS listener.
+type TLSConfig struct {
+	Addr              string `name:"address" description:"TLS server address. Leave empty to disable the TLS listener"`
+	CertFile          string `name:"cert-file" description:"location of the server certificate"`
+	KeyFile           string `name:"key-file" description:"location of the server private key"`
+	CAFile            string `name:"ca-file" description:"location of the CA certificates to verify client certificates"`
+	RequireClientCert bool   `name:"require-client-cert" description:"require clients to present a certificate signed by the CA"`
+	UsernameFromCN    bool   `name:"username-from-cn" description:"use the common name of a verified client certificate as username without checking the password"`
+}
+
+// newTLSConfig loads the certificates and returns the TLS configuration.
+func (c TLSConfig) newTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load server certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.CAFile == "" {
+		if c.RequireClientCert || c.UsernameFromCN {
+			return nil, errors.New("client certificates require a CA file")
+		}
+		return config, nil
+	}
+	pem, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA file: %w", err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file '%s'", c.CAFile)
+	}
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if c.RequireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// StartTLS starts the MQTT server on the TLS listener.
+func (s *Server) StartTLS(ctx context.Context) error {
+	config, err := s.c.TLS.newTLSConfig()
+	if err != nil {
+		return err
+	}
+	inner, err := tls.Listen("tcp", s.c.TLS.Addr, config)
+	if err != nil {
+		return err
+	}
+	logger.LoggerFromContext(ctx).WithField("address", s.c.TLS.Addr).Info("Start MQTT TLS server")
+	s.setBound(listenerTLS, true)
+	defer s.setBound(listenerTLS, false)
+	return s.serve(ctx, mqttnet.NewListener(inner, "tls"))
+}
+
+// verifiedCommonName returns the common name of the client certificate if the connection is TLS and the certificate is verified.
+// The handshake is complete once the CONNECT packet is read.
+func verifiedCommonName(conn mqttnet.Conn) (string, bool) {
+	tlsConn, ok := conn.NetConn().(*tls.Conn)
+	if !ok {
+		return "", false
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	cn := state.VerifiedChains[0][0].Subject.CommonName
+	return cn, cn != ""
+}
@@ -0,0 +1,178 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
+	"github.com/TheThingsIndustries/mystique/pkg/packet"
+)
+
+// newCertificate creates a certificate signed by the parent. If parent is nil, the certificate is self-signed.
+func newCertificate(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writePEM(t *testing.T, name, typ string, b []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTLSUsernameFromCN(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca := newCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := newCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	client := newCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "meter-1"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+	serverKey, err := x509.MarshalPKCS8PrivateKey(server.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := TLSConfig{
+		CertFile:       writePEM(t, "server.pem", "CERTIFICATE", server.Certificate[0]),
+		KeyFile:        writePEM(t, "server-key.pem", "PRIVATE KEY", serverKey),
+		CAFile:         writePEM(t, "ca.pem", "CERTIFICATE", ca.Certificate[0]),
+		UsernameFromCN: true,
+	}
+	tlsConfig, err := c.newTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := ACLConfig{
+		Publish: map[string][]string{
+			"meter-1": {"dsmr/%u/#"},
+		},
+	}.NewACL(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgCh := make(chan *Message, 1)
+	s := &Server{
+		c:     Config{TLS: c},
+		auth:  mockStore{},
+		acl:   acl,
+		msgCh: msgCh,
+	}
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve(ctx, mqttnet.NewListener(lis, "tls"))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	publish := func(t *testing.T, certs []tls.Certificate) (mqttnet.Conn, error) {
+		inner, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := mqttnet.NewConn(inner, "tls")
+		if err := conn.Send(&packet.ConnectPacket{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: 4,
+			CleanStart:    true,
+			ClientID:      "test",
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Receive(); err != nil {
+			t.Fatal(err)
+		}
+		return conn, conn.Send(&packet.PublishPacket{
+			TopicName: "dsmr/meter-1/electricity_delivered_1",
+			Message:   []byte("1234.567"),
+		})
+	}
+
+	t.Run("ClientCertificate", func(t *testing.T) {
+		conn, err := publish(t, []tls.Certificate{client})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		select {
+		case msg := <-msgCh:
+			if msg.Username != "meter-1" || string(msg.Payload) != "1234.567" {
+				t.Fatalf("unexpected message %+v", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for message")
+		}
+	})
+
+	t.Run("NoClientCertificate", func(t *testing.T) {
+		// The server closes the connection so the publish may fail.
+		conn, _ := publish(t, nil)
+		defer conn.Close()
+		select {
+		case msg := <-msgCh:
+			t.Fatalf("unexpected message %+v", msg)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
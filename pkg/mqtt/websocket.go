@@ -0,0 +1,226 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	mqttnet "github.com/TheThingsIndustries/mystique/pkg/net"
+	"golang.org/x/net/websocket"
+	"krishnaiyer.dev/golang/datasink/pkg/metrics"
+	"krishnaiyer.dev/golang/datasink/pkg/topic"
+	"krishnaiyer.dev/golang/dry/pkg/logger"
+)
+
+const (
+	// subprotocolJSON is the WebSocket subprotocol for JSON frames.
+	// Clients that don't request a subprotocol also use JSON frames.
+	subprotocolJSON = "json"
+
+	defaultWebSocketPath = "/"
+)
+
+// mqttSubprotocols are the WebSocket subprotocols for MQTT over WebSocket.
+var mqttSubprotocols = map[string]bool{
+	"mqtt":     true,
+	"mqttv3.1": true,
+}
+
+// WebSocketConfig is the configuration for the WebSocket listener.
+type WebSocketConfig struct {
+	Addr string `name:"address" description:"server address. Leave empty to disable the WebSocket listener"`
+	Path string `name:"path" description:"path of the WebSocket endpoint (default '/')"`
+}
+
+// jsonFrame is a frame in the JSON mode of the WebSocket listener.
+// Clients that can't set the Authorization header on the upgrade request send the credentials in the first frame.
+// Each following frame publishes the payload to the topic. If the payload is a JSON string, the string itself is published.
+// The server only sends frames that contain an error.
+type jsonFrame struct {
+	Username string          `json:"username,omitempty"`
+	Password string          `json:"password,omitempty"`
+	Topic    string          `json:"topic,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// wsConn is an MQTT connection over WebSocket.
+type wsConn struct {
+	mqttnet.Conn
+	remoteAddr net.Addr
+}
+
+// RemoteAddr returns the address of the client instead of the origin of the WebSocket.
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// StartWebSocket starts the WebSocket listener.
+// Clients that request the `mqtt` subprotocol use the same session handling as the TCP listener.
+// Other clients send JSON frames.
+func (s *Server) StartWebSocket(ctx context.Context, c WebSocketConfig) error {
+	logger := logger.LoggerFromContext(ctx)
+	if c.Path == "" {
+		c.Path = defaultWebSocketPath
+	}
+	s.setBound(listenerWebSocket, false)
+	mux := http.NewServeMux()
+	mux.Handle(c.Path, s.webSocketHandler(ctx))
+	srv := &http.Server{
+		Addr:    c.Addr,
+		Handler: mux,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	lis, err := net.Listen("tcp", c.Addr)
+	if err != nil {
+		return err
+	}
+	logger.WithField("address", c.Addr).WithField("path", c.Path).Info("Start WebSocket server")
+	s.setBound(listenerWebSocket, true)
+	defer s.setBound(listenerWebSocket, false)
+	err = srv.Serve(lis)
+	logger.Info("Stop WebSocket server")
+	if errors.Is(err, http.ErrServerClosed) {
+		return ctx.Err()
+	}
+	return err
+}
+
+// webSocketHandler returns the handler for WebSocket connections.
+func (s *Server) webSocketHandler(ctx context.Context) http.Handler {
+	return websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) (err error) {
+			// Devices don't set the origin so it's not checked.
+			config.Origin, err = websocket.Origin(config, req)
+			if err != nil {
+				return err
+			}
+			var selected string
+			for _, protocol := range config.Protocol {
+				if mqttSubprotocols[protocol] || protocol == subprotocolJSON {
+					selected = protocol
+					break
+				}
+			}
+			if len(config.Protocol) > 0 && selected == "" {
+				return fmt.Errorf("no suitable subprotocol")
+			}
+			config.Protocol = nil
+			if selected != "" {
+				config.Protocol = []string{selected}
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			protocol := ""
+			if len(ws.Config().Protocol) > 0 {
+				protocol = ws.Config().Protocol[0]
+			}
+			if !mqttSubprotocols[protocol] {
+				s.handleJSONConnection(ctx, ws)
+				return
+			}
+			ws.PayloadType = websocket.BinaryFrame
+			conn := &wsConn{
+				Conn:       mqttnet.NewConn(ws, "ws"),
+				remoteAddr: ws.RemoteAddr(),
+			}
+			if addr, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr); err == nil {
+				conn.remoteAddr = addr
+			}
+			// handleConnection closes the connection when done so we don't need to do it here.
+			s.handleConnection(ctx, conn)
+		},
+	}
+}
+
+// handleJSONConnection handles a WebSocket connection that sends JSON frames.
+func (s *Server) handleJSONConnection(ctx context.Context, ws *websocket.Conn) {
+	logger := logger.LoggerFromContext(ctx).WithField("remote_addr", ws.Request().RemoteAddr)
+	logger.Info("Connect")
+	metrics.MQTTConnections.Inc()
+	metrics.MQTTActiveConnections.Inc()
+	defer func() {
+		logger.Info("Disconnect")
+		metrics.MQTTActiveConnections.Dec()
+		ws.Close()
+	}()
+
+	username, password, ok := ws.Request().BasicAuth()
+	if !ok {
+		var frame jsonFrame
+		if err := websocket.JSON.Receive(ws, &frame); err != nil {
+			logger.WithError(err).Error("Read auth frame")
+			return
+		}
+		username, password = frame.Username, frame.Password
+	}
+	if s.auth != nil && !s.auth.Verify(username, password) {
+		logger.Error("Invalid credentials for user")
+		metrics.MQTTAuthFailures.Inc()
+		websocket.JSON.Send(ws, jsonFrame{Error: "invalid credentials"})
+		return
+	}
+	logger = logger.WithField("username", username)
+
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.WithError(err).Error("Read frame")
+			}
+			return
+		}
+		var frame jsonFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			websocket.JSON.Send(ws, jsonFrame{Error: fmt.Sprintf("invalid frame: %s", err)})
+			continue
+		}
+		if err := topic.ValidateTopic(frame.Topic); err != nil {
+			websocket.JSON.Send(ws, jsonFrame{Topic: frame.Topic, Error: err.Error()})
+			continue
+		}
+		if !s.acl.CanPublish(username, "", frame.Topic) {
+			logger.WithField("topic", frame.Topic).Error("User not allowed to publish to topic")
+			metrics.RejectMessage()
+			websocket.JSON.Send(ws, jsonFrame{Topic: frame.Topic, Error: "not allowed to publish to topic"})
+			continue
+		}
+		payload := []byte(frame.Payload)
+		var str string
+		if err := json.Unmarshal(frame.Payload, &str); err == nil {
+			payload = []byte(str)
+		}
+		logger.Info("Message received from client")
+		s.publish(ctx, &Message{
+			Username: username,
+			Topic:    frame.Topic,
+			Payload:  payload,
+		})
+	}
+}
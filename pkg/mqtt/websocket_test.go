@@ -0,0 +1,111 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+type mockStore map[string]string
+
+func (s mockStore) Verify(user, pass string) bool {
+	p, ok := s[user]
+	return ok && p == pass
+}
+
+func TestWebSocketJSON(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	acl, err := ACLConfig{
+		Publish: map[string][]string{
+			"test": {"dsmr/#"},
+		},
+	}.NewACL(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgCh := make(chan *Message, 1)
+	s := &Server{
+		auth:  mockStore{"test": "secret"},
+		acl:   acl,
+		msgCh: msgCh,
+	}
+	srv := httptest.NewServer(s.webSocketHandler(ctx))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	dial := func(t *testing.T) *websocket.Conn {
+		config, err := websocket.NewConfig(url, srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws, err := websocket.DialConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ws
+	}
+
+	t.Run("InvalidCredentials", func(t *testing.T) {
+		ws := dial(t)
+		defer ws.Close()
+		if err := websocket.JSON.Send(ws, jsonFrame{Username: "test", Password: "wrong"}); err != nil {
+			t.Fatal(err)
+		}
+		var frame jsonFrame
+		if err := websocket.JSON.Receive(ws, &frame); err != nil {
+			t.Fatal(err)
+		}
+		if frame.Error == "" {
+			t.Fatal("expected error frame")
+		}
+	})
+
+	t.Run("Publish", func(t *testing.T) {
+		ws := dial(t)
+		defer ws.Close()
+		for _, frame := range []string{
+			`{"username":"test","password":"secret"}`,
+			`{"topic":"home/temperature","payload":"21.5"}`,
+			`{"topic":"dsmr/reading/gas","payload":"12.3"}`,
+		} {
+			if err := websocket.Message.Send(ws, frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var frame jsonFrame
+		if err := websocket.JSON.Receive(ws, &frame); err != nil {
+			t.Fatal(err)
+		}
+		if frame.Topic != "home/temperature" || frame.Error == "" {
+			t.Fatalf("expected error frame for rejected topic, got %+v", frame)
+		}
+		select {
+		case msg := <-msgCh:
+			if msg.Username != "test" || msg.Topic != "dsmr/reading/gas" || string(msg.Payload) != "12.3" {
+				t.Fatalf("unexpected message %+v", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for message")
+		}
+	})
+}
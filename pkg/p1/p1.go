@@ -0,0 +1,327 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package p1 reads DSMR telegrams from the P1 port of a smart meter.
+// Telegrams are read from a serial device or from any file or pipe, like a capture of telegrams.
+package p1
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+	"krishnaiyer.dev/golang/datasink/pkg/mqtt"
+	"krishnaiyer.dev/golang/dry/pkg/logger"
+)
+
+const (
+	// DefaultBaud is the baud rate of DSMR 4.x and 5.0 meters. DSMR 2.2 meters use 9600 baud with 7 data bits and even parity.
+	DefaultBaud = 115200
+	// DefaultDataBits is the default number of data bits.
+	DefaultDataBits = 8
+	// DefaultID is the default meter ID.
+	DefaultID = "p1"
+	// DefaultTopic is the default topic on which telegrams are published.
+	DefaultTopic = "dsmr/telegram"
+
+	// serialReadTimeout is the timeout of a single read from a serial device, after which the context is checked.
+	serialReadTimeout = time.Second
+	maxTelegramSize   = 64 << 10
+
+	// initialBackoff is the initial backoff before reopening a serial device.
+	initialBackoff = time.Second
+	// maxBackoff is the maximum backoff before reopening a serial device.
+	maxBackoff = time.Minute
+)
+
+var parities = map[string]serial.Parity{
+	"":     serial.ParityNone,
+	"none": serial.ParityNone,
+	"odd":  serial.ParityOdd,
+	"even": serial.ParityEven,
+}
+
+// Config is the configuration of the P1 reader.
+type Config struct {
+	Path     string `name:"path" description:"serial device, file or pipe to read telegrams from. Leave empty to disable the P1 reader"`
+	Baud     int    `name:"baud" description:"baud rate of the serial device (default 115200)"`
+	DataBits int    `name:"data-bits" description:"data bits of the serial device (default 8)"`
+	Parity   string `name:"parity" description:"parity of the serial device. Supported values are 'none' (default), 'odd' and 'even'"`
+	StopBits int    `name:"stop-bits" description:"stop bits of the serial device (default 1)"`
+	ID       string `name:"id" description:"meter ID that is recorded in the id tag (default 'p1')"`
+	Topic    string `name:"topic" description:"topic on which the telegrams are routed to devices (default 'dsmr/telegram')"`
+}
+
+// Reader reads telegrams and forwards them as messages.
+type Reader struct {
+	c     Config
+	msgCh chan<- *mqtt.Message
+
+	mu        sync.Mutex
+	open      bool
+	done      bool
+	telegrams uint64
+	err       error
+}
+
+// New validates the configuration and returns a new Reader.
+// The telegrams are sent to the message channel as if they were published by the meter ID on the topic.
+func New(c Config, messageCh chan<- *mqtt.Message) (*Reader, error) {
+	if c.Baud == 0 {
+		c.Baud = DefaultBaud
+	}
+	if c.DataBits == 0 {
+		c.DataBits = DefaultDataBits
+	}
+	if c.StopBits == 0 {
+		c.StopBits = 1
+	}
+	if c.ID == "" {
+		c.ID = DefaultID
+	}
+	if c.Topic == "" {
+		c.Topic = DefaultTopic
+	}
+	if _, ok := parities[c.Parity]; !ok {
+		return nil, fmt.Errorf("invalid parity '%s'. Supported values are 'none', 'odd' and 'even'", c.Parity)
+	}
+	if c.StopBits != 1 && c.StopBits != 2 {
+		return nil, fmt.Errorf("invalid stop bits '%d'. Supported values are 1 and 2", c.StopBits)
+	}
+	return &Reader{
+		c:     c,
+		msgCh: messageCh,
+	}, nil
+}
+
+// Start reads telegrams until the context is done.
+// Character devices are opened as serial devices, which are reopened with backoff if they fail, like when the
+// cable is unplugged. Other files are read until the end.
+func (r *Reader) Start(ctx context.Context) error {
+	logger := logger.LoggerFromContext(ctx).WithField("path", r.c.Path)
+	info, err := os.Stat(r.c.Path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeCharDevice == 0 {
+		f, err := os.Open(r.c.Path)
+		if err != nil {
+			return err
+		}
+		logger.Info("Start P1 reader")
+		if err := r.read(ctx, f); err != nil {
+			if ctx.Err() == nil {
+				r.setError(err)
+			}
+			return err
+		}
+		r.mu.Lock()
+		r.done = true
+		r.mu.Unlock()
+		logger.WithField("telegrams", r.count()).Info("P1 file read, stop P1 reader")
+		return nil
+	}
+
+	backoff := initialBackoff
+	for {
+		port, err := r.openSerial(ctx)
+		if err == nil {
+			logger.Info("Start P1 reader")
+			before := r.count()
+			err = r.read(ctx, port)
+			if ctx.Err() != nil {
+				logger.Info("Stop P1 reader")
+				return ctx.Err()
+			}
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			if r.count() > before {
+				backoff = initialBackoff
+			}
+		}
+		r.setError(err)
+		logger.WithError(err).WithField("backoff", backoff).Warn("Failed to read P1 device, reopen")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// read reads telegrams from the source until the end or until the context is done. The source is closed.
+func (r *Reader) read(ctx context.Context, src io.ReadCloser) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		src.Close()
+	}()
+	r.mu.Lock()
+	r.open, r.err = true, nil
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.open = false
+		r.mu.Unlock()
+	}()
+
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 0, 4096), maxTelegramSize)
+	scanner.Split(splitTelegram)
+	for scanner.Scan() {
+		// The scanner reuses its buffer.
+		telegram := append([]byte(nil), scanner.Bytes()...)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case r.msgCh <- &mqtt.Message{
+			Username: r.c.ID,
+			Topic:    r.c.Topic,
+			Payload:  telegram,
+		}:
+		}
+		r.mu.Lock()
+		r.telegrams++
+		r.mu.Unlock()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return scanner.Err()
+}
+
+// setError marks the reader as failed.
+func (r *Reader) setError(err error) {
+	r.mu.Lock()
+	r.open, r.err = false, err
+	r.mu.Unlock()
+}
+
+// count returns the number of telegrams read.
+func (r *Reader) count() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.telegrams
+}
+
+// Check returns an error if the reader is not reading telegrams, unless it has read the whole file.
+func (r *Reader) Check(ctx context.Context) (any, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	details := map[string]any{
+		"open":      r.open,
+		"telegrams": r.telegrams,
+	}
+	switch {
+	case r.open, r.done:
+		return details, nil
+	case r.err != nil:
+		return details, fmt.Errorf("P1 reader failed: %w", r.err)
+	default:
+		return details, errors.New("P1 reader not started")
+	}
+}
+
+// openSerial opens the path as a serial device.
+func (r *Reader) openSerial(ctx context.Context) (io.ReadCloser, error) {
+	port, err := serial.OpenPort(&serial.Config{
+		Name:        r.c.Path,
+		Baud:        r.c.Baud,
+		Size:        byte(r.c.DataBits),
+		Parity:      parities[r.c.Parity],
+		StopBits:    serial.StopBits(r.c.StopBits),
+		ReadTimeout: serialReadTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open serial device '%s': %w", r.c.Path, err)
+	}
+	return &serialPort{
+		ctx:  ctx,
+		path: r.c.Path,
+		port: port,
+	}, nil
+}
+
+// serialPort retries reads that time out until the context is done.
+// A read that times out returns io.EOF, like a read from a device that is removed, so the path is checked.
+type serialPort struct {
+	ctx  context.Context
+	path string
+	port *serial.Port
+}
+
+// Read implements io.Reader.
+func (p *serialPort) Read(b []byte) (int, error) {
+	for {
+		n, err := p.port.Read(b)
+		if n > 0 || !errors.Is(err, io.EOF) {
+			return n, err
+		}
+		if err := p.ctx.Err(); err != nil {
+			return 0, err
+		}
+		if _, err := os.Stat(p.path); err != nil {
+			return 0, fmt.Errorf("serial device '%s' removed: %w", p.path, err)
+		}
+	}
+}
+
+// Close implements io.Closer.
+func (p *serialPort) Close() error {
+	return p.port.Close()
+}
+
+// splitTelegram is a bufio.SplitFunc that frames telegrams from the '/' of the header to the end of the line with the '!' and the CRC.
+// Data before the header is discarded. If a telegram is cut off, the framing restarts at the next header.
+func splitTelegram(data []byte, atEOF bool) (int, []byte, error) {
+	start := bytes.IndexByte(data, '/')
+	if start < 0 {
+		return len(data), nil, nil
+	}
+	end := bytes.IndexByte(data[start:], '!')
+	if end < 0 {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return start, nil, nil
+	}
+	end += start
+	if next := bytes.LastIndexByte(data[start:end], '/'); next > 0 {
+		start += next
+	}
+	eol := bytes.IndexByte(data[end:], '\n')
+	if eol < 0 {
+		if atEOF {
+			return len(data), data[start:], nil
+		}
+		return start, nil, nil
+	}
+	end += eol + 1
+	return end, data[start:end], nil
+}
@@ -0,0 +1,118 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"krishnaiyer.dev/golang/datasink/pkg/device/smartmeter"
+	"krishnaiyer.dev/golang/datasink/pkg/mqtt"
+)
+
+// openPTY opens a pseudo terminal and returns the master and the path of the slave.
+func openPTY(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("pseudo terminals not available: %v", err)
+	}
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		t.Fatal(err)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func TestReadSerial(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	master, path := openPTY(t)
+	defer master.Close()
+
+	data, err := os.ReadFile("testdata/telegrams.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgCh := make(chan *mqtt.Message, 10)
+	r, err := New(Config{Path: path}, msgCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- r.Start(ctx)
+	}()
+	// Wait for the reader to configure the terminal before writing.
+	time.Sleep(100 * time.Millisecond)
+	if _, err := master.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-msgCh:
+			if msg.Username != DefaultID {
+				t.Fatalf("expected meter ID %s, got %s", DefaultID, msg.Username)
+			}
+			if _, err := smartmeter.ParseTelegram(msg.Payload); err != nil {
+				t.Fatalf("invalid telegram %q: %v", msg.Payload, err)
+			}
+		case err := <-errCh:
+			t.Fatalf("reader stopped: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for telegram")
+		}
+	}
+
+	if _, err := r.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reader keeps running when the device is removed.
+	master.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := r.Check(ctx); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the reader to fail")
+		}
+	}
+	select {
+	case err := <-errCh:
+		t.Fatalf("reader stopped: %v", err)
+	default:
+	}
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the reader to stop")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p1
+
+import (
+	"context"
+	"testing"
+
+	"krishnaiyer.dev/golang/datasink/pkg/device/smartmeter"
+	"krishnaiyer.dev/golang/datasink/pkg/mqtt"
+)
+
+func TestReadFile(t *testing.T) {
+	ctx := context.Background()
+	msgCh := make(chan *mqtt.Message, 10)
+	r, err := New(Config{Path: "testdata/telegrams.txt", ID: "meter-1"}, msgCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Check(ctx); err == nil {
+		t.Fatal("expected the reader not to be ready before start")
+	}
+	if err := r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	close(msgCh)
+	// A file that is read until the end is not an error.
+	if _, err := r.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var headers []string
+	for msg := range msgCh {
+		if msg.Username != "meter-1" || msg.Topic != DefaultTopic {
+			t.Fatalf("unexpected message %s on %s", msg.Username, msg.Topic)
+		}
+		telegram, err := smartmeter.ParseTelegram(msg.Payload)
+		if err != nil {
+			t.Fatalf("invalid telegram %q: %v", msg.Payload, err)
+		}
+		headers = append(headers, telegram.Header)
+	}
+	// The capture starts and is cut off in the middle of a telegram.
+	expected := []string{`ISk5\2MT382-1000`, `ISk5\2MT382-1004`, `ISk5\2MT382-1000`}
+	if len(headers) != len(expected) {
+		t.Fatalf("expected telegrams %v, got %v", expected, headers)
+	}
+	for i := range expected {
+		if headers[i] != expected[i] {
+			t.Fatalf("expected telegrams %v, got %v", expected, headers)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	for _, tc := range []struct {
+		Name   string
+		Config Config
+	}{
+		{Name: "InvalidParity", Config: Config{Path: "/dev/ttyUSB0", Parity: "mark"}},
+		{Name: "InvalidStopBits", Config: Config{Path: "/dev/ttyUSB0", StopBits: 3}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			if _, err := New(tc.Config, nil); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pipeline parses incoming messages and records them in the database.
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database"
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+	"krishnaiyer.dev/golang/datasink/pkg/device"
+	"krishnaiyer.dev/golang/datasink/pkg/metrics"
+	"krishnaiyer.dev/golang/datasink/pkg/mqtt"
+	"krishnaiyer.dev/golang/dry/pkg/logger"
+)
+
+var (
+	// ErrNoDevice is returned when no device is configured for the topic of a message.
+	ErrNoDevice = errors.New("no device found")
+	// ErrParse is returned when the device could not parse the message.
+	ErrParse = errors.New("parse message")
+	// ErrRecord is returned when the entry could not be written to the database.
+	ErrRecord = errors.New("write to database")
+)
+
+// Devices returns the device that parses messages on a topic.
+type Devices interface {
+	GetParser(ctx context.Context, key string) (device.Device, error)
+}
+
+// Observer observes the entries that are parsed from messages.
+// Observers are called before the entry is recorded and must not block.
+type Observer interface {
+	Observe(ctx context.Context, e entry.Entry)
+}
+
+// Event is the outcome of processing a message.
+type Event struct {
+	Message *mqtt.Message
+	// Entry is the parsed entry. It is nil if the message could not be parsed or the device skipped it.
+	Entry *entry.Entry
+	// Err is the error if the message could not be processed.
+	Err error
+}
+
+// Listener listens to the outcome of every processed message.
+// Listeners are called after the entry is recorded and must not block.
+type Listener interface {
+	Listen(ctx context.Context, e Event)
+}
+
+// Pipeline parses messages with the configured devices and records the entries in the database.
+type Pipeline struct {
+	devices   Devices
+	db        database.Database
+	observers []Observer
+	listeners []Listener
+}
+
+// New returns a new Pipeline.
+func New(devices Devices, db database.Database) *Pipeline {
+	return &Pipeline{
+		devices: devices,
+		db:      db,
+	}
+}
+
+// AddObserver adds an observer of the parsed entries. Observers must be added before messages are processed.
+func (p *Pipeline) AddObserver(o Observer) {
+	p.observers = append(p.observers, o)
+}
+
+// AddListener adds a listener of the processed messages. Listeners must be added before messages are processed.
+func (p *Pipeline) AddListener(l Listener) {
+	p.listeners = append(p.listeners, l)
+}
+
+// Process parses a single message and records the resulting entry.
+// The entry returned could be nil without error if the device skipped the message.
+func (p *Pipeline) Process(ctx context.Context, msg *mqtt.Message) (*entry.Entry, error) {
+	entry, err := p.process(ctx, msg)
+	for _, l := range p.listeners {
+		l.Listen(ctx, Event{
+			Message: msg,
+			Entry:   entry,
+			Err:     err,
+		})
+	}
+	return entry, err
+}
+
+func (p *Pipeline) process(ctx context.Context, msg *mqtt.Message) (*entry.Entry, error) {
+	parser, err := p.devices.GetParser(ctx, msg.Topic)
+	if err != nil {
+		metrics.ParsedMessages.WithLabelValues("", metrics.OutcomeNoDevice).Inc()
+		return nil, fmt.Errorf("%w: %v", ErrNoDevice, err)
+	}
+	typ := device.TypeOf(parser)
+	entry, err := parser.Parse(ctx, msg.Username, msg.Topic, msg.Payload)
+	if err != nil {
+		metrics.ParsedMessages.WithLabelValues(typ, metrics.OutcomeParseError).Inc()
+		return nil, fmt.Errorf("%w: %v", ErrParse, err)
+	}
+	if entry == nil {
+		metrics.ParsedMessages.WithLabelValues(typ, metrics.OutcomeSkipped).Inc()
+		return nil, nil
+	}
+	metrics.ParsedMessages.WithLabelValues(typ, metrics.OutcomeParsed).Inc()
+	for _, o := range p.observers {
+		o.Observe(ctx, *entry)
+	}
+	if err := p.db.Record(ctx, *entry); err != nil {
+		return entry, fmt.Errorf("%w: %v", ErrRecord, err)
+	}
+	return entry, nil
+}
+
+// Run processes messages from the channel until the context is done.
+func (p *Pipeline) Run(ctx context.Context, messageCh <-chan *mqtt.Message) {
+	logger := logger.LoggerFromContext(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-messageCh:
+			if msg == nil {
+				continue
+			}
+			_, err := p.Process(ctx, msg)
+			switch {
+			case err == nil:
+			case errors.Is(err, ErrRecord):
+				logger.WithError(err).Error("Error writing to database")
+			default:
+				logger.WithError(err).Warn("Skip message")
+			}
+		}
+	}
+}
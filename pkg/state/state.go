@@ -0,0 +1,210 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package state keeps the latest value of every field of every measurement and tag set in memory.
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+)
+
+// Config configures the state.
+type Config struct {
+	File string `name:"file" description:"file that the state is saved to on shutdown and loaded from on start. Leave empty to keep the state in memory only"`
+}
+
+// Value is the latest value of a field.
+type Value struct {
+	Value any       `json:"value"`
+	Time  time.Time `json:"time"`
+}
+
+// Series are the latest values of the fields of a measurement with a set of tags.
+type Series struct {
+	Measurement string            `json:"measurement"`
+	Tags        map[string]string `json:"tags"`
+	Fields      map[string]Value  `json:"fields"`
+}
+
+// Store keeps the latest values.
+type Store struct {
+	cfg Config
+	now func() time.Time
+
+	mu     sync.RWMutex
+	series map[string]*Series
+}
+
+// NewStore returns a new store. If a file is configured and exists, the saved state is loaded.
+// Numbers in a saved state are loaded as floats.
+func (c Config) NewStore() (*Store, error) {
+	s := &Store{
+		cfg:    c,
+		now:    time.Now,
+		series: make(map[string]*Series),
+	}
+	if c.File == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(c.File)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved []Series
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("invalid state file '%s': %w", c.File, err)
+	}
+	for i := range saved {
+		series := saved[i]
+		if series.Tags == nil {
+			series.Tags = make(map[string]string)
+		}
+		if series.Fields == nil {
+			series.Fields = make(map[string]Value)
+		}
+		s.series[seriesKey(series.Measurement, series.Tags)] = &series
+	}
+	return s, nil
+}
+
+// Observe updates the latest values with the fields of the entry.
+// Entries without time are observed at the current time. Values that are older than the latest value are ignored.
+func (s *Store) Observe(ctx context.Context, e entry.Entry) {
+	if e.Time.IsZero() {
+		e.Time = s.now()
+	}
+	key := seriesKey(e.Measurement, e.Tags)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	series, ok := s.series[key]
+	if !ok {
+		tags := make(map[string]string, len(e.Tags))
+		for k, v := range e.Tags {
+			tags[k] = v
+		}
+		series = &Series{
+			Measurement: e.Measurement,
+			Tags:        tags,
+			Fields:      make(map[string]Value, len(e.Fields)),
+		}
+		s.series[key] = series
+	}
+	for field, value := range e.Fields {
+		if latest, ok := series.Fields[field]; ok && latest.Time.After(e.Time) {
+			continue
+		}
+		series.Fields[field] = Value{
+			Value: value,
+			Time:  e.Time,
+		}
+	}
+}
+
+// Device returns the latest values of the series with the tag 'id' of the device, sorted by measurement and tags.
+func (s *Store) Device(id string) []Series {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []string
+	for key, series := range s.series {
+		if series.Tags[entry.IDTag] == id {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	ret := make([]Series, 0, len(keys))
+	for _, key := range keys {
+		ret = append(ret, s.series[key].copy())
+	}
+	return ret
+}
+
+// Save writes the state to the configured file. The file is replaced atomically.
+// Without file, this does nothing.
+func (s *Store) Save() error {
+	if s.cfg.File == "" {
+		return nil
+	}
+	s.mu.RLock()
+	keys := entry.SortedKeys(s.series)
+	saved := make([]Series, 0, len(keys))
+	for _, key := range keys {
+		saved = append(saved, s.series[key].copy())
+	}
+	s.mu.RUnlock()
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.cfg.File), filepath.Base(s.cfg.File)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.cfg.File)
+}
+
+// copy returns a copy of the series that is safe to use without the lock.
+func (s *Series) copy() Series {
+	ret := Series{
+		Measurement: s.Measurement,
+		Tags:        make(map[string]string, len(s.Tags)),
+		Fields:      make(map[string]Value, len(s.Fields)),
+	}
+	for k, v := range s.Tags {
+		ret.Tags[k] = v
+	}
+	for k, v := range s.Fields {
+		ret.Fields[k] = v
+	}
+	return ret
+}
+
+// seriesKey returns the key of a measurement with a set of tags.
+func seriesKey(measurement string, tags map[string]string) string {
+	var b strings.Builder
+	b.WriteString(measurement)
+	for _, key := range entry.SortedKeys(tags) {
+		b.WriteByte(0)
+		b.WriteString(key)
+		b.WriteByte(0)
+		b.WriteString(tags[key])
+	}
+	return b.String()
+}
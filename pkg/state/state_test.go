@@ -0,0 +1,89 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"krishnaiyer.dev/golang/datasink/pkg/database/entry"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "state.json")
+	s, err := Config{File: file}.NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t1 := time.Date(2022, 12, 1, 12, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Minute)
+	s.now = func() time.Time { return t2 }
+	for _, e := range []entry.Entry{
+		{Measurement: "smartmeter", Tags: map[string]string{"id": "meter-1"}, Fields: map[string]any{"power": 1.5, "gas": 10.0}, Time: t1},
+		// Entries without time are observed now.
+		{Measurement: "smartmeter", Tags: map[string]string{"id": "meter-1"}, Fields: map[string]any{"power": 2.5}},
+		// Older values are ignored.
+		{Measurement: "smartmeter", Tags: map[string]string{"id": "meter-1"}, Fields: map[string]any{"power": 0.5, "gas": 9.0}, Time: t1.Add(-time.Minute)},
+		{Measurement: "climate", Tags: map[string]string{"id": "meter-1", "room": "kitchen"}, Fields: map[string]any{"temperature": 21.0}, Time: t1},
+		{Measurement: "smartmeter", Tags: map[string]string{"id": "meter-2"}, Fields: map[string]any{"power": 3.5}, Time: t1},
+	} {
+		s.Observe(ctx, e)
+	}
+	expected := []Series{
+		{
+			Measurement: "climate",
+			Tags:        map[string]string{"id": "meter-1", "room": "kitchen"},
+			Fields:      map[string]Value{"temperature": {Value: 21.0, Time: t1}},
+		},
+		{
+			Measurement: "smartmeter",
+			Tags:        map[string]string{"id": "meter-1"},
+			Fields:      map[string]Value{"power": {Value: 2.5, Time: t2}, "gas": {Value: 10.0, Time: t1}},
+		},
+	}
+	if actual := s.Device("meter-1"); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, actual)
+	}
+	if actual := s.Device("meter-3"); len(actual) != 0 {
+		t.Fatalf("expected no state, got %+v", actual)
+	}
+
+	// The state survives a restart.
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = Config{File: file}.NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := s.Device("meter-1"); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %+v after restart, got %+v", expected, actual)
+	}
+}
+
+func TestInvalidFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(file, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (Config{File: file}).NewStore(); err == nil {
+		t.Fatal("expected error for invalid file")
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright © 2022 Krishna Iyer Easwaran
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package topic matches MQTT topics against topic filters.
+package topic
+
+import (
+	"strings"
+
+	mqtttopic "github.com/TheThingsIndustries/mystique/pkg/topic"
+)
+
+const (
+	// Separator separates topic levels.
+	Separator = mqtttopic.Separator
+	// Wildcard matches any number of levels. It must be the last level of a filter.
+	Wildcard = mqtttopic.Wildcard
+	// PartWildcard matches exactly one level.
+	PartWildcard = mqtttopic.PartWildcard
+)
+
+// Split splits a topic into levels.
+func Split(topic string) []string {
+	return mqtttopic.Split(topic)
+}
+
+// Join joins topic levels.
+func Join(parts []string) string {
+	return mqtttopic.Join(parts)
+}
+
+// Match returns true if the topic matches the filter.
+// A trailing multi-level wildcard also matches the parent level, so `dsmr/#` matches `dsmr`.
+func Match(filter, topic string) bool {
+	return MatchPath(Split(filter), Split(topic))
+}
+
+// MatchPath is Match for topics and filters that are already split into levels.
+func MatchPath(filter, topic []string) bool {
+	if len(filter) == 0 || len(topic) == 0 {
+		return false
+	}
+	if mqtttopic.MatchPath(topic, filter) {
+		return true
+	}
+	n := len(filter)
+	if n > 1 && filter[n-1] == Wildcard && len(topic) == n-1 {
+		return mqtttopic.MatchPath(topic, filter[:n-1])
+	}
+	return false
+}
+
+// ValidateTopic validates a topic name.
+func ValidateTopic(topic string) error {
+	return mqtttopic.ValidateTopic(topic)
+}
+
+// ValidateFilter validates a topic filter.
+func ValidateFilter(filter string) error {
+	return mqtttopic.ValidateFilter(filter)
+}
+
+// IsFilter returns true if the string contains wildcards.
+func IsFilter(s string) bool {
+	return strings.ContainsAny(s, Wildcard+PartWildcard)
+}